@@ -0,0 +1,141 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Event represents a single event, as emitted by gerrit's stream-events command,
+// the events-log plugin or the webhooks plugin.
+// Only the fields relevant to the submit queue are parsed.
+//
+// Gerrit docs: https://gerrit-review.googlesource.com/Documentation/cmd-stream-events.html#events
+type Event struct {
+	Type           string     `json:"type"`
+	Change         *Change    `json:"change,omitempty"`
+	PatchSet       *PatchSet  `json:"patchSet,omitempty"`
+	Approvals      []Approval `json:"approvals,omitempty"`
+	RefUpdate      *RefUpdate `json:"refUpdate,omitempty"`
+	EventCreatedOn int64      `json:"eventCreatedOn,omitempty"`
+}
+
+// Change contains the attributes of a change an event refers to
+type Change struct {
+	Project string      `json:"project"`
+	Branch  string      `json:"branch"`
+	Topic   string      `json:"topic,omitempty"`
+	ID      string      `json:"id"`
+	Number  json.Number `json:"number"`
+	Subject string      `json:"subject"`
+	Status  string      `json:"status,omitempty"`
+	URL     string      `json:"url,omitempty"`
+}
+
+// PatchSet contains the attributes of a patchset an event refers to
+type PatchSet struct {
+	Number   json.Number `json:"number"`
+	Revision string      `json:"revision"`
+	Parents  []string    `json:"parents,omitempty"`
+}
+
+// Approval contains a single label vote of a comment-added event.
+// OldValue is only set if the vote was changed by this comment.
+type Approval struct {
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+	OldValue string `json:"oldValue,omitempty"`
+}
+
+// RefUpdate contains the attributes of a ref-updated event
+type RefUpdate struct {
+	OldRev  string `json:"oldRev"`
+	NewRev  string `json:"newRev"`
+	RefName string `json:"refName"`
+	Project string `json:"project"`
+}
+
+// The event types the submit queue cares about
+const (
+	TypeCommentAdded    = "comment-added"
+	TypeRefUpdated      = "ref-updated"
+	TypePatchsetCreated = "patchset-created"
+	TypeChangeAbandoned = "change-abandoned"
+)
+
+// ParseEvent parses a single JSON-encoded event
+func ParseEvent(data []byte) (*Event, error) {
+	var event Event
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, fmt.Errorf("unable to parse event: %w", err)
+	}
+	if event.Type == "" {
+		return nil, fmt.Errorf("event without type")
+	}
+	return &event, nil
+}
+
+// Project returns the name of the project the event refers to
+func (e *Event) Project() string {
+	if e.Change != nil {
+		return e.Change.Project
+	}
+	if e.RefUpdate != nil {
+		return e.RefUpdate.Project
+	}
+	return ""
+}
+
+// Branch returns the short name of the branch the event refers to.
+// For ref-updated events on something else than a branch, an empty string is returned.
+func (e *Event) Branch() string {
+	if e.Change != nil {
+		return e.Change.Branch
+	}
+	if e.RefUpdate != nil {
+		refName := e.RefUpdate.RefName
+		if strings.HasPrefix(refName, "refs/heads/") {
+			return strings.TrimPrefix(refName, "refs/heads/")
+		}
+		// older gerrit versions send the short branch name
+		if !strings.HasPrefix(refName, "refs/") {
+			return refName
+		}
+	}
+	return ""
+}
+
+// Matches returns true if the event refers to the given project and branch
+func (e *Event) Matches(projectName, branchName string) bool {
+	return e.Project() == projectName && e.Branch() == branchName
+}
+
+// IsRelevant returns true if the event could change the state of the submit queue:
+//   - a comment changing a label vote
+//   - a ref update (the target branch might have moved)
+//   - a new patchset
+//   - an abandoned change
+func (e *Event) IsRelevant() bool {
+	switch e.Type {
+	case TypeCommentAdded:
+		for _, approval := range e.Approvals {
+			if approval.OldValue != "" && approval.OldValue != approval.Value {
+				return true
+			}
+		}
+		return false
+	case TypeRefUpdated:
+		return e.RefUpdate != nil && e.Branch() != ""
+	case TypePatchsetCreated, TypeChangeAbandoned:
+		return true
+	default:
+		return false
+	}
+}
+
+func (e *Event) String() string {
+	if e.Change != nil {
+		return fmt.Sprintf("Event(%s, %s/%s #%s)", e.Type, e.Project(), e.Branch(), e.Change.Number)
+	}
+	return fmt.Sprintf("Event(%s, %s/%s)", e.Type, e.Project(), e.Branch())
+}
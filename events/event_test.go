@@ -0,0 +1,65 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseEvent(t *testing.T) {
+	event, err := ParseEvent([]byte(`{"type":"comment-added","change":{"project":"depot","branch":"master","id":"I0123","number":42,"subject":"foo"},"approvals":[{"type":"Verified","value":"1","oldValue":"0"}],"eventCreatedOn":1600000000}`))
+	assert.NoError(t, err)
+	assert.Equal(t, TypeCommentAdded, event.Type)
+	assert.Equal(t, "depot", event.Project())
+	assert.Equal(t, "master", event.Branch())
+	assert.Equal(t, "42", event.Change.Number.String())
+	assert.True(t, event.IsRelevant(), "a comment changing a vote should be relevant")
+
+	// older gerrit versions send the change number as a string
+	event, err = ParseEvent([]byte(`{"type":"patchset-created","change":{"project":"depot","branch":"master","number":"42"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "42", event.Change.Number.String())
+
+	_, err = ParseEvent([]byte(`{"change":{}}`))
+	assert.Error(t, err, "events without type should be rejected")
+
+	_, err = ParseEvent([]byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestIsRelevant(t *testing.T) {
+	commentWithoutVote := &Event{
+		Type:      TypeCommentAdded,
+		Approvals: []Approval{{Type: "Code-Review", Value: "2"}},
+	}
+	assert.False(t, commentWithoutVote.IsRelevant(), "a comment not changing a vote should not be relevant")
+
+	commentWithSameVote := &Event{
+		Type:      TypeCommentAdded,
+		Approvals: []Approval{{Type: "Code-Review", Value: "2", OldValue: "2"}},
+	}
+	assert.False(t, commentWithSameVote.IsRelevant(), "a comment not changing a vote should not be relevant")
+
+	refUpdated := &Event{
+		Type:      TypeRefUpdated,
+		RefUpdate: &RefUpdate{RefName: "refs/heads/master", Project: "depot"},
+	}
+	assert.True(t, refUpdated.IsRelevant())
+	assert.True(t, refUpdated.Matches("depot", "master"))
+	assert.False(t, refUpdated.Matches("depot", "main"))
+
+	refUpdatedShortName := &Event{
+		Type:      TypeRefUpdated,
+		RefUpdate: &RefUpdate{RefName: "master", Project: "depot"},
+	}
+	assert.True(t, refUpdatedShortName.Matches("depot", "master"), "short ref names should be treated as branches")
+
+	changeRefUpdated := &Event{
+		Type:      TypeRefUpdated,
+		RefUpdate: &RefUpdate{RefName: "refs/changes/42/42/1", Project: "depot"},
+	}
+	assert.False(t, changeRefUpdated.IsRelevant(), "updates to refs other than branches should not be relevant")
+
+	assert.True(t, (&Event{Type: TypeChangeAbandoned}).IsRelevant())
+	assert.False(t, (&Event{Type: "reviewer-added"}).IsRelevant())
+}
@@ -0,0 +1,106 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// EventsLogClient is the part of gerrit.Client the EventsLogSource relies on
+type EventsLogClient interface {
+	GetEventsLog(ctx context.Context, since time.Time) (io.ReadCloser, error)
+}
+
+// EventsLogSource streams events by periodically polling the events-log plugin over HTTP.
+// It's meant as an alternative for installations where SSH access isn't possible.
+type EventsLogSource struct {
+	logger       *log.Logger
+	client       EventsLogClient
+	pollInterval time.Duration
+
+	// since is the timestamp of the last event seen,
+	// seen contains the raw events with that timestamp, which might be returned again.
+	since time.Time
+	seen  map[string]bool
+}
+
+var _ Source = &EventsLogSource{}
+
+// NewEventsLogSource creates a new EventsLogSource, polling every pollInterval.
+// Only events newer than the time of creation are emitted.
+func NewEventsLogSource(logger *log.Logger, client EventsLogClient, pollInterval time.Duration) *EventsLogSource {
+	return &EventsLogSource{
+		logger:       logger,
+		client:       client,
+		pollInterval: pollInterval,
+		since:        time.Now().UTC().Truncate(time.Second),
+		seen:         make(map[string]bool),
+	}
+}
+
+// Stream implements Source
+func (s *EventsLogSource) Stream(ctx context.Context, events chan<- *Event) error {
+	ticker := time.NewTicker(s.pollInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.poll(ctx, events); err != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll fetches all events since the last seen one and sends new ones to the events channel
+func (s *EventsLogSource) poll(ctx context.Context, events chan<- *Event) error {
+	body, err := s.client.GetEventsLog(ctx, s.since)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		event, err := ParseEvent([]byte(line))
+		if err != nil {
+			s.logger.WithError(err).Warn("skipping unparseable event")
+			continue
+		}
+		createdOn := time.Unix(event.EventCreatedOn, 0).UTC()
+		if createdOn.Before(s.since) {
+			continue
+		}
+		// the events-log plugin has a resolution of one second,
+		// so events at the boundary are returned again on the next poll.
+		if createdOn.After(s.since) {
+			s.since = createdOn
+			s.seen = make(map[string]bool)
+		}
+		if s.seen[line] {
+			continue
+		}
+		s.seen[line] = true
+
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *EventsLogSource) String() string {
+	return "events-log"
+}
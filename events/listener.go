@@ -0,0 +1,130 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// Listener consumes a Source, and passes all relevant events to a handler function.
+// If the source breaks, it's restarted after a (growing) delay.
+type Listener struct {
+	logger  *log.Logger
+	source  Source
+	handler func(*Event)
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// NewListener creates a new Listener
+func NewListener(logger *log.Logger, source Source, handler func(*Event)) *Listener {
+	return &Listener{
+		logger:     logger,
+		source:     source,
+		handler:    handler,
+		minBackoff: time.Second,
+		maxBackoff: 5 * time.Minute,
+	}
+}
+
+// Run consumes the source until the context is cancelled
+func (l *Listener) Run(ctx context.Context) {
+	logger := l.logger.WithField("source", l.source.String())
+	backoff := l.minBackoff
+	for {
+		events := make(chan *Event)
+		done := make(chan error, 1)
+
+		logger.Info("connecting to event source")
+		go func() {
+			done <- l.source.Stream(ctx, events)
+		}()
+
+		// consume events until the source gives up
+		var err error
+		receivedEvents := false
+	consume:
+		for {
+			select {
+			case event := <-events:
+				receivedEvents = true
+				if !event.IsRelevant() {
+					continue
+				}
+				logger.WithField("event", event.String()).Debug("received event")
+				l.handler(event)
+			case err = <-done:
+				break consume
+			}
+		}
+
+		if ctx.Err() != nil {
+			logger.Info("stopped listening for events")
+			return
+		}
+
+		// reset the backoff if the stream was working for a while
+		if receivedEvents {
+			backoff = l.minBackoff
+		}
+		logger.WithError(err).Warnf("event source broke, reconnecting in %s", backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > l.maxBackoff {
+			backoff = l.maxBackoff
+		}
+	}
+}
+
+// FilterTarget returns an event handler calling trigger for all events
+// belonging to the given project and branch.
+func FilterTarget(projectName, branchName string, trigger func()) func(*Event) {
+	return func(event *Event) {
+		if event.Matches(projectName, branchName) {
+			trigger()
+		}
+	}
+}
+
+// Debouncer coalesces bursts of calls to Trigger into a single call of a function.
+// The function is called delay after the first call to Trigger,
+// all calls to Trigger in the meantime are absorbed.
+// This ensures a constant stream of events can't postpone the call forever.
+type Debouncer struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	f       func()
+	pending bool
+}
+
+// NewDebouncer creates a new Debouncer, calling f delay after a call to Trigger
+func NewDebouncer(delay time.Duration, f func()) *Debouncer {
+	return &Debouncer{
+		delay: delay,
+		f:     f,
+	}
+}
+
+// Trigger schedules a call to the wrapped function, unless one is already scheduled
+func (d *Debouncer) Trigger() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending {
+		return
+	}
+	d.pending = true
+	time.AfterFunc(d.delay, func() {
+		d.mu.Lock()
+		d.pending = false
+		d.mu.Unlock()
+		d.f()
+	})
+}
@@ -0,0 +1,101 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+)
+
+var testLogger = &log.Logger{Handler: discard.New()}
+
+// fakeSource replays a fixed stream of newline-delimited events,
+// and then reports a broken connection.
+type fakeSource struct {
+	mu          sync.Mutex
+	stream      string
+	connections int
+}
+
+func (s *fakeSource) Stream(ctx context.Context, events chan<- *Event) error {
+	s.mu.Lock()
+	s.connections++
+	s.mu.Unlock()
+	if err := readEvents(ctx, strings.NewReader(s.stream), events, testLogger); err != nil {
+		return err
+	}
+	return fmt.Errorf("connection closed")
+}
+
+func (s *fakeSource) String() string {
+	return "fake"
+}
+
+func TestListener(t *testing.T) {
+	source := &fakeSource{
+		stream: strings.Join([]string{
+			`{"type":"ref-updated","refUpdate":{"refName":"refs/heads/master","project":"depot"}}`,
+			`garbage`,
+			`{"type":"ref-updated","refUpdate":{"refName":"refs/heads/master","project":"other"}}`,
+			`{"type":"reviewer-added","change":{"project":"depot","branch":"master"}}`,
+			`{"type":"patchset-created","change":{"project":"depot","branch":"master","number":1}}`,
+			``,
+			`{"type":"change-abandoned","change":{"project":"depot","branch":"release","number":2}}`,
+		}, "\n"),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	triggered := make(chan struct{}, 10)
+	listener := NewListener(testLogger, source, FilterTarget("depot", "master", func() {
+		triggered <- struct{}{}
+	}))
+	listener.minBackoff = time.Millisecond
+
+	done := make(chan struct{})
+	go func() {
+		listener.Run(ctx)
+		close(done)
+	}()
+
+	// the two relevant events for depot/master, from the first connection
+	<-triggered
+	<-triggered
+	// the source breaks after replaying, the listener should reconnect
+	<-triggered
+	cancel()
+	<-done
+
+	source.mu.Lock()
+	defer source.mu.Unlock()
+	assert.GreaterOrEqual(t, source.connections, 2, "the listener should reconnect to a broken source")
+}
+
+func TestDebouncer(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	debouncer := NewDebouncer(20*time.Millisecond, func() {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+	})
+
+	for i := 0; i < 10; i++ {
+		debouncer.Trigger()
+	}
+	time.Sleep(60 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, 1, calls, "a burst of triggers should be coalesced into one call")
+	mu.Unlock()
+
+	debouncer.Trigger()
+	time.Sleep(60 * time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, 2, calls, "a trigger after the delay should cause another call")
+	mu.Unlock()
+}
@@ -0,0 +1,128 @@
+package events
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+
+	"github.com/apex/log"
+)
+
+// Source produces a stream of gerrit events
+type Source interface {
+	// Stream sends all events it receives to the passed channel.
+	// It blocks until the context is cancelled, or the underlying connection breaks.
+	Stream(ctx context.Context, events chan<- *Event) error
+	String() string
+}
+
+// readEvents reads newline-delimited JSON events from r and sends them to the events channel,
+// until r is exhausted or the context is cancelled.
+// Lines that can't be parsed are logged and skipped.
+func readEvents(ctx context.Context, r io.Reader, events chan<- *Event, logger *log.Logger) error {
+	scanner := bufio.NewScanner(r)
+	// events can contain long commit messages
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		event, err := ParseEvent(line)
+		if err != nil {
+			logger.WithError(err).Warn("skipping unparseable event")
+			continue
+		}
+		select {
+		case events <- event:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return scanner.Err()
+}
+
+// SSHSource streams events by invoking `gerrit stream-events` over SSH.
+// It shells out to the ssh binary, so the usual ssh configuration (known_hosts, agent, …) applies.
+type SSHSource struct {
+	logger       *log.Logger
+	address      string
+	username     string
+	identityFile string
+}
+
+var _ Source = &SSHSource{}
+
+// NewSSHSource creates a new SSHSource.
+// address is the host:port of gerrit's SSH daemon,
+// identityFile is optional and can be used to point to a private key.
+func NewSSHSource(logger *log.Logger, address, username, identityFile string) (*SSHSource, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid ssh address %s: %w", address, err)
+	}
+	return &SSHSource{
+		logger:       logger,
+		address:      address,
+		username:     username,
+		identityFile: identityFile,
+	}, nil
+}
+
+// Stream implements Source
+func (s *SSHSource) Stream(ctx context.Context, events chan<- *Event) error {
+	host, port, err := net.SplitHostPort(s.address)
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		"-o", "BatchMode=yes",
+		"-o", "ServerAliveInterval=30",
+		"-p", port,
+	}
+	if s.identityFile != "" {
+		args = append(args, "-i", s.identityFile)
+	}
+	if s.username != "" {
+		args = append(args, "-l", s.username)
+	}
+	args = append(args, host, "gerrit", "stream-events",
+		"-s", TypeCommentAdded,
+		"-s", TypeRefUpdated,
+		"-s", TypePatchsetCreated,
+		"-s", TypeChangeAbandoned,
+	)
+
+	cmd := exec.CommandContext(ctx, "ssh", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	readErr := readEvents(ctx, stdout, events, s.logger)
+	// make sure the ssh process goes away if we stopped reading for other reasons
+	if cmd.Process != nil {
+		_ = cmd.Process.Kill()
+	}
+	waitErr := cmd.Wait()
+	if readErr != nil {
+		return readErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if waitErr != nil {
+		return fmt.Errorf("ssh exited: %w", waitErr)
+	}
+	return fmt.Errorf("ssh exited")
+}
+
+func (s *SSHSource) String() string {
+	return fmt.Sprintf("ssh://%s@%s", s.username, s.address)
+}
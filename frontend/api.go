@@ -0,0 +1,64 @@
+package frontend
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/apex/log"
+
+	"github.com/flokli/gerrit-queue/submitqueue"
+)
+
+// diagnosisResponse is the response of the diagnosis endpoint
+type diagnosisResponse struct {
+	Project          string `json:"project"`
+	Branch           string `json:"branch"`
+	CurrentlyRunning bool   `json:"currentlyRunning"`
+	// Units is empty while the queue is running, as its state is changing
+	Units []*submitqueue.UnitDiagnosis `json:"units"`
+}
+
+// makeDiagnosisHandler returns a http.HandlerFunc explaining why units of a queue aren't submitted.
+// The queue is selected by the project and branch query parameters,
+// the optional change parameter limits the response to the unit containing that change.
+func makeDiagnosisHandler(queues []*Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		queue := findQueue(queues, r)
+		if queue == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		changeNumber := 0
+		if change := r.URL.Query().Get("change"); change != "" {
+			var err error
+			changeNumber, err = strconv.Atoi(change)
+			if err != nil {
+				http.Error(w, "invalid change number", http.StatusBadRequest)
+				return
+			}
+		}
+
+		response := &diagnosisResponse{
+			Project:          queue.GerritClient.GetProjectName(),
+			Branch:           queue.GerritClient.GetBranchName(),
+			CurrentlyRunning: queue.Runner.IsCurrentlyRunning(),
+			Units:            make([]*submitqueue.UnitDiagnosis, 0),
+		}
+		// don't trigger operations requiring a lock
+		if !response.CurrentlyRunning {
+			for _, diagnosis := range queue.Runner.Diagnose() {
+				if changeNumber == 0 || diagnosis.Contains(changeNumber) {
+					response.Units = append(response.Units, diagnosis)
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(response)
+		if err != nil {
+			log.Warnf("failed to encode diagnosis: %s", err)
+		}
+	}
+}
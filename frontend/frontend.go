@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"time"
 
 	"html/template"
 
@@ -28,7 +30,7 @@ func loadTemplate(templateNames []string, funcMap template.FuncMap) (*template.T
 	tmpl := template.New(templateNames[0]).Funcs(funcMap)
 
 	for _, templateName := range templateNames {
-		r, err := templates.Open("/" + templateName)
+		r, err := templates.Open("templates/" + templateName)
 		if err != nil {
 			return nil, err
 		}
@@ -46,64 +48,181 @@ func loadTemplate(templateNames []string, funcMap template.FuncMap) (*template.T
 	return tmpl, nil
 }
 
-// MakeFrontend returns a http.Handler
-func MakeFrontend(rotatingLogHandler *misc.RotatingLogHandler, gerritClient *gerrit.Client, runner *submitqueue.Runner) http.Handler {
-	projectName := gerritClient.GetProjectName()
-	branchName := gerritClient.GetBranchName()
+// Queue is a single submit queue served by the frontend
+type Queue struct {
+	GerritClient       *gerrit.Client
+	Runner             *submitqueue.Runner
+	RotatingLogHandler *misc.RotatingLogHandler
+	// Trigger is called for relevant events received via webhooks
+	Trigger func()
+}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, _ *http.Request) {
-		var wipChain *gerrit.Chain = nil
-		HEAD := ""
-		currentlyRunning := runner.IsCurrentlyRunning()
-
-		// don't trigger operations requiring a lock
-		if !currentlyRunning {
-			wipChain = runner.GetWIPChain()
-			HEAD = gerritClient.GetHEAD()
+// queueState is a snapshot of the state of a queue, as rendered by the templates
+type queueState struct {
+	ProjectName      string
+	BranchName       string
+	Strategy         string
+	URL              string
+	CurrentlyRunning bool
+	State            string
+	WIPUnit          *gerrit.Unit
+	Batch            []*gerrit.Unit
+	CIDeadline       time.Time
+	BatchSize        int
+	MaxBatchSize     int
+	Topics           []*gerrit.Unit
+	Trees            []*gerrit.ChangeNode
+	Report           *gerrit.AssemblyReport
+	Diagnoses        []*submitqueue.UnitDiagnosis
+	Preemptions      []*submitqueue.Preemption
+	History          []*submitqueue.HistoryEntry
+	HEAD             string
+	QueryTruncated   bool
+}
+
+// getQueueState returns the current state of the queue
+func (q *Queue) getQueueState() *queueState {
+	state := &queueState{
+		ProjectName:      q.GerritClient.GetProjectName(),
+		BranchName:       q.GerritClient.GetBranchName(),
+		Strategy:         q.GerritClient.GetStrategy().Name(),
+		CurrentlyRunning: q.Runner.IsCurrentlyRunning(),
+	}
+	state.URL = "/queue?" + url.Values{
+		"project": []string{state.ProjectName},
+		"branch":  []string{state.BranchName},
+	}.Encode()
+
+	// don't trigger operations requiring a lock
+	if !state.CurrentlyRunning {
+		state.State = q.Runner.GetState().String()
+		state.WIPUnit = q.Runner.GetWIPUnit()
+		state.Batch = q.Runner.GetBatch()
+		state.CIDeadline = q.Runner.GetCIDeadline()
+		state.BatchSize, state.MaxBatchSize = q.Runner.GetBatchSize()
+		state.Topics = q.GerritClient.FilterUnits(func(u *gerrit.Unit) bool {
+			return u.IsTopic()
+		})
+		if graph := q.GerritClient.GetChangeGraph(); graph != nil {
+			state.Trees = graph.Trees()
+		}
+		state.Report = q.GerritClient.GetAssemblyReport()
+		// units nobody asked to submit aren't interesting
+		for _, diagnosis := range q.Runner.Diagnose() {
+			if diagnosis.Status != submitqueue.UnitStatusIdle {
+				state.Diagnoses = append(state.Diagnoses, diagnosis)
+			}
 		}
+		state.Preemptions = q.Runner.GetPreemptions()
+		state.History = q.Runner.GetHistory()
+		state.HEAD = q.GerritClient.GetHEAD()
+		state.QueryTruncated = q.GerritClient.IsQueryTruncated()
+	}
+	return state
+}
 
-		funcMap := template.FuncMap{
-			"changesetURL": func(changeset *gerrit.Changeset) string {
-				return gerritClient.GetChangesetURL(changeset)
-			},
-			"levelToClasses": func(level log.Level) string {
-				switch level {
-				case log.DebugLevel:
-					return "text-muted"
-				case log.InfoLevel:
-					return "text-info"
-				case log.WarnLevel:
-					return "text-warning"
-				case log.ErrorLevel:
-					return "text-danger"
-				case log.FatalLevel:
-					return "text-danger"
-				default:
-					return "text-white"
-				}
-			},
-			"fieldsToJSON": func(fields log.Fields) string {
-				jsonData, _ := json.Marshal(fields)
-				return string(jsonData)
-			},
+// findQueue returns the queue selected by the project and branch query parameters, or nil
+func findQueue(queues []*Queue, r *http.Request) *Queue {
+	projectName := r.URL.Query().Get("project")
+	branchName := r.URL.Query().Get("branch")
+	for _, q := range queues {
+		if q.GerritClient.GetProjectName() == projectName && q.GerritClient.GetBranchName() == branchName {
+			return q
+		}
+	}
+	return nil
+}
+
+// makeFuncMap returns the template functions, changeset URLs are rendered for the given client
+func makeFuncMap(gerritClient *gerrit.Client) template.FuncMap {
+	return template.FuncMap{
+		"changesetURL": func(changeset *gerrit.Changeset) string {
+			return gerritClient.GetChangesetURL(changeset)
+		},
+		"levelToClasses": func(level log.Level) string {
+			switch level {
+			case log.DebugLevel:
+				return "text-muted"
+			case log.InfoLevel:
+				return "text-info"
+			case log.WarnLevel:
+				return "text-warning"
+			case log.ErrorLevel:
+				return "text-danger"
+			case log.FatalLevel:
+				return "text-danger"
+			default:
+				return "text-white"
+			}
+		},
+		"fieldsToJSON": func(fields log.Fields) string {
+			jsonData, _ := json.Marshal(fields)
+			return string(jsonData)
+		},
+	}
+}
+
+// MakeFrontend returns a http.Handler
+// It serves an overview of all queues at /, and the details of each queue at /queue?project=…&branch=….
+// /api/diagnosis?project=…&branch=… explains why units of the queue aren't submitted, as JSON.
+// If webhookSecret is set, it also accepts events from the gerrit webhooks plugin,
+// and triggers the queues they're relevant for.
+func MakeFrontend(rotatingLogHandler *misc.RotatingLogHandler, queues []*Queue, webhookSecret string) http.Handler {
+	mux := http.NewServeMux()
+	if webhookSecret != "" {
+		mux.HandleFunc("/webhooks/gerrit", makeWebhookHandler(webhookSecret, queues))
+	}
+
+	mux.HandleFunc("/api/diagnosis", makeDiagnosisHandler(queues))
+
+	mux.HandleFunc("/queue", func(w http.ResponseWriter, r *http.Request) {
+		queue := findQueue(queues, r)
+		if queue == nil {
+			http.NotFound(w, r)
+			return
 		}
 
 		tmpl := template.Must(loadTemplate([]string{
 			"index.tmpl.html",
+			"unit.tmpl.html",
 			"chain.tmpl.html",
 			"changeset.tmpl.html",
-		}, funcMap))
+			"graph.tmpl.html",
+			"report.tmpl.html",
+			"diagnosis.tmpl.html",
+		}, makeFuncMap(queue.GerritClient)))
 
 		err := tmpl.ExecuteTemplate(w, "index.tmpl.html", map[string]interface{}{
-			// Config
-			"projectName": projectName,
-			"branchName":  branchName,
+			// State
+			"queue": queue.getQueueState(),
+
+			// History
+			"memory": queue.RotatingLogHandler,
+		})
+
+		if err != nil {
+			log.Warnf("failed to execute template: %s", err)
+		}
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		states := make([]*queueState, 0, len(queues))
+		for _, q := range queues {
+			states = append(states, q.getQueueState())
+		}
+
+		tmpl := template.Must(loadTemplate([]string{
+			"overview.tmpl.html",
+		}, makeFuncMap(nil)))
 
+		err := tmpl.ExecuteTemplate(w, "overview.tmpl.html", map[string]interface{}{
 			// State
-			"currentlyRunning": currentlyRunning,
-			"wipChain":         wipChain,
-			"HEAD":             HEAD,
+			"queues": states,
 
 			// History
 			"memory": rotatingLogHandler,
@@ -0,0 +1,71 @@
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+	"github.com/flokli/gerrit-queue/misc"
+	"github.com/flokli/gerrit-queue/submitqueue"
+)
+
+func TestMakeFrontend(t *testing.T) {
+	logger := &log.Logger{Handler: discard.New()}
+	var queues []*Queue
+	for _, target := range [][2]string{{"depot", "master"}, {"tools/ci", "release"}} {
+		gerritClient, err := gerrit.NewClient(logger, "https://gerrit.invalid", nil, target[0], target[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		queues = append(queues, &Queue{
+			GerritClient:       gerritClient,
+			Runner:             submitqueue.NewRunner(logger, gerritClient),
+			RotatingLogHandler: misc.NewRotatingLogHandler(10),
+			Trigger:            func() {},
+		})
+	}
+	handler := MakeFrontend(misc.NewRotatingLogHandler(10), queues, "")
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+		return rec
+	}
+
+	t.Run("overview lists all queues", func(t *testing.T) {
+		rec := get("/")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "/queue?branch=master&amp;project=depot")
+		assert.Contains(t, rec.Body.String(), "/queue?branch=release&amp;project=tools%2Fci")
+	})
+
+	t.Run("queue page", func(t *testing.T) {
+		rec := get("/queue?project=tools/ci&branch=release")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "tools/ci")
+	})
+
+	t.Run("unknown queue", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, get("/queue?project=depot&branch=unknown").Code)
+		assert.Equal(t, http.StatusNotFound, get("/unknown").Code)
+	})
+
+	t.Run("diagnosis", func(t *testing.T) {
+		rec := get("/api/diagnosis?project=depot&branch=master")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		assert.JSONEq(t, `{"project":"depot","branch":"master","currentlyRunning":false,"units":[]}`, rec.Body.String())
+
+		assert.Equal(t, http.StatusBadRequest, get("/api/diagnosis?project=depot&branch=master&change=foo").Code)
+		assert.Equal(t, http.StatusNotFound, get("/api/diagnosis?project=depot&branch=unknown").Code)
+	})
+
+	t.Run("webhooks disabled without secret", func(t *testing.T) {
+		assert.Equal(t, http.StatusNotFound, get("/webhooks/gerrit").Code)
+	})
+}
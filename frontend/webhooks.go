@@ -0,0 +1,77 @@
+package frontend
+
+import (
+	"crypto/subtle"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/apex/log"
+
+	"github.com/flokli/gerrit-queue/events"
+)
+
+// maxWebhookPayloadSize limits the size of accepted webhook payloads.
+// Events can contain long commit messages, but nothing close to this.
+const maxWebhookPayloadSize = 4 * 1024 * 1024
+
+// makeWebhookHandler returns a http.HandlerFunc accepting events from the gerrit webhooks plugin.
+//
+// As the webhooks plugin can't sign its payloads, the shared secret needs to be
+// part of the configured URL (as `secret` query parameter), or passed as a bearer
+// token by a proxy in front.
+// Relevant events trigger all queues for the project and branch they refer to.
+func makeWebhookHandler(secret string, queues []*Queue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !checkWebhookSecret(r, secret) {
+			log.WithField("remoteAddr", r.RemoteAddr).Warn("rejecting webhook with invalid secret")
+			http.Error(w, "invalid secret", http.StatusUnauthorized)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookPayloadSize))
+		if err != nil {
+			http.Error(w, "unable to read body", http.StatusBadRequest)
+			return
+		}
+		event, err := events.ParseEvent(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !event.IsRelevant() {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		triggered := false
+		for _, q := range queues {
+			if event.Matches(q.GerritClient.GetProjectName(), q.GerritClient.GetBranchName()) {
+				q.Trigger()
+				triggered = true
+			}
+		}
+		if !triggered {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		log.WithField("event", event.String()).Debug("received webhook")
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// checkWebhookSecret returns true if the request carries the expected secret
+func checkWebhookSecret(r *http.Request, secret string) bool {
+	provided := r.URL.Query().Get("secret")
+	if authorization := r.Header.Get("Authorization"); strings.HasPrefix(authorization, "Bearer ") {
+		provided = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(secret)) == 1
+}
@@ -0,0 +1,60 @@
+package frontend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	triggered := 0
+	gerritClient, err := gerrit.NewClient(&log.Logger{Handler: discard.New()}, "https://gerrit.invalid", nil, "depot", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := makeWebhookHandler("s3cret", []*Queue{{
+		GerritClient: gerritClient,
+		Trigger: func() {
+			triggered++
+		},
+	}})
+
+	do := func(method, target, body string, header http.Header) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	relevantEvent := `{"type":"ref-updated","refUpdate":{"refName":"refs/heads/master","project":"depot"}}`
+
+	assert.Equal(t, http.StatusMethodNotAllowed, do("GET", "/webhooks/gerrit?secret=s3cret", "", nil))
+	assert.Equal(t, http.StatusUnauthorized, do("POST", "/webhooks/gerrit", relevantEvent, nil))
+	assert.Equal(t, http.StatusUnauthorized, do("POST", "/webhooks/gerrit?secret=wrong", relevantEvent, nil))
+	assert.Equal(t, 0, triggered, "requests without a valid secret must not trigger")
+
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/webhooks/gerrit?secret=s3cret", "garbage", nil))
+
+	// events for other branches or irrelevant events are accepted, but ignored
+	assert.Equal(t, http.StatusNoContent, do("POST", "/webhooks/gerrit?secret=s3cret",
+		`{"type":"ref-updated","refUpdate":{"refName":"refs/heads/release","project":"depot"}}`, nil))
+	assert.Equal(t, http.StatusNoContent, do("POST", "/webhooks/gerrit?secret=s3cret",
+		`{"type":"reviewer-added","change":{"project":"depot","branch":"master"}}`, nil))
+	assert.Equal(t, 0, triggered)
+
+	assert.Equal(t, http.StatusAccepted, do("POST", "/webhooks/gerrit?secret=s3cret", relevantEvent, nil))
+	assert.Equal(t, http.StatusAccepted, do("POST", "/webhooks/gerrit", relevantEvent, http.Header{
+		"Authorization": []string{"Bearer s3cret"},
+	}))
+	assert.Equal(t, 2, triggered)
+}
@@ -0,0 +1,415 @@
+package gerrit
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Authenticator adds credentials to requests sent to gerrit
+type Authenticator interface {
+	// Transport wraps the passed http.RoundTripper, adding credentials to each request
+	Transport(base http.RoundTripper) http.RoundTripper
+}
+
+// roundTripperFunc turns a function into a http.RoundTripper
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// BasicAuth authenticates using HTTP basic auth
+type BasicAuth struct {
+	Username string
+	Password string
+}
+
+// Transport implements Authenticator
+func (a *BasicAuth) Transport(base http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.SetBasicAuth(a.Username, a.Password)
+		return base.RoundTrip(req)
+	})
+}
+
+// BearerTokenAuth authenticates by sending a bearer token,
+// as used by setups with an authenticating proxy in front of gerrit.
+type BearerTokenAuth struct {
+	Token string
+}
+
+// Transport implements Authenticator
+func (a *BearerTokenAuth) Transport(base http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+a.Token)
+		return base.RoundTrip(req)
+	})
+}
+
+// CookieAuth authenticates by sending cookies, usually obtained from a .gitcookies file
+type CookieAuth struct {
+	Cookies []*http.Cookie
+}
+
+// Transport implements Authenticator
+func (a *CookieAuth) Transport(base http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		for _, cookie := range a.Cookies {
+			req.AddCookie(cookie)
+		}
+		return base.RoundTrip(req)
+	})
+}
+
+// DigestAuth authenticates using HTTP digest auth.
+// Each request is first sent without credentials, to obtain a challenge,
+// and resent with the computed response if gerrit asks for it.
+type DigestAuth struct {
+	Username string
+	Password string
+}
+
+// Transport implements Authenticator
+func (a *DigestAuth) Transport(base http.RoundTripper) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		// the request might need to be sent twice, so make sure we can replay the body
+		if req.Body != nil && req.GetBody == nil {
+			return nil, fmt.Errorf("digest auth requires a replayable request body")
+		}
+		resp, err := base.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusUnauthorized {
+			return resp, err
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		if !strings.HasPrefix(challenge, "Digest ") {
+			return resp, nil
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		authorization, err := a.authorization(req.Method, req.URL.RequestURI(), challenge)
+		if err != nil {
+			return nil, err
+		}
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			retry.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		retry.Header.Set("Authorization", authorization)
+		return base.RoundTrip(retry)
+	})
+}
+
+// authorization computes the Authorization header for a given digest challenge
+func (a *DigestAuth) authorization(method, uri, challenge string) (string, error) {
+	params := parseDigestChallenge(strings.TrimPrefix(challenge, "Digest "))
+	if algorithm, ok := params["algorithm"]; ok && !strings.EqualFold(algorithm, "MD5") {
+		return "", fmt.Errorf("unsupported digest algorithm %s", algorithm)
+	}
+
+	cnonceBytes := make([]byte, 8)
+	if _, err := rand.Read(cnonceBytes); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(cnonceBytes)
+	nc := "00000001"
+
+	ha1 := md5Hex(a.Username + ":" + params["realm"] + ":" + a.Password)
+	ha2 := md5Hex(method + ":" + uri)
+
+	var response string
+	qop := ""
+	if qops, ok := params["qop"]; ok {
+		for _, q := range strings.Split(qops, ",") {
+			if strings.TrimSpace(q) == "auth" {
+				qop = "auth"
+			}
+		}
+		if qop == "" {
+			return "", fmt.Errorf("unsupported digest qop %s", qops)
+		}
+		response = md5Hex(strings.Join([]string{ha1, params["nonce"], nc, cnonce, qop, ha2}, ":"))
+	} else {
+		response = md5Hex(strings.Join([]string{ha1, params["nonce"], ha2}, ":"))
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s", algorithm=MD5`,
+		a.Username, params["realm"], params["nonce"], uri, response)
+	if qop != "" {
+		fmt.Fprintf(&sb, `, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+	}
+	if opaque, ok := params["opaque"]; ok {
+		fmt.Fprintf(&sb, `, opaque="%s"`, opaque)
+	}
+	return sb.String(), nil
+}
+
+// parseDigestChallenge parses the comma-separated key=value pairs of a digest challenge.
+// Values might be quoted, and contain commas.
+func parseDigestChallenge(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				value, s = s, ""
+			} else {
+				value, s = s[:end], s[end:]
+			}
+		}
+		params[key] = strings.TrimSpace(value)
+	}
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s)) // nolint: gosec
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadGitCookies reads a .gitcookies file (in netscape cookie file format),
+// and returns a CookieAuth with all cookies applying to the given gerrit URL.
+func LoadGitCookies(path, gerritURL string) (*CookieAuth, error) {
+	u, err := url.Parse(gerritURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	auth := &CookieAuth{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// cookies not accessible from JavaScript are prefixed, but still valid
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		domain, includeSubdomains, name, value := fields[0], fields[1] == "TRUE", fields[5], fields[6]
+		if !cookieDomainMatches(host, domain, includeSubdomains) {
+			continue
+		}
+		if fields[2] != "" && fields[2] != "/" && !strings.HasPrefix(u.Path, fields[2]) {
+			continue
+		}
+		auth.Cookies = append(auth.Cookies, &http.Cookie{Name: name, Value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(auth.Cookies) == 0 {
+		return nil, fmt.Errorf("no cookies for %s found in %s", host, path)
+	}
+	return auth, nil
+}
+
+// cookieDomainMatches returns true if a cookie for domain should be sent to host
+func cookieDomainMatches(host, domain string, includeSubdomains bool) bool {
+	if strings.HasPrefix(domain, ".") {
+		return host == domain[1:] || strings.HasSuffix(host, domain)
+	}
+	if host == domain {
+		return true
+	}
+	return includeSubdomains && strings.HasSuffix(host, "."+domain)
+}
+
+// LoadNetrc reads a .netrc file, and returns a BasicAuth with the credentials
+// for the host of the given gerrit URL (or the default entry).
+func LoadNetrc(path, gerritURL string) (*BasicAuth, error) {
+	u, err := url.Parse(gerritURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Hostname()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var found, fallback *BasicAuth
+	var current *BasicAuth
+	tokens := strings.Fields(string(data))
+	for i := 0; i < len(tokens); i++ {
+		next := func() string {
+			if i+1 < len(tokens) {
+				i++
+				return tokens[i]
+			}
+			return ""
+		}
+		switch tokens[i] {
+		case "machine":
+			current = nil
+			if next() == host && found == nil {
+				found = &BasicAuth{}
+				current = found
+			}
+		case "default":
+			current = nil
+			if fallback == nil {
+				fallback = &BasicAuth{}
+				current = fallback
+			}
+		case "login":
+			if v := next(); current != nil {
+				current.Username = v
+			}
+		case "password":
+			if v := next(); current != nil {
+				current.Password = v
+			}
+		case "account":
+			next()
+		case "macdef":
+			// macro definitions run until the next empty line, which we can't see anymore.
+			// They're irrelevant for us, so stop parsing.
+			i = len(tokens)
+		}
+	}
+	if found != nil {
+		return found, nil
+	}
+	if fallback != nil {
+		return fallback, nil
+	}
+	return nil, fmt.Errorf("no credentials for %s found in %s", host, path)
+}
+
+// readSecretFile reads a secret (password, token) from a file, stripping surrounding whitespace
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// AuthConfig describes how to authenticate against gerrit
+type AuthConfig struct {
+	// Method is one of none, basic, digest, gitcookies, bearer, netrc
+	Method string
+
+	Username     string
+	Password     string
+	PasswordFile string
+
+	Token     string
+	TokenFile string
+
+	GitCookiesFile string
+	NetrcFile      string
+}
+
+// NewAuthenticator creates the Authenticator described by the config.
+// It returns nil for anonymous access.
+func (cfg *AuthConfig) NewAuthenticator(gerritURL string) (Authenticator, error) {
+	password := cfg.Password
+	if cfg.PasswordFile != "" {
+		var err error
+		if password, err = readSecretFile(cfg.PasswordFile); err != nil {
+			return nil, fmt.Errorf("unable to read password file: %w", err)
+		}
+	}
+
+	switch cfg.Method {
+	case "none", "":
+		return nil, nil
+	case "basic", "digest":
+		if cfg.Username == "" || password == "" {
+			return nil, fmt.Errorf("%s auth requires a username and password", cfg.Method)
+		}
+		if cfg.Method == "digest" {
+			return &DigestAuth{Username: cfg.Username, Password: password}, nil
+		}
+		return &BasicAuth{Username: cfg.Username, Password: password}, nil
+	case "bearer":
+		token := cfg.Token
+		if cfg.TokenFile != "" {
+			var err error
+			if token, err = readSecretFile(cfg.TokenFile); err != nil {
+				return nil, fmt.Errorf("unable to read token file: %w", err)
+			}
+		}
+		if token == "" {
+			return nil, fmt.Errorf("bearer auth requires a token")
+		}
+		return &BearerTokenAuth{Token: token}, nil
+	case "gitcookies":
+		path, err := expandHome(cfg.GitCookiesFile, ".gitcookies")
+		if err != nil {
+			return nil, err
+		}
+		auth, err := LoadGitCookies(path, gerritURL)
+		if err != nil {
+			return nil, err
+		}
+		return auth, nil
+	case "netrc":
+		path, err := expandHome(cfg.NetrcFile, ".netrc")
+		if err != nil {
+			return nil, err
+		}
+		auth, err := LoadNetrc(path, gerritURL)
+		if err != nil {
+			return nil, err
+		}
+		return auth, nil
+	default:
+		return nil, fmt.Errorf("unknown auth method: %s", cfg.Method)
+	}
+}
+
+// expandHome returns path, or the given file in the users home directory if path is empty
+func expandHome(path, defaultName string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, defaultName), nil
+}
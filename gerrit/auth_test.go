@@ -0,0 +1,104 @@
+package gerrit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTempFile(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadGitCookies(t *testing.T) {
+	path := writeTempFile(t, strings.Join([]string{
+		"# comment",
+		"gerrit.example.com\tFALSE\t/\tTRUE\t2147483647\to\tgit-user=secret",
+		"#HttpOnly_.example.com\tTRUE\t/\tTRUE\t2147483647\tSID\tsession",
+		"other.example.org\tFALSE\t/\tTRUE\t2147483647\to\tunrelated",
+		"",
+	}, "\n"))
+
+	auth, err := LoadGitCookies(path, "https://gerrit.example.com")
+	assert.NoError(t, err)
+	assert.Len(t, auth.Cookies, 2)
+	assert.Equal(t, "o", auth.Cookies[0].Name)
+	assert.Equal(t, "git-user=secret", auth.Cookies[0].Value)
+	assert.Equal(t, "SID", auth.Cookies[1].Name, "HttpOnly cookies for parent domains should be included")
+
+	_, err = LoadGitCookies(path, "https://gerrit.example.net")
+	assert.Error(t, err, "a cookie file without matching cookies should be rejected")
+}
+
+func TestLoadNetrc(t *testing.T) {
+	path := writeTempFile(t, `
+machine other.example.com login other password wrong
+machine gerrit.example.com
+  login queue
+  password s3cret
+default login anonymous password guest
+`)
+
+	auth, err := LoadNetrc(path, "https://gerrit.example.com:8443/")
+	assert.NoError(t, err)
+	assert.Equal(t, &BasicAuth{Username: "queue", Password: "s3cret"}, auth)
+
+	auth, err = LoadNetrc(path, "https://unknown.example.com/")
+	assert.NoError(t, err)
+	assert.Equal(t, &BasicAuth{Username: "anonymous", Password: "guest"}, auth, "the default entry should be used as fallback")
+}
+
+func TestNewAuthenticatorFromFiles(t *testing.T) {
+	passwordFile := writeTempFile(t, "s3cret\n")
+	auth, err := (&AuthConfig{Method: "basic", Username: "queue", PasswordFile: passwordFile}).NewAuthenticator("https://gerrit.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, &BasicAuth{Username: "queue", Password: "s3cret"}, auth)
+
+	tokenFile := writeTempFile(t, "t0ken\n")
+	auth, err = (&AuthConfig{Method: "bearer", TokenFile: tokenFile}).NewAuthenticator("https://gerrit.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, &BearerTokenAuth{Token: "t0ken"}, auth)
+
+	_, err = (&AuthConfig{Method: "basic", Username: "queue"}).NewAuthenticator("https://gerrit.example.com")
+	assert.Error(t, err, "basic auth without password should be rejected")
+
+	auth, err = (&AuthConfig{Method: "none"}).NewAuthenticator("https://gerrit.example.com")
+	assert.NoError(t, err)
+	assert.Nil(t, auth)
+}
+
+func TestDigestAuth(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		if authorization == "" {
+			w.Header().Set("WWW-Authenticate", `Digest realm="Gerrit Code Review", domain="http://gerrit/", qop="auth", nonce="abc,def"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		params := parseDigestChallenge(strings.TrimPrefix(authorization, "Digest "))
+		ha1 := md5Hex("queue:Gerrit Code Review:s3cret")
+		ha2 := md5Hex(r.Method + ":" + r.URL.RequestURI())
+		expected := md5Hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], params["qop"], ha2}, ":"))
+		if params["nonce"] != "abc,def" || params["response"] != expected {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: (&DigestAuth{Username: "queue", Password: "s3cret"}).Transport(http.DefaultTransport)}
+	resp, err := client.Post(server.URL+"/a/changes/1/submit", "application/json", strings.NewReader("{}"))
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
@@ -3,6 +3,7 @@ package gerrit
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/apex/log"
 )
@@ -11,6 +12,52 @@ import (
 // starting from the parent.
 type Chain struct {
 	ChangeSets []*Changeset
+
+	// OutdatedDependencies lists changesets in the chain based on an outdated patchset
+	// of their predecessor. These are only found when assembling chains from related changes.
+	OutdatedDependencies []*OutdatedDependency
+	// ForeignSubmittedTogether contains the numbers of changes gerrit would submit
+	// together with the chain, but which aren't part of it.
+	ForeignSubmittedTogether []int
+}
+
+// OutdatedDependency describes a changeset that is based on an outdated patchset of another one
+type OutdatedDependency struct {
+	Changeset  *Changeset
+	Dependency *Changeset
+	// PatchSetNumber is the patchset of Dependency that Changeset is based on
+	PatchSetNumber int
+}
+
+func (d *OutdatedDependency) String() string {
+	return fmt.Sprintf("%d depends on outdated patchset %d of %d (current: %d)",
+		d.Changeset.Number, d.PatchSetNumber, d.Dependency.Number, d.Dependency.PatchSetNumber)
+}
+
+// HasOutdatedDependencies returns true if any changeset in the chain is based on an outdated patchset
+// of its predecessor. Such a chain needs to be rebased before it can be submitted.
+func (s *Chain) HasOutdatedDependencies() bool {
+	return len(s.OutdatedDependencies) != 0
+}
+
+// HasMerges returns true if any changeset in the chain is a merge commit
+func (s *Chain) HasMerges() bool {
+	for _, changeset := range s.ChangeSets {
+		if changeset.IsMerge() {
+			return true
+		}
+	}
+	return false
+}
+
+// getOutdatedDependency returns the outdated dependency of a changeset in the chain, or nil if it has none.
+func (s *Chain) getOutdatedDependency(changeset *Changeset) *OutdatedDependency {
+	for _, outdatedDependency := range s.OutdatedDependencies {
+		if outdatedDependency.Changeset == changeset {
+			return outdatedDependency
+		}
+	}
+	return nil
 }
 
 // GetParentCommitIDs returns the parent commit IDs
@@ -29,12 +76,20 @@ func (s *Chain) GetLeafCommitID() (string, error) {
 	return s.ChangeSets[len(s.ChangeSets)-1].CommitID, nil
 }
 
-// Validate checks that the chain contains a properly ordered and connected chain of commits
+// Validate checks that the chain contains a properly ordered and connected chain of commits.
+// Failures are returned as *ValidationError.
+// Merge commits are connected to their predecessor by their first parent,
+// their other parents need to be outside of the chain.
 func (s *Chain) Validate() error {
 	logger := log.WithField("chain", s)
 	// an empty chain is invalid
 	if len(s.ChangeSets) == 0 {
-		return fmt.Errorf("an empty chain is invalid")
+		return &ValidationError{Reason: "an empty chain is invalid"}
+	}
+
+	commitIDs := make(map[string]bool, len(s.ChangeSets))
+	for _, changeset := range s.ChangeSets {
+		commitIDs[changeset.CommitID] = true
 	}
 
 	previousCommitID := ""
@@ -48,15 +103,28 @@ func (s *Chain) Validate() error {
 
 		parentCommitIDs := changeset.ParentCommitIDs
 		if len(parentCommitIDs) == 0 {
-			return fmt.Errorf("changesets without any parent are not supported")
+			return &ValidationError{Changeset: changeset, Reason: "changesets without any parent are not supported"}
 		}
-		// we don't check parents of the first changeset in a chain
-		if i != 0 {
-			if len(parentCommitIDs) != 1 {
-				return fmt.Errorf("merge commits in the middle of a chain are not supported (only at the beginning)")
+		seenParents := make(map[string]bool, len(parentCommitIDs))
+		for j, parentCommitID := range parentCommitIDs {
+			if parentCommitID == "" {
+				return &ValidationError{Changeset: changeset, Reason: "empty parent commit id"}
+			}
+			if seenParents[parentCommitID] {
+				return &ValidationError{Changeset: changeset, Reason: fmt.Sprintf("merge has parent %.7s multiple times", parentCommitID)}
+			}
+			seenParents[parentCommitID] = true
+			if j != 0 && commitIDs[parentCommitID] {
+				return &ValidationError{Changeset: changeset, Reason: fmt.Sprintf("merges %.7s, which is part of the same chain", parentCommitID)}
 			}
+		}
+		// we don't check the first parent of the first changeset in a chain
+		if i != 0 {
 			if parentCommitIDs[0] != previousCommitID {
-				return fmt.Errorf("changesets parent commit id doesn't match previous commit id")
+				// changesets based on an outdated patchset of the previous changeset are known to not match
+				if d := s.getOutdatedDependency(changeset); d == nil || d.Dependency != s.ChangeSets[i-1] {
+					return &ValidationError{Changeset: changeset, Reason: "parent commit id doesn't match previous commit id"}
+				}
 			}
 		}
 		// update previous commit id for the next loop iteration
@@ -65,6 +133,19 @@ func (s *Chain) Validate() error {
 	return nil
 }
 
+// Topics returns the distinct topics of the changesets in the chain
+func (s *Chain) Topics() []string {
+	topics := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, changeset := range s.ChangeSets {
+		if changeset.Topic != "" && !seen[changeset.Topic] {
+			seen[changeset.Topic] = true
+			topics = append(topics, changeset.Topic)
+		}
+	}
+	return topics
+}
+
 // AllChangesets applies a filter function on all of the changesets in the chain.
 // returns true if it returns true for all changesets, false otherwise
 func (s *Chain) AllChangesets(f func(c *Changeset) bool) bool {
@@ -76,6 +157,55 @@ func (s *Chain) AllChangesets(f func(c *Changeset) bool) bool {
 	return true
 }
 
+// Prefix returns a chain of the first n changesets of the chain,
+// keeping what's known about them
+func (s *Chain) Prefix(n int) *Chain {
+	prefix := &Chain{
+		ChangeSets:               s.ChangeSets[:n:n],
+		ForeignSubmittedTogether: s.ForeignSubmittedTogether,
+	}
+	for _, outdatedDependency := range s.OutdatedDependencies {
+		for _, changeset := range prefix.ChangeSets {
+			if outdatedDependency.Changeset == changeset {
+				prefix.OutdatedDependencies = append(prefix.OutdatedDependencies, outdatedDependency)
+			}
+		}
+	}
+	return prefix
+}
+
+// Owner returns the owner of the first changeset in the chain
+func (s *Chain) Owner() Account {
+	if len(s.ChangeSets) == 0 {
+		return Account{}
+	}
+	return s.ChangeSets[0].Owner
+}
+
+// Created returns when the oldest changeset in the chain was created,
+// or the zero time if it's not known
+func (s *Chain) Created() time.Time {
+	var created time.Time
+	for _, changeset := range s.ChangeSets {
+		if created.IsZero() || (!changeset.Created.IsZero() && changeset.Created.Before(created)) {
+			created = changeset.Created
+		}
+	}
+	return created
+}
+
+// AutosubmitDate returns when the last changeset in the chain was opted in to automatic submission,
+// or the zero time if it's not known for any of them
+func (s *Chain) AutosubmitDate() time.Time {
+	var date time.Time
+	for _, changeset := range s.ChangeSets {
+		if changeset.AutosubmitDate.After(date) {
+			date = changeset.AutosubmitDate
+		}
+	}
+	return date
+}
+
 func (s *Chain) String() string {
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("Chain[%d]", len(s.ChangeSets)))
@@ -92,7 +222,7 @@ func (s *Chain) String() string {
 
 			for i, parentCommitID := range parentCommitIDs {
 				sb.WriteString(fmt.Sprintf("%.7s", parentCommitID))
-				if i < len(parentCommitIDs) {
+				if i < len(parentCommitIDs)-1 {
 					sb.WriteString(", ")
 				}
 			}
@@ -0,0 +1,44 @@
+package gerrit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainValidate(t *testing.T) {
+	c1 := &Changeset{Number: 1, CommitID: "c1", ParentCommitIDs: []string{"head"}}
+	c2 := &Changeset{Number: 2, CommitID: "c2", ParentCommitIDs: []string{"c1"}}
+
+	t.Run("linear chain", func(t *testing.T) {
+		assert.NoError(t, (&Chain{ChangeSets: []*Changeset{c1, c2}}).Validate())
+	})
+
+	t.Run("broken chain", func(t *testing.T) {
+		c3 := &Changeset{Number: 3, CommitID: "c3", ParentCommitIDs: []string{"other"}}
+		assert.Error(t, (&Chain{ChangeSets: []*Changeset{c1, c3}}).Validate())
+	})
+
+	t.Run("merge at the beginning", func(t *testing.T) {
+		merge := &Changeset{Number: 3, CommitID: "m", ParentCommitIDs: []string{"head", "feature"}}
+		c4 := &Changeset{Number: 4, CommitID: "c4", ParentCommitIDs: []string{"m"}}
+		chain := &Chain{ChangeSets: []*Changeset{merge, c4}}
+		assert.NoError(t, chain.Validate())
+		assert.True(t, chain.HasMerges())
+	})
+
+	t.Run("merge in the middle", func(t *testing.T) {
+		merge := &Changeset{Number: 3, CommitID: "m", ParentCommitIDs: []string{"c2", "feature"}}
+		assert.NoError(t, (&Chain{ChangeSets: []*Changeset{c1, c2, merge}}).Validate())
+	})
+
+	t.Run("merge connected by its second parent", func(t *testing.T) {
+		merge := &Changeset{Number: 3, CommitID: "m", ParentCommitIDs: []string{"feature", "c2"}}
+		assert.Error(t, (&Chain{ChangeSets: []*Changeset{c1, c2, merge}}).Validate())
+	})
+
+	t.Run("merge of its own chain", func(t *testing.T) {
+		merge := &Changeset{Number: 3, CommitID: "m", ParentCommitIDs: []string{"c2", "c1"}}
+		assert.Error(t, (&Chain{ChangeSets: []*Changeset{c1, c2, merge}}).Validate())
+	})
+}
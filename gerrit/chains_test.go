@@ -0,0 +1,79 @@
+package gerrit
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeLinearChangesets returns n changesets based on each other, in reverse order
+func makeLinearChangesets(n int) []*Changeset {
+	changesets := make([]*Changeset, n)
+	parentCommitID := "head"
+	for i := 0; i < n; i++ {
+		commitID := fmt.Sprintf("c%d", i)
+		changesets[n-1-i] = &Changeset{Number: i + 1, CommitID: commitID, ParentCommitIDs: []string{parentCommitID}}
+		parentCommitID = commitID
+	}
+	return changesets
+}
+
+// makeForestChangesets returns n changesets, forming trees of the given size, forking at every changeset
+func makeForestChangesets(n, treeSize int) []*Changeset {
+	changesets := make([]*Changeset, n)
+	for i := 0; i < n; i++ {
+		parentCommitID := "head"
+		if offset := i % treeSize; offset != 0 {
+			// binary trees, stored in an array
+			parentCommitID = fmt.Sprintf("c%d", i-offset+(offset-1)/2)
+		}
+		changesets[i] = &Changeset{Number: i + 1, CommitID: fmt.Sprintf("c%d", i), ParentCommitIDs: []string{parentCommitID}}
+	}
+	return changesets
+}
+
+func TestAssembleChain(t *testing.T) {
+	logger := &log.Logger{Handler: discard.New()}
+
+	// more changesets than the old fixpoint approach could glue together
+	changesets := makeLinearChangesets(500)
+	chains, err := AssembleChain(changesets, logger)
+	assert.NoError(t, err)
+	if assert.Len(t, chains, 1) {
+		assert.Len(t, chains[0].ChangeSets, 500)
+		assert.NoError(t, chains[0].Validate())
+	}
+
+	chains, err = AssembleChain(makeForestChangesets(14, 7), logger)
+	assert.NoError(t, err)
+	// each tree of 7 forks at every changeset, so each changeset is a chain of its own
+	assert.Len(t, chains, 14)
+}
+
+func TestSortChains(t *testing.T) {
+	short := &Chain{ChangeSets: []*Changeset{{Number: 1}}}
+	long := &Chain{ChangeSets: []*Changeset{{Number: 2}, {Number: 3}}}
+	assert.Equal(t, []*Chain{long, short}, SortChains([]*Chain{short, long}))
+}
+
+func BenchmarkAssembleChain(b *testing.B) {
+	logger := &log.Logger{Handler: discard.New()}
+	for _, bc := range []struct {
+		name       string
+		changesets []*Changeset
+	}{
+		{"linear-10k", makeLinearChangesets(10000)},
+		{"independent-10k", makeForestChangesets(10000, 1)},
+		{"forest-10k", makeForestChangesets(10000, 15)},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, _ = AssembleChain(bc.changesets, logger)
+			}
+		})
+	}
+}
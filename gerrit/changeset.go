@@ -3,6 +3,10 @@ package gerrit
 import (
 	"bytes"
 	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	goGerrit "github.com/andygrunwald/go-gerrit"
 	"github.com/apex/log"
@@ -10,55 +14,328 @@ import (
 
 // Changeset represents a single changeset
 type Changeset struct {
-	changeInfo      *goGerrit.ChangeInfo
-	ChangeID        string
-	Number          int
+	changeInfo  *goGerrit.ChangeInfo
+	labelPolicy LabelPolicy
+	ChangeID    string
+	Number      int
+	Project     string
+	Branch      string
+	Topic       string
+	// Verified, CodeReviewed and Autosubmit are the values of the labels
+	// configured for the CI, review and opt-in roles
 	Verified        int
 	CodeReviewed    int
 	Autosubmit      int
 	Submittable     bool
 	CommitID        string
+	PatchSetNumber  int
 	ParentCommitIDs []string
 	OwnerName       string
 	Subject         string
+	// SubmitRequirements is only populated if the client fetches submit requirements
+	SubmitRequirements []*SubmitRequirement
+
+	// Status is NEW, MERGED or ABANDONED
+	Status         string
+	WorkInProgress bool
+	Private        bool
+	Hashtags       []string
+	// Mergeable is nil if gerrit didn't report whether the changeset can be merged
+	Mergeable              *bool
+	Created                time.Time
+	Updated                time.Time
+	Insertions             int
+	Deletions              int
+	UnresolvedCommentCount int
+	Owner                  Account
+	// Uploader uploaded the current patchset, which isn't necessarily the owner
+	Uploader Account
+	// Reviewers and CCs don't include accounts that were only added by email
+	Reviewers []Account
+	CCs       []Account
+	// Files are the paths modified by the current patchset
+	Files    []string
+	Messages []ChangeMessage
+	// AutosubmitDate is when the opt-in vote was cast, the zero time if it's not known
+	AutosubmitDate time.Time
+}
+
+// Account is a gerrit account
+type Account struct {
+	ID       int
+	Name     string
+	Email    string
+	Username string
+}
+
+func (a Account) String() string {
+	switch {
+	case a.Name != "":
+		return a.Name
+	case a.Username != "":
+		return a.Username
+	case a.Email != "":
+		return a.Email
+	default:
+		return fmt.Sprintf("account %d", a.ID)
+	}
+}
+
+// ChangeMessage is a message posted on a changeset
+type ChangeMessage struct {
+	Author  Account
+	Date    time.Time
+	Message string
+	// Tag is set for messages posted by automation, like "autogenerated:gerrit:merged"
+	Tag            string
+	PatchSetNumber int
 }
 
-// MakeChangeset creates a new Changeset object out of a goGerrit.ChangeInfo object
+// MakeChangeset creates a new Changeset object out of a goGerrit.ChangeInfo object,
+// using the default label policy
 func MakeChangeset(changeInfo *goGerrit.ChangeInfo) *Changeset {
+	return MakeChangesetWithLabelPolicy(changeInfo, DefaultLabelPolicy)
+}
+
+// MakeChangesetWithLabelPolicy creates a new Changeset object out of a goGerrit.ChangeInfo object,
+// interpreting labels according to the given label policy
+func MakeChangesetWithLabelPolicy(changeInfo *goGerrit.ChangeInfo, labelPolicy LabelPolicy) *Changeset {
 	return &Changeset{
 		changeInfo:      changeInfo,
+		labelPolicy:     labelPolicy,
 		ChangeID:        changeInfo.ChangeID,
 		Number:          changeInfo.Number,
-		Verified:        labelInfoToInt(changeInfo.Labels["Verified"]),
-		CodeReviewed:    labelInfoToInt(changeInfo.Labels["Code-Review"]),
-		Autosubmit:      labelInfoToInt(changeInfo.Labels["Autosubmit"]),
+		Project:         changeInfo.Project,
+		Branch:          changeInfo.Branch,
+		Topic:           changeInfo.Topic,
+		Verified:        labelPolicy.labelValue(changeInfo.Labels[labelPolicy.CI.Name]),
+		CodeReviewed:    labelPolicy.labelValue(changeInfo.Labels[labelPolicy.Review.Name]),
+		Autosubmit:      labelPolicy.labelValue(changeInfo.Labels[labelPolicy.OptIn.Name]),
 		Submittable:     changeInfo.Submittable,
 		CommitID:        changeInfo.CurrentRevision, // yes, this IS the commit ID.
+		PatchSetNumber:  changeInfo.Revisions[changeInfo.CurrentRevision].Number,
 		ParentCommitIDs: getParentCommitIDs(changeInfo),
 		OwnerName:       changeInfo.Owner.Name,
 		Subject:         changeInfo.Subject,
+
+		Status:                 changeInfo.Status,
+		WorkInProgress:         changeInfo.WorkInProgress,
+		Private:                changeInfo.IsPrivate,
+		Hashtags:               changeInfo.Hashtags,
+		Created:                changeInfo.Created.Time,
+		Updated:                changeInfo.Updated.Time,
+		AutosubmitDate:         latestPassingVote(changeInfo.Labels[labelPolicy.OptIn.Name], labelPolicy.OptIn),
+		Insertions:             changeInfo.Insertions,
+		Deletions:              changeInfo.Deletions,
+		UnresolvedCommentCount: changeInfo.UnresolvedCommentCount,
+		Owner:                  makeAccount(changeInfo.Owner),
+		Uploader:               makeAccount(changeInfo.Revisions[changeInfo.CurrentRevision].Uploader),
+		Reviewers:              makeAccounts(changeInfo.Reviewers["REVIEWER"]),
+		CCs:                    makeAccounts(changeInfo.Reviewers["CC"]),
+		Files:                  getFiles(changeInfo),
+		Messages:               makeChangeMessages(changeInfo.Messages),
+	}
+}
+
+// IsWorkInProgress returns true if the changeset is marked as work in progress
+func (c *Changeset) IsWorkInProgress() bool {
+	return c.WorkInProgress
+}
+
+// IsPrivate returns true if the changeset is only visible to its owner and reviewers
+func (c *Changeset) IsPrivate() bool {
+	return c.Private
+}
+
+// HasHashtag returns true if the changeset carries the given hashtag
+func (c *Changeset) HasHashtag(hashtag string) bool {
+	for _, h := range c.Hashtags {
+		if h == hashtag {
+			return true
+		}
+	}
+	return false
+}
+
+// HasConflicts returns true if gerrit reported that the changeset can't be merged.
+// If gerrit didn't compute mergeability, it's assumed to be mergeable.
+func (c *Changeset) HasConflicts() bool {
+	return c.Mergeable != nil && !*c.Mergeable
+}
+
+// IsUploadedByOwner returns true if the current patchset was uploaded by the owner of the changeset.
+// If the uploader isn't known, it's assumed to be the owner.
+func (c *Changeset) IsUploadedByOwner() bool {
+	return c.Uploader.ID == 0 || c.Uploader.ID == c.Owner.ID
+}
+
+// Size returns the number of lines changed by the changeset
+func (c *Changeset) Size() int {
+	return c.Insertions + c.Deletions
+}
+
+// makeAccount converts a goGerrit.AccountInfo to an Account
+func makeAccount(accountInfo goGerrit.AccountInfo) Account {
+	return Account{
+		ID:       accountInfo.AccountID,
+		Name:     accountInfo.Name,
+		Email:    accountInfo.Email,
+		Username: accountInfo.Username,
+	}
+}
+
+// makeAccounts converts a list of goGerrit.AccountInfo to Accounts,
+// leaving out accounts that are only known by email
+func makeAccounts(accountInfos []goGerrit.AccountInfo) []Account {
+	accounts := make([]Account, 0, len(accountInfos))
+	for _, accountInfo := range accountInfos {
+		if accountInfo.AccountID == 0 {
+			continue
+		}
+		accounts = append(accounts, makeAccount(accountInfo))
 	}
+	return accounts
+}
+
+// makeChangeMessages converts a list of goGerrit.ChangeMessageInfo to ChangeMessages
+func makeChangeMessages(messageInfos []goGerrit.ChangeMessageInfo) []ChangeMessage {
+	messages := make([]ChangeMessage, len(messageInfos))
+	for i, messageInfo := range messageInfos {
+		messages[i] = ChangeMessage{
+			Author:         makeAccount(messageInfo.Author),
+			Date:           messageInfo.Date.Time,
+			Message:        messageInfo.Message,
+			Tag:            messageInfo.Tag,
+			PatchSetNumber: messageInfo.RevisionNumber,
+		}
+	}
+	return messages
+}
+
+// getFiles returns the sorted paths of the files modified by the current revision,
+// leaving out the commit message and other magic files
+func getFiles(changeInfo *goGerrit.ChangeInfo) []string {
+	revisionInfo := changeInfo.Revisions[changeInfo.CurrentRevision]
+	files := make([]string, 0, len(revisionInfo.Files))
+	for path := range revisionInfo.Files {
+		if strings.HasPrefix(path, "/") {
+			continue
+		}
+		files = append(files, path)
+	}
+	sort.Strings(files)
+	return files
 }
 
 // IsAutosubmit returns true if the changeset is intended to be
 // automatically submitted by gerrit-queue.
 //
-// This is determined by the Change Owner setting +1 on the
-// "Autosubmit" label.
+// This is determined by the Change Owner voting on the opt-in label
+// ("Autosubmit" by default, +1) with a value passing the label policy.
 func (c *Changeset) IsAutosubmit() bool {
-	return c.Autosubmit == 1
+	return c.labelPolicy.OptIn.Passes(c.Autosubmit)
+}
+
+// OptInPatchSetNumber returns the latest patchset the owner opted in to automatic submission on,
+// according to the votes on the opt-in label recorded in the change messages.
+// It returns 0 if the owner didn't opt in, or revoked it later.
+//
+// Votes usually aren't copied to new patchsets, so a changeset with an opt-in on an older patchset
+// needs the owner to vote again.
+func (c *Changeset) OptInPatchSetNumber() int {
+	voteRegexp := c.labelPolicy.OptIn.voteRegexp()
+	patchSetNumber := 0
+	for _, message := range c.Messages {
+		if message.Author.ID != c.Owner.ID {
+			continue
+		}
+		for _, match := range voteRegexp.FindAllStringSubmatch(message.Message, -1) {
+			value, err := strconv.Atoi(strings.TrimPrefix(match[1], "+"))
+			if err != nil {
+				continue
+			}
+			if c.labelPolicy.OptIn.Passes(value) {
+				patchSetNumber = message.PatchSetNumber
+			} else {
+				patchSetNumber = 0
+			}
+		}
+	}
+	return patchSetNumber
+}
+
+// IsSubmittable returns true if gerrit allows submitting the changeset.
+//
+// Gerrit's 'submittable' field needs to be set, it also accounts for rules evaluated
+// on the server, and other changes submitted together with it.
+// If submit requirements were fetched, all of them need to be satisfied as well.
+func (c *Changeset) IsSubmittable() bool {
+	return c.Submittable && len(c.UnsatisfiedSubmitRequirements()) == 0
+}
+
+// UnsatisfiedSubmitRequirements returns the submit requirements blocking submission of the changeset
+func (c *Changeset) UnsatisfiedSubmitRequirements() []*SubmitRequirement {
+	unsatisfied := make([]*SubmitRequirement, 0)
+	for _, requirement := range c.SubmitRequirements {
+		if !requirement.IsSatisfied() {
+			unsatisfied = append(unsatisfied, requirement)
+		}
+	}
+	return unsatisfied
 }
 
 // IsVerified returns true if the changeset passed CI,
-// that's when somebody left the Approved (+1) on the "Verified" label
+// that's when the CI label ("Verified" by default, +1) has a value passing the label policy
 func (c *Changeset) IsVerified() bool {
-	return c.Verified == 1
+	return c.labelPolicy.CI.Passes(c.Verified)
+}
+
+// IsMerge returns true if the changeset is a merge commit
+func (c *Changeset) IsMerge() bool {
+	return len(c.ParentCommitIDs) > 1
+}
+
+// IsCIFailed returns true if the changeset failed CI, that's a vote failing the CI label (any negative vote by default)
+func (c *Changeset) IsCIFailed() bool {
+	return c.labelPolicy.CI.Fails(c.Verified)
 }
 
 // IsCodeReviewed returns true if the changeset passed code review,
-// that's when somebody left the Recommended (+2) on the "Code-Review" label
+// that's when the review label ("Code-Review" by default, +2) has a value passing the label policy
 func (c *Changeset) IsCodeReviewed() bool {
-	return c.CodeReviewed == 2
+	return c.labelPolicy.Review.Passes(c.CodeReviewed)
+}
+
+// LabelValues returns the values of the labels configured in the label policy
+func (c *Changeset) LabelValues() []LabelValue {
+	return []LabelValue{{
+		Role:    "CI",
+		Name:    c.labelPolicy.CI.Name,
+		Value:   c.Verified,
+		Passing: c.IsVerified(),
+		Failing: c.IsCIFailed(),
+	}, {
+		Role:    "Review",
+		Name:    c.labelPolicy.Review.Name,
+		Value:   c.CodeReviewed,
+		Passing: c.IsCodeReviewed(),
+		Failing: c.labelPolicy.Review.Fails(c.CodeReviewed),
+	}, {
+		Role:    "Opt-in",
+		Name:    c.labelPolicy.OptIn.Name,
+		Value:   c.Autosubmit,
+		Passing: c.IsAutosubmit(),
+		Failing: c.labelPolicy.OptIn.Fails(c.Autosubmit),
+	}}
+}
+
+// LabelValue returns the value of any label of the changeset, combining votes according to the label policy.
+// It's 0 if the label isn't set, or the changeset wasn't made from a gerrit change.
+func (c *Changeset) LabelValue(name string) int {
+	if c.changeInfo == nil {
+		return 0
+	}
+	return c.labelPolicy.labelValue(c.changeInfo.Labels[name])
 }
 
 func (c *Changeset) String() string {
@@ -1,7 +1,9 @@
 package gerrit
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	goGerrit "github.com/andygrunwald/go-gerrit"
 	"github.com/stretchr/testify/assert"
@@ -53,3 +55,69 @@ func TestIsAutosubmit(t *testing.T) {
 	}
 	assert.Equal(t, false, MakeChangeset(changeInfoWithAutosubmitLabelSetToMinusTwo).IsAutosubmit(), "Autosubmit label set to -2 should not be autosubmittable")
 }
+
+func TestMakeChangeset(t *testing.T) {
+	var info changeInfo
+	err := json.Unmarshal([]byte(`{
+		"change_id": "I1", "_number": 1, "status": "NEW", "subject": "foo",
+		"work_in_progress": true, "is_private": true, "hashtags": ["release"],
+		"mergeable": false,
+		"created": "2024-01-02 03:04:05.000000000", "updated": "2024-01-03 03:04:05.000000000",
+		"insertions": 10, "deletions": 3,
+		"owner": {"_account_id": 1, "name": "Owner"},
+		"reviewers": {
+			"REVIEWER": [{"_account_id": 2, "name": "Reviewer"}],
+			"CC": [{"_account_id": 3, "name": "CC"}, {"email": "unknown@example.com"}]
+		},
+		"messages": [{"author": {"_account_id": 2}, "date": "2024-01-03 03:04:05.000000000", "message": "LGTM", "_revision_number": 1}],
+		"current_revision": "c1",
+		"revisions": {"c1": {
+			"_number": 1,
+			"uploader": {"_account_id": 4, "name": "Uploader"},
+			"files": {"/COMMIT_MSG": {}, "b.go": {}, "a.go": {}}
+		}}
+	}`), &info)
+	assert.NoError(t, err)
+
+	changeset := makeChangeset(&info, DefaultLabelPolicy)
+	assert.Equal(t, "NEW", changeset.Status)
+	assert.True(t, changeset.IsWorkInProgress())
+	assert.True(t, changeset.IsPrivate())
+	assert.True(t, changeset.HasHashtag("release"))
+	assert.False(t, changeset.HasHashtag("other"))
+	assert.True(t, changeset.HasConflicts())
+	assert.Equal(t, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), changeset.Created)
+	assert.Equal(t, 13, changeset.Size())
+	assert.Equal(t, "Owner", changeset.Owner.String())
+	assert.Equal(t, "Uploader", changeset.Uploader.String())
+	assert.False(t, changeset.IsUploadedByOwner())
+	assert.Equal(t, []Account{{ID: 2, Name: "Reviewer"}}, changeset.Reviewers)
+	assert.Equal(t, []Account{{ID: 3, Name: "CC"}}, changeset.CCs)
+	assert.Equal(t, []string{"a.go", "b.go"}, changeset.Files)
+	if assert.Len(t, changeset.Messages, 1) {
+		assert.Equal(t, "LGTM", changeset.Messages[0].Message)
+		assert.Equal(t, 2, changeset.Messages[0].Author.ID)
+		assert.Equal(t, 1, changeset.Messages[0].PatchSetNumber)
+	}
+
+	// mergeability isn't always computed
+	assert.False(t, makeChangeset(&changeInfo{}, DefaultLabelPolicy).HasConflicts())
+}
+
+func TestOptInPatchSetNumber(t *testing.T) {
+	owner := Account{ID: 1}
+	changeset := &Changeset{
+		labelPolicy:    DefaultLabelPolicy,
+		Owner:          owner,
+		PatchSetNumber: 3,
+		Messages: []ChangeMessage{
+			{Author: owner, PatchSetNumber: 1, Message: "Patch Set 1: Autosubmit+1"},
+			{Author: Account{ID: 2}, PatchSetNumber: 2, Message: "Patch Set 2: Code-Review+2 Autosubmit+1"},
+			{Author: owner, PatchSetNumber: 2, Message: "Uploaded patch set 2."},
+		},
+	}
+	assert.Equal(t, 1, changeset.OptInPatchSetNumber(), "only votes of the owner count")
+
+	changeset.Messages = append(changeset.Messages, ChangeMessage{Author: owner, PatchSetNumber: 3, Message: "Patch Set 3:\n\nAutosubmit-1"})
+	assert.Equal(t, 0, changeset.OptInPatchSetNumber(), "a later negative vote revokes the opt-in")
+}
@@ -1,11 +1,15 @@
 package gerrit
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"time"
 
 	goGerrit "github.com/andygrunwald/go-gerrit"
 	"github.com/apex/log"
 
+	"net/http"
 	"net/url"
 )
 
@@ -16,59 +20,213 @@ var additionalFields = []string{
 	"CURRENT_COMMIT",
 	"DETAILED_ACCOUNTS",
 	"SUBMITTABLE",
+	"DETAILED_LABELS",
+	"MESSAGES",
+	"CURRENT_FILES",
 }
 
+// DefaultCallTimeout is the default deadline for a single call to gerrit
+const DefaultCallTimeout = time.Minute
+
+// default limits for paginated change queries
+const (
+	DefaultQueryPageSize   = 100
+	DefaultQueryMaxChanges = 5000
+)
+
 // IClient defines the gerrit.Client interface
 type IClient interface {
-	Refresh() error
+	Refresh(ctx context.Context) error
 	GetHEAD() string
 	GetBaseURL() string
 	GetChangesetURL(changeset *Changeset) string
-	SubmitChangeset(changeset *Changeset) (*Changeset, error)
-	RebaseChangeset(changeset *Changeset, ref string) (*Changeset, error)
+	SubmitChangeset(ctx context.Context, changeset *Changeset) (*Changeset, error)
+	RebaseChangeset(ctx context.Context, changeset *Changeset, ref string) (*Changeset, error)
+	ChangesetIsMergeable(ctx context.Context, changeset *Changeset) (bool, error)
+	NotifyOwner(ctx context.Context, changeset *Changeset, message string) error
+	PostMessage(ctx context.Context, changeset *Changeset, message string) error
+	ResetOptIn(ctx context.Context, changeset *Changeset, message string) error
 	ChangesetIsRebasedOnHEAD(changeset *Changeset) bool
 	ChainIsRebasedOnHEAD(chain *Chain) bool
+	UnitIsRebasedOnHEAD(unit *Unit) bool
+	ChainCanBeRebased(chain *Chain) bool
+	UnitCanBeRebased(unit *Unit) bool
 	FilterChains(filter func(s *Chain) bool) []*Chain
 	FindFirstChain(filter func(s *Chain) bool) *Chain
+	FilterUnits(filter func(u *Unit) bool) []*Unit
+	FindFirstUnit(filter func(u *Unit) bool) *Unit
 }
 
 var _ IClient = &Client{}
 
 // Client provides some ways to interact with a gerrit instance
 type Client struct {
-	client      *goGerrit.Client
-	logger      *log.Logger
-	baseURL     string
-	projectName string
-	branchName  string
-	chains      []*Chain
-	head        string
-}
-
-// NewClient initializes a new gerrit client
-func NewClient(logger *log.Logger, URL, username, password, projectName, branchName string) (*Client, error) {
-	urlParsed, err := url.Parse(URL)
-	if err != nil {
-		return nil, err
+	client *goGerrit.Client
+	// authenticated is true if requests carry credentials,
+	// and need to go to the authenticated API endpoints.
+	authenticated bool
+	logger        *log.Logger
+	baseURL       string
+	projectName   string
+	branchName    string
+	graph         *ChangeGraph
+	chains        []*Chain
+	units         []*Unit
+	head          string
+
+	chainMode     ChainMode
+	mergeStrategy MergeStrategy
+	strategy      Strategy
+	labelPolicy   LabelPolicy
+	// priorityPolicy decides which units are picked first, see UnitPriority
+	priorityPolicy PriorityPolicy
+	// dependencies caches the patchsets commits are based on, see resolveDependencies
+	dependencies map[string]*Dependency
+	// submittedTogether caches the changes submitted together with chains, see checkSubmittedTogether
+	submittedTogether map[string][]int
+
+	retryPolicy RetryPolicy
+	callTimeout time.Duration
+
+	// submitRequirements enables fetching submit requirements, which needs gerrit 3.5 or newer
+	submitRequirements bool
+
+	queryPageSize   int
+	queryMaxChanges int
+	// queryTruncated is set if the last refresh hit queryMaxChanges
+	queryTruncated bool
+}
+
+// NewClient initializes a new gerrit client.
+// authenticator adds credentials to each request, it can be nil for anonymous access.
+func NewClient(logger *log.Logger, URL string, authenticator Authenticator, projectName, branchName string) (*Client, error) {
+	httpClient := &http.Client{}
+	if authenticator != nil {
+		httpClient.Transport = authenticator.Transport(http.DefaultTransport)
 	}
-	urlParsed.User = url.UserPassword(username, password)
 
-	goGerritClient, err := goGerrit.NewClient(urlParsed.String(), nil)
+	goGerritClient, err := goGerrit.NewClient(URL, httpClient)
 	if err != nil {
 		return nil, err
 	}
 	return &Client{
-		client:      goGerritClient,
-		baseURL:     URL,
-		logger:      logger,
-		projectName: projectName,
-		branchName:  branchName,
+		client:        goGerritClient,
+		authenticated: authenticator != nil,
+		baseURL:       URL,
+		logger:        logger,
+		projectName:   projectName,
+		branchName:    branchName,
+		chainMode:     ChainModeParents,
+		mergeStrategy: MergeStrategyRequireHEAD,
+		strategy:      DefaultStrategy,
+		labelPolicy:   DefaultLabelPolicy,
+
+		priorityPolicy: DefaultPriorityPolicy,
+
+		retryPolicy: DefaultRetryPolicy,
+		callTimeout: DefaultCallTimeout,
+
+		queryPageSize:   DefaultQueryPageSize,
+		queryMaxChanges: DefaultQueryMaxChanges,
 	}, nil
 }
 
+// SetQueryLimits configures the page size used to query changesets,
+// and the maximum number of changesets fetched in total.
+// Both need to be positive, otherwise an error is returned, and the limits are left unchanged.
+func (c *Client) SetQueryLimits(pageSize, maxChanges int) error {
+	if pageSize <= 0 {
+		return fmt.Errorf("query page size must be positive, got %d", pageSize)
+	}
+	if maxChanges <= 0 {
+		return fmt.Errorf("maximum number of changes to query must be positive, got %d", maxChanges)
+	}
+	c.queryPageSize = pageSize
+	c.queryMaxChanges = maxChanges
+	return nil
+}
+
+// SetLabelPolicy configures which labels are used for CI, review and opting in to the submit queue
+func (c *Client) SetLabelPolicy(labelPolicy LabelPolicy) {
+	c.labelPolicy = labelPolicy
+}
+
+// GetLabelPolicy returns the labels used for CI, review and opting in to the submit queue
+func (c *Client) GetLabelPolicy() LabelPolicy {
+	return c.labelPolicy
+}
+
+// SetSubmitRequirements configures whether submit requirements are fetched for changesets,
+// and used to decide whether they're submittable. This needs gerrit 3.5 or newer.
+func (c *Client) SetSubmitRequirements(enabled bool) {
+	c.submitRequirements = enabled
+}
+
+// changeQueryOptions returns the additional fields requested for changesets
+func (c *Client) changeQueryOptions() []string {
+	if c.submitRequirements {
+		return append(append([]string{}, additionalFields...), "SUBMIT_REQUIREMENTS")
+	}
+	return additionalFields
+}
+
+// SetCallTimeout configures the deadline for a single call to gerrit
+func (c *Client) SetCallTimeout(timeout time.Duration) {
+	c.callTimeout = timeout
+}
+
+// call sends a request to gerrit, and decodes the response into v.
+// The request is bound to the passed context, and the configured call timeout.
+func (c *Client) call(ctx context.Context, method, u string, body, v interface{}) (*goGerrit.Response, error) {
+	if c.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.callTimeout)
+		defer cancel()
+	}
+	req, err := c.client.NewRequest(method, c.apiPath(u), body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx), v)
+	// go-gerrit leaves the body of error responses open
+	if err != nil && resp != nil && resp.Response != nil {
+		resp.Body.Close()
+	}
+	return resp, err
+}
+
+// apiPath prefixes a REST API path with /a/ if we're authenticated,
+// as gerrit only looks at credentials on these endpoints.
+func (c *Client) apiPath(u string) string {
+	if c.authenticated {
+		return "a/" + u
+	}
+	return u
+}
+
+// VerifyAuth checks the configured credentials, by querying the own account
+func (c *Client) VerifyAuth(ctx context.Context) error {
+	if !c.authenticated {
+		return nil
+	}
+	var accountInfo goGerrit.AccountInfo
+	err := c.retry(ctx, "get own account", func() (*goGerrit.Response, error) {
+		return c.call(ctx, "GET", "accounts/self", nil, &accountInfo)
+	})
+	if err != nil {
+		return err
+	}
+	c.logger.WithField("username", accountInfo.Username).Info("authenticated")
+	return nil
+}
+
 // refreshHEAD queries the commit ID of the selected project and branch
-func (c *Client) refreshHEAD() (string, error) {
-	branchInfo, _, err := c.client.Projects.GetBranch(c.projectName, c.branchName)
+func (c *Client) refreshHEAD(ctx context.Context) (string, error) {
+	u := fmt.Sprintf("projects/%s/branches/%s", url.PathEscape(c.projectName), url.PathEscape(c.branchName))
+	branchInfo := new(goGerrit.BranchInfo)
+	err := c.retry(ctx, "get branch", func() (*goGerrit.Response, error) {
+		return c.call(ctx, "GET", u, nil, branchInfo)
+	})
 	if err != nil {
 		return "", err
 	}
@@ -81,9 +239,9 @@ func (c *Client) GetHEAD() string {
 }
 
 // Refresh causes the client to refresh internal view of gerrit
-func (c *Client) Refresh() error {
+func (c *Client) Refresh(ctx context.Context) error {
 	c.logger.Debug("refreshing from gerrit")
-	HEAD, err := c.refreshHEAD()
+	HEAD, err := c.refreshHEAD(ctx)
 	if err != nil {
 		return err
 	}
@@ -91,74 +249,216 @@ func (c *Client) Refresh() error {
 
 	var queryString = fmt.Sprintf("status:open project:%s branch:%s", c.projectName, c.branchName)
 	c.logger.Debugf("fetching changesets: %s", queryString)
-	changesets, err := c.fetchChangesets(queryString)
+	changesets, err := c.fetchChangesets(ctx, queryString)
 	if err != nil {
 		return err
 	}
 
-	c.logger.Infof("assembling chains")
-	chains, err := AssembleChain(changesets, c.logger)
+	c.logger.WithField("chainMode", c.chainMode).Infof("assembling chains")
+	var dependencies map[string]*Dependency
+	if c.chainMode == ChainModeRelated {
+		dependencies, err = c.resolveDependencies(ctx, changesets)
+		if err != nil {
+			return err
+		}
+	}
+	graph := AssembleChangeGraph(changesets, dependencies, c.logger)
+	c.graph = graph
+	graph.FindOrphans(c.head)
+	chains := graph.Chains()
+	graph.ValidateChains(chains, c.logger)
+	if c.chainMode == ChainModeRelated {
+		err = c.checkSubmittedTogether(ctx, chains)
+		if err != nil {
+			return err
+		}
+	}
+	chains = c.strategy.Sort(chains)
+	c.chains = chains
+
+	c.logger.Infof("assembling units")
+	units, err := c.assembleUnits(ctx, chains, graph.Report)
 	if err != nil {
 		return err
 	}
-	chains = SortChains(chains)
-	c.chains = chains
+	c.units = units
 	return nil
 }
 
-// fetchChangesets fetches a list of changesets matching a passed query string
-func (c *Client) fetchChangesets(queryString string) (changesets []*Changeset, Error error) {
-	opt := &goGerrit.QueryChangeOptions{}
-	opt.Query = []string{
-		queryString,
-	}
-	opt.AdditionalFields = additionalFields
-	changes, _, err := c.client.Changes.QueryChanges(opt)
+// fetchChangesets fetches a list of changesets matching a passed query string.
+// If there are more than queryMaxChanges, the result is marked as truncated.
+func (c *Client) fetchChangesets(ctx context.Context, queryString string) (changesets []*Changeset, Error error) {
+	c.queryTruncated = false
+	changes, truncated, err := c.queryChanges(ctx, "query changes", queryString)
 	if err != nil {
 		return nil, err
 	}
-
-	changesets = make([]*Changeset, 0)
-	for _, change := range *changes {
-		changesets = append(changesets, MakeChangeset(&change))
+	if truncated {
+		c.logger.WithField("maxChanges", c.queryMaxChanges).Warn("query result truncated, some chains might be missing")
+		c.queryTruncated = true
 	}
 
+	changesets = make([]*Changeset, 0, len(changes))
+	for _, change := range changes {
+		changesets = append(changesets, makeChangeset(change, c.labelPolicy))
+	}
 	return changesets, nil
 }
 
+// queryChanges pages through the changes matching a query string,
+// until gerrit reports no more changes, or queryMaxChanges is reached.
+// It returns whether there were more changes than that.
+func (c *Client) queryChanges(ctx context.Context, op, queryString string) ([]*changeInfo, bool, error) {
+	result := make([]*changeInfo, 0)
+	seen := make(map[int]bool)
+	start := 0
+	for {
+		c.logger.WithField("start", start).Debug("fetching page")
+		query := url.Values{}
+		query.Set("q", queryString)
+		query.Set("n", fmt.Sprint(c.queryPageSize))
+		query.Set("S", fmt.Sprint(start))
+		for _, field := range c.changeQueryOptions() {
+			query.Add("o", field)
+		}
+
+		var changes []changeInfo
+		err := c.retry(ctx, op, func() (*goGerrit.Response, error) {
+			changes = nil
+			return c.call(ctx, "GET", "changes/?"+query.Encode(), nil, &changes)
+		})
+		if err != nil {
+			return nil, false, err
+		}
+
+		for i := range changes {
+			change := &changes[i]
+			// results are sorted by last update, so changes updated while paging
+			// might show up twice.
+			if seen[change.Number] {
+				continue
+			}
+			seen[change.Number] = true
+			result = append(result, change)
+		}
+
+		// gerrit sets _more_changes on the last change of a page, if there's more.
+		// It might return fewer changes than requested, if its own query limit is lower.
+		more := len(changes) != 0 && changes[len(changes)-1].MoreChanges
+		if len(result) > c.queryMaxChanges || (more && len(result) == c.queryMaxChanges) {
+			return result[:c.queryMaxChanges], true, nil
+		}
+		if !more {
+			return result, false, nil
+		}
+		start += len(changes)
+	}
+}
+
 // fetchChangeset downloads an existing Changeset from gerrit, by its ID
 // Gerrit's API is a bit sparse, and only returns what you explicitly ask it
 // This is used to refresh an existing changeset with more data.
-func (c *Client) fetchChangeset(changeID string) (*Changeset, error) {
-	opt := goGerrit.ChangeOptions{}
-	opt.AdditionalFields = []string{"LABELS", "DETAILED_ACCOUNTS"}
-	changeInfo, _, err := c.client.Changes.GetChange(changeID, &opt)
+func (c *Client) fetchChangeset(ctx context.Context, changeID string) (*Changeset, error) {
+	query := url.Values{}
+	for _, field := range c.changeQueryOptions() {
+		query.Add("o", field)
+	}
+	u := fmt.Sprintf("changes/%s?%s", url.PathEscape(changeID), query.Encode())
+	info := new(changeInfo)
+	err := c.retry(ctx, "get change", func() (*goGerrit.Response, error) {
+		return c.call(ctx, "GET", u, nil, info)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return MakeChangeset(changeInfo), nil
+	return makeChangeset(info, c.labelPolicy), nil
 }
 
 // SubmitChangeset submits a given changeset, and returns a changeset afterwards.
-func (c *Client) SubmitChangeset(changeset *Changeset) (*Changeset, error) {
-	changeInfo, _, err := c.client.Changes.SubmitChange(changeset.ChangeID, &goGerrit.SubmitInput{})
+// Submitting isn't idempotent, so it's not retried.
+// A changeset that can't be merged results in an ErrConflict.
+func (c *Client) SubmitChangeset(ctx context.Context, changeset *Changeset) (*Changeset, error) {
+	changeInfo := new(goGerrit.ChangeInfo)
+	u := fmt.Sprintf("changes/%s/submit", url.PathEscape(changeset.ChangeID))
+	resp, err := c.call(ctx, "POST", u, &goGerrit.SubmitInput{}, changeInfo)
 	if err != nil {
-		return nil, err
+		return nil, classifyError("submit", resp, err)
 	}
 	c.head = changeInfo.CurrentRevision
-	return c.fetchChangeset(changeInfo.ChangeID)
+	return c.fetchChangeset(ctx, changeInfo.ChangeID)
 }
 
-// RebaseChangeset rebases a given changeset on top of a given ref
-func (c *Client) RebaseChangeset(changeset *Changeset, ref string) (*Changeset, error) {
-	changeInfo, _, err := c.client.Changes.RebaseChange(changeset.ChangeID, &goGerrit.RebaseInput{
+// RebaseChangeset rebases a given changeset on top of a given ref.
+// Rebasing isn't idempotent, so it's not retried.
+// A rebase with merge conflicts results in an ErrConflict.
+func (c *Client) RebaseChangeset(ctx context.Context, changeset *Changeset, ref string) (*Changeset, error) {
+	changeInfo := new(goGerrit.ChangeInfo)
+	u := fmt.Sprintf("changes/%s/rebase", url.PathEscape(changeset.ChangeID))
+	resp, err := c.call(ctx, "POST", u, &goGerrit.RebaseInput{
 		Base:               ref,
 		OnBehalfOfUploader: true,
-	})
+	}, changeInfo)
+	if err != nil {
+		return changeset, classifyError("rebase", resp, err)
+	}
+	return c.fetchChangeset(ctx, changeInfo.ChangeID)
+}
+
+// GetEventsLog queries the events-log plugin for all events since the given time.
+// It returns the raw response body, containing one JSON-encoded event per line.
+// The caller is responsible for closing it.
+func (c *Client) GetEventsLog(ctx context.Context, since time.Time) (io.ReadCloser, error) {
+	u := fmt.Sprintf("plugins/events-log/events/?t1=%s", url.QueryEscape(since.Format("2006-01-02 15:04:05")))
+	req, err := c.client.NewRequest("GET", c.apiPath(u), nil)
+	if err != nil {
+		return nil, err
+	}
+	// the body is read after we return, so the context is only cancelled once it's closed.
+	var cancel context.CancelFunc
+	if c.callTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.callTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	resp, err := c.client.Do(req.WithContext(ctx), nil)
 	if err != nil {
-		return changeset, err
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, classifyError("get events log", resp, err)
+	}
+	return &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}, nil
+}
+
+// cancelOnClose is an io.ReadCloser cancelling a context when closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the underlying io.ReadCloser, and cancels the context
+func (r *cancelOnClose) Close() error {
+	defer r.cancel()
+	return r.ReadCloser.Close()
+}
+
+// IsQueryTruncated returns true if the last refresh didn't fetch all open changesets
+func (c *Client) IsQueryTruncated() bool {
+	return c.queryTruncated
+}
+
+// GetChangeGraph returns the dependency graph of the last refresh
+func (c *Client) GetChangeGraph() *ChangeGraph {
+	return c.graph
+}
+
+// GetAssemblyReport returns the problems found while assembling chains during the last refresh
+func (c *Client) GetAssemblyReport() *AssemblyReport {
+	if c.graph == nil {
+		return &AssemblyReport{}
 	}
-	return c.fetchChangeset(changeInfo.ChangeID)
+	return c.graph.Report
 }
 
 // GetBaseURL returns the gerrit base URL
@@ -178,27 +478,43 @@ func (c *Client) GetBranchName() string {
 
 // GetChangesetURL returns the URL to view a given changeset
 func (c *Client) GetChangesetURL(changeset *Changeset) string {
-	return fmt.Sprintf("%s/c/%s/+/%d", c.GetBaseURL(), c.projectName, changeset.Number)
+	// changesets of topics can be in other projects
+	projectName := changeset.Project
+	if projectName == "" {
+		projectName = c.projectName
+	}
+	return fmt.Sprintf("%s/c/%s/+/%d", c.GetBaseURL(), projectName, changeset.Number)
 }
 
-// ChangesetIsRebasedOnHEAD returns true if the changeset is rebased on the current HEAD
+// ChangesetIsRebasedOnHEAD returns true if the changeset is rebased on the current HEAD.
+// For merge commits, this is the case if their first parent is HEAD.
 func (c *Client) ChangesetIsRebasedOnHEAD(changeset *Changeset) bool {
-	if len(changeset.ParentCommitIDs) != 1 {
+	if len(changeset.ParentCommitIDs) == 0 {
 		return false
 	}
 	return changeset.ParentCommitIDs[0] == c.head
 }
 
 // ChainIsRebasedOnHEAD returns true if the whole chain is rebased on the current HEAD
-// this is already the case if the first changeset in the chain is rebased on the current HEAD
+// this is already the case if the first changeset in the chain is rebased on the current HEAD,
+// and no changeset is based on an outdated patchset of its predecessor.
 func (c *Client) ChainIsRebasedOnHEAD(chain *Chain) bool {
 	// an empty chain should not exist
 	if len(chain.ChangeSets) == 0 {
 		return false
 	}
+	if chain.HasOutdatedDependencies() {
+		return false
+	}
 	return c.ChangesetIsRebasedOnHEAD(chain.ChangeSets[0])
 }
 
+// UnitIsRebasedOnHEAD returns true if all chains of the unit are rebased on the current HEAD.
+// Foreign changesets are in other projects or branches, so they aren't checked.
+func (c *Client) UnitIsRebasedOnHEAD(unit *Unit) bool {
+	return unit.AllChains(c.ChainIsRebasedOnHEAD)
+}
+
 // FilterChains returns a subset of all chains, passing the given filter function
 func (c *Client) FilterChains(filter func(s *Chain) bool) []*Chain {
 	matchedChains := []*Chain{}
@@ -219,3 +535,24 @@ func (c *Client) FindFirstChain(filter func(s *Chain) bool) *Chain {
 	}
 	return nil
 }
+
+// FilterUnits returns a subset of all units, passing the given filter function
+func (c *Client) FilterUnits(filter func(u *Unit) bool) []*Unit {
+	matchedUnits := []*Unit{}
+	for _, unit := range c.units {
+		if filter(unit) {
+			matchedUnits = append(matchedUnits, unit)
+		}
+	}
+	return matchedUnits
+}
+
+// FindFirstUnit returns the first unit that matches the filter, or nil if none was found
+func (c *Client) FindFirstUnit(filter func(u *Unit) bool) *Unit {
+	for _, unit := range c.units {
+		if filter(unit) {
+			return unit
+		}
+	}
+	return nil
+}
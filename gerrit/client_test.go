@@ -0,0 +1,163 @@
+package gerrit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestClient returns a Client talking to a fake gerrit, serving the passed handler
+func newTestClient(t *testing.T, handler http.Handler) *Client {
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	c, err := NewClient(&log.Logger{Handler: discard.New()}, server.URL, &BasicAuth{Username: "user", Password: "password"}, "depot", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// writeJSON writes a JSON response, including gerrit's magic prefix
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, ")]}'\n%s", data)
+}
+
+func TestFetchChangesetsPaging(t *testing.T) {
+	// a fake gerrit with 25 open changes, which returns at most 10 changes per page
+	var requestedStarts []int
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start, _ := strconv.Atoi(r.URL.Query().Get("S"))
+		limit, _ := strconv.Atoi(r.URL.Query().Get("n"))
+		if limit > 10 {
+			limit = 10
+		}
+		requestedStarts = append(requestedStarts, start)
+
+		changes := []goGerrit.ChangeInfo{}
+		for i := start; i < start+limit && i < 25; i++ {
+			changes = append(changes, goGerrit.ChangeInfo{Number: i + 1})
+		}
+		if len(changes) > 0 && start+len(changes) < 25 {
+			changes[len(changes)-1].MoreChanges = true
+		}
+		writeJSON(w, changes)
+	}))
+
+	assert.NoError(t, c.SetQueryLimits(50, 1000))
+	changesets, err := c.fetchChangesets(context.Background(), "status:open")
+	assert.NoError(t, err)
+	assert.Len(t, changesets, 25, "all pages should be fetched")
+	assert.Equal(t, []int{0, 10, 20}, requestedStarts)
+	assert.False(t, c.IsQueryTruncated())
+
+	requestedStarts = nil
+	assert.NoError(t, c.SetQueryLimits(10, 15))
+	changesets, err = c.fetchChangesets(context.Background(), "status:open")
+	assert.NoError(t, err)
+	assert.Len(t, changesets, 15, "fetching should stop once the maximum is reached")
+	assert.True(t, c.IsQueryTruncated(), "the result should be marked as truncated")
+
+	// all changes fit, even though the last page is cut short
+	assert.NoError(t, c.SetQueryLimits(10, 25))
+	changesets, err = c.fetchChangesets(context.Background(), "status:open")
+	assert.NoError(t, err)
+	assert.Len(t, changesets, 25)
+	assert.False(t, c.IsQueryTruncated())
+
+	// non-positive limits are rejected, and the previous ones kept
+	assert.Error(t, c.SetQueryLimits(0, 25))
+	assert.Error(t, c.SetQueryLimits(-1, 25))
+	assert.Error(t, c.SetQueryLimits(10, 0))
+	assert.Error(t, c.SetQueryLimits(10, -1))
+	changesets, err = c.fetchChangesets(context.Background(), "status:open")
+	assert.NoError(t, err)
+	assert.Len(t, changesets, 25)
+}
+
+func TestFetchForeignChangesetsPaging(t *testing.T) {
+	// a topic with 25 changes in another project, gerrit returns at most 10 changes per page
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, `status:open topic:"feature"`, r.URL.Query().Get("q"))
+		start, _ := strconv.Atoi(r.URL.Query().Get("S"))
+		changes := []goGerrit.ChangeInfo{}
+		for i := start; i < start+10 && i < 25; i++ {
+			changes = append(changes, goGerrit.ChangeInfo{Number: i + 1, Project: "other", Branch: "master"})
+		}
+		if len(changes) > 0 && start+len(changes) < 25 {
+			changes[len(changes)-1].MoreChanges = true
+		}
+		writeJSON(w, changes)
+	}))
+
+	assert.NoError(t, c.SetQueryLimits(10, 1000))
+	changesets, truncated, err := c.fetchForeignChangesets(context.Background(), "feature")
+	assert.NoError(t, err)
+	assert.Len(t, changesets, 25, "all pages should be fetched")
+	assert.False(t, truncated)
+	assert.False(t, c.IsQueryTruncated(), "topics don't truncate the main query")
+
+	// a unit of a topic with changes missing isn't valid, so it's not picked
+	assert.NoError(t, c.SetQueryLimits(10, 15))
+	chain := &Chain{ChangeSets: []*Changeset{{Number: 100, Topic: "feature"}}}
+	report := &AssemblyReport{}
+	units, err := c.assembleUnits(context.Background(), []*Chain{chain}, report)
+	assert.NoError(t, err)
+	if assert.Len(t, units, 1) {
+		assert.Len(t, units[0].ForeignChangesets, 15)
+		assert.Equal(t, []string{"feature"}, report.TruncatedTopics)
+		assert.False(t, report.UnitIsValid(units[0]))
+	}
+}
+
+func TestPathEscaping(t *testing.T) {
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// spaces in path segments are %20, + is only a space in query strings
+		assert.Equal(t, "/a/projects/my%20project%2Fsub/branches/release%201", r.URL.EscapedPath())
+		writeJSON(w, goGerrit.BranchInfo{Revision: "head"})
+	}))
+	c.projectName = "my project/sub"
+	c.branchName = "release 1"
+
+	head, err := c.refreshHEAD(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "head", head)
+}
+
+func TestCallTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-unblock:
+		case <-r.Context().Done():
+		}
+	}))
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+	c.SetCallTimeout(10 * time.Millisecond)
+
+	_, err := c.refreshHEAD(context.Background())
+	assert.True(t, errors.Is(err, ErrTransient), "a hanging request should time out")
+
+	// a cancelled context aborts immediately, and isn't considered transient
+	c.SetCallTimeout(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.refreshHEAD(ctx)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.False(t, errors.Is(err, ErrTransient))
+}
@@ -0,0 +1,86 @@
+package gerrit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+)
+
+// Error kinds returned by Client operations.
+// Use errors.Is to check for them.
+var (
+	// ErrConflict is returned if gerrit refused an operation due to a conflict,
+	// like a rebase with merge conflicts, or a submit of a non-mergeable change.
+	ErrConflict = errors.New("conflict")
+	// ErrForbidden is returned if we're lacking permissions for an operation
+	ErrForbidden = errors.New("forbidden")
+	// ErrNotFound is returned if the requested object doesn't exist (anymore)
+	ErrNotFound = errors.New("not found")
+	// ErrTransient is returned on network errors and server-side failures,
+	// retrying the operation later might succeed.
+	ErrTransient = errors.New("transient error")
+)
+
+// Error is returned by Client operations that failed talking to gerrit
+type Error struct {
+	// Op is the name of the operation that failed
+	Op string
+	// StatusCode is the HTTP status code returned by gerrit, if any
+	StatusCode int
+	// Kind is one of the ErrConflict, ErrForbidden, ErrNotFound, ErrTransient,
+	// or nil if the error couldn't be classified.
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	if e.Kind != nil {
+		return fmt.Sprintf("%s: %s: %s", e.Op, e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is match the error kind
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
+
+// classifyError wraps an error returned by go-gerrit into an *Error, if err is not nil.
+func classifyError(op string, resp *goGerrit.Response, err error) error {
+	if err == nil {
+		return nil
+	}
+	e := &Error{
+		Op:  op,
+		Err: err,
+	}
+	// we gave up ourselves, that's nothing worth retrying
+	if errors.Is(err, context.Canceled) {
+		return e
+	}
+	// no response at all means we couldn't talk to gerrit (in time)
+	if resp == nil || resp.Response == nil {
+		e.Kind = ErrTransient
+		return e
+	}
+	e.StatusCode = resp.StatusCode
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		e.Kind = ErrConflict
+	case resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusUnauthorized:
+		e.Kind = ErrForbidden
+	case resp.StatusCode == http.StatusNotFound:
+		e.Kind = ErrNotFound
+	case resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		e.Kind = ErrTransient
+	}
+	return e
+}
@@ -0,0 +1,273 @@
+package gerrit
+
+import (
+	"github.com/apex/log"
+)
+
+// ChangeNode is a single changeset in a ChangeGraph
+type ChangeNode struct {
+	Changeset *Changeset
+	Parent    *ChangeNode
+	Children  []*ChangeNode
+	// Outdated is set if the changeset is based on an outdated patchset of its parent
+	Outdated *OutdatedDependency
+	// Merged contains other changesets merged by a merge commit, through its second and further parents.
+	// They're submitted together with it.
+	Merged []*ChangeNode
+}
+
+// ChangeGraph is a forest of changesets, connected by their parent -> child relation.
+//
+// Multiple changesets can be based on the same changeset, so each tree can fork.
+// The changesets up to a fork are submitted first, then each branch below it on its own.
+type ChangeGraph struct {
+	Roots []*ChangeNode
+	// Report describes the problems found while assembling the graph
+	Report *AssemblyReport
+}
+
+// AssembleChangeGraph consumes a list of changesets, and connects them to a ChangeGraph.
+//
+// A changeset is a child of the changeset whose current commit is its parent.
+// dependencies can be nil, otherwise it maps commit IDs to the patchset of another change
+// their parent belongs to, which connects changesets based on an outdated patchset.
+// Merge commits are children of their first parent, the changesets they merge are recorded in Merged.
+//
+// This runs in linear time. Changesets seen before (by change number or commit ID) are left out,
+// and dependency cycles are broken up. Both are recorded in the report of the graph.
+func AssembleChangeGraph(changesets []*Changeset, dependencies map[string]*Dependency, logger *log.Logger) *ChangeGraph {
+	report := &AssemblyReport{}
+	nodes := make([]*ChangeNode, 0, len(changesets))
+	byCommitID := make(map[string]*ChangeNode, len(changesets))
+	byNumber := make(map[int]*ChangeNode, len(changesets))
+	for _, changeset := range changesets {
+		_, seenCommit := byCommitID[changeset.CommitID]
+		_, seenNumber := byNumber[changeset.Number]
+		if seenCommit || seenNumber {
+			report.Duplicates = append(report.Duplicates, changeset)
+			continue
+		}
+		node := &ChangeNode{Changeset: changeset}
+		nodes = append(nodes, node)
+		byCommitID[changeset.CommitID] = node
+		byNumber[changeset.Number] = node
+	}
+
+	graph := &ChangeGraph{Report: report}
+	for _, node := range nodes {
+		changeset := node.Changeset
+		if len(changeset.ParentCommitIDs) == 0 {
+			graph.Roots = append(graph.Roots, node)
+			continue
+		}
+
+		parent := byCommitID[changeset.ParentCommitIDs[0]]
+		if parent == nil {
+			if dependency := dependencies[changeset.CommitID]; dependency != nil {
+				parent = byNumber[dependency.Number]
+				if parent == nil {
+					report.BrokenLinks = append(report.BrokenLinks, &BrokenLink{
+						Changeset:  changeset,
+						Dependency: dependency,
+					})
+				} else {
+					node.Outdated = &OutdatedDependency{
+						Changeset:      changeset,
+						Dependency:     parent.Changeset,
+						PatchSetNumber: dependency.PatchSetNumber,
+					}
+				}
+			}
+		}
+		for i, parentCommitID := range changeset.ParentCommitIDs {
+			if i == 0 {
+				continue
+			}
+			if merged := byCommitID[parentCommitID]; merged != nil {
+				logger.WithFields(log.Fields{
+					"changeset": changeset.String(),
+					"merged":    merged.Changeset.String(),
+				}).Warn("merge commit merges another open changeset")
+				node.Merged = append(node.Merged, merged)
+			}
+		}
+
+		if parent == nil {
+			graph.Roots = append(graph.Roots, node)
+			continue
+		}
+		node.Parent = parent
+		parent.Children = append(parent.Children, node)
+	}
+
+	graph.breakCycles(nodes)
+
+	for _, node := range nodes {
+		if node.Outdated != nil {
+			report.OutdatedParents = append(report.OutdatedParents, node.Outdated)
+		}
+	}
+	report.log(logger)
+	return graph
+}
+
+// breakCycles finds nodes that can't be reached from any root, which means they're part of a cycle,
+// or based on one. Each cycle is reported, and broken up by turning one of its nodes into a root.
+// Commits can't form cycles, so links to outdated patchsets are cut first.
+func (g *ChangeGraph) breakCycles(nodes []*ChangeNode) {
+	reachable := make(map[*ChangeNode]bool, len(nodes))
+	for _, root := range g.Roots {
+		markReachable(root, reachable)
+	}
+
+	for _, node := range nodes {
+		if reachable[node] {
+			continue
+		}
+		// parents of unreachable nodes are unreachable as well, so walking up ends in a cycle
+		onPath := make(map[*ChangeNode]bool)
+		current := node
+		for !onPath[current] {
+			onPath[current] = true
+			current = current.Parent
+		}
+		cycle := []*Changeset{current.Changeset}
+		cut := current
+		for n := current.Parent; n != current; n = n.Parent {
+			cycle = append(cycle, n.Changeset)
+			if cut.Outdated == nil && n.Outdated != nil {
+				cut = n
+			}
+		}
+		g.Report.Cycles = append(g.Report.Cycles, cycle)
+
+		parent := cut.Parent
+		for i, child := range parent.Children {
+			if child == cut {
+				parent.Children = append(parent.Children[:i], parent.Children[i+1:]...)
+				break
+			}
+		}
+		cut.Parent = nil
+		cut.Outdated = nil
+		g.Roots = append(g.Roots, cut)
+		markReachable(cut, reachable)
+	}
+}
+
+// markReachable marks the node and all of its descendants as reachable
+func markReachable(node *ChangeNode, reachable map[*ChangeNode]bool) {
+	stack := []*ChangeNode{node}
+	for len(stack) != 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		reachable[n] = true
+		stack = append(stack, n.Children...)
+	}
+}
+
+// Chains splits the trees of the graph into chains, so each changeset is part of exactly one chain.
+// A chain ends where the tree forks, and each branch below the fork starts a chain of its own.
+// Chains of branches wait for the changesets they're based on to be submitted, see ValidateChains.
+func (g *ChangeGraph) Chains() []*Chain {
+	chains := make([]*Chain, 0)
+	for _, root := range g.Roots {
+		pending := []*ChangeNode{root}
+		for len(pending) != 0 {
+			node := pending[0]
+			pending = pending[1:]
+			chain := &Chain{}
+			inChain := make(map[*ChangeNode]bool)
+			path := make([]*ChangeNode, 0)
+			for {
+				path = append(path, node)
+				inChain[node] = true
+				chain.ChangeSets = append(chain.ChangeSets, node.Changeset)
+				if node.Outdated != nil {
+					chain.OutdatedDependencies = append(chain.OutdatedDependencies, node.Outdated)
+				}
+				if len(node.Children) != 1 {
+					break
+				}
+				node = node.Children[0]
+			}
+			for _, n := range path {
+				for _, merged := range n.Merged {
+					if !inChain[merged] {
+						chain.ForeignSubmittedTogether = append(chain.ForeignSubmittedTogether, merged.Changeset.Number)
+					}
+				}
+			}
+			chains = append(chains, chain)
+			pending = append(pending, node.Children...)
+		}
+	}
+	return chains
+}
+
+// ValidateChains checks the integrity of chains of the graph, and records failures in the report.
+// Chains of a branch below a fork are recorded as waiting for their parent instead,
+// they can't be submitted before the changeset they're based on, which other branches are based on as well.
+func (g *ChangeGraph) ValidateChains(chains []*Chain, logger *log.Logger) {
+	parents := make(map[*Changeset]*Changeset)
+	for _, root := range g.Roots {
+		stack := []*ChangeNode{root}
+		for len(stack) != 0 {
+			n := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			for _, child := range n.Children {
+				parents[child.Changeset] = n.Changeset
+			}
+			stack = append(stack, n.Children...)
+		}
+	}
+
+	// report each failure only once
+	seen := make(map[string]bool)
+	for _, chain := range chains {
+		l := logger.WithField("chain", chain.String())
+		l.Debugf("checking integrity")
+		err := chain.Validate()
+		if err == nil {
+			if parent, ok := parents[chain.ChangeSets[0]]; ok {
+				waiting := &WaitingChangeset{Changeset: chain.ChangeSets[0], Parent: parent}
+				l.Info(waiting.String())
+				g.Report.WaitingForParent = append(g.Report.WaitingForParent, waiting)
+			}
+			continue
+		}
+		if seen[err.Error()] {
+			continue
+		}
+		seen[err.Error()] = true
+		l.Errorf("checking integrity failed: %s", err)
+
+		validationError, ok := err.(*ValidationError)
+		if !ok {
+			validationError = &ValidationError{Reason: err.Error()}
+		}
+		g.Report.ValidationErrors = append(g.Report.ValidationErrors, validationError)
+	}
+}
+
+// FindOrphans records the roots of the graph that aren't based on HEAD in the report.
+func (g *ChangeGraph) FindOrphans(head string) {
+	g.Report.Orphans = nil
+	for _, root := range g.Roots {
+		changeset := root.Changeset
+		if len(changeset.ParentCommitIDs) == 0 || changeset.ParentCommitIDs[0] != head {
+			g.Report.Orphans = append(g.Report.Orphans, changeset)
+		}
+	}
+}
+
+// Trees returns the roots of all trees with more than one changeset
+func (g *ChangeGraph) Trees() []*ChangeNode {
+	trees := make([]*ChangeNode, 0)
+	for _, root := range g.Roots {
+		if len(root.Children) != 0 {
+			trees = append(trees, root)
+		}
+	}
+	return trees
+}
@@ -0,0 +1,161 @@
+package gerrit
+
+import (
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssembleChangeGraph(t *testing.T) {
+	logger := &log.Logger{Handler: discard.New()}
+
+	//        /- 3 <- 4
+	// 1 <- 2
+	//        \- 5
+	c1 := &Changeset{Number: 1, CommitID: "c1", ParentCommitIDs: []string{"head"}}
+	c2 := &Changeset{Number: 2, CommitID: "c2", ParentCommitIDs: []string{"c1"}}
+	c3 := &Changeset{Number: 3, CommitID: "c3", ParentCommitIDs: []string{"c2"}}
+	c4 := &Changeset{Number: 4, CommitID: "c4", ParentCommitIDs: []string{"c3"}}
+	c5 := &Changeset{Number: 5, CommitID: "c5", ParentCommitIDs: []string{"c2"}}
+	// an unrelated changeset
+	c6 := &Changeset{Number: 6, CommitID: "c6", ParentCommitIDs: []string{"head"}}
+
+	t.Run("forks split into chains", func(t *testing.T) {
+		graph := AssembleChangeGraph([]*Changeset{c5, c4, c3, c2, c1, c6}, nil, logger)
+		if assert.Len(t, graph.Roots, 2) {
+			assert.Equal(t, c1, graph.Roots[0].Changeset)
+			assert.Equal(t, c6, graph.Roots[1].Changeset)
+		}
+
+		// each changeset is part of exactly one chain
+		chains := graph.Chains()
+		if assert.Len(t, chains, 4) {
+			assert.Equal(t, []*Changeset{c1, c2}, chains[0].ChangeSets)
+			assert.Equal(t, []*Changeset{c5}, chains[1].ChangeSets)
+			assert.Equal(t, []*Changeset{c3, c4}, chains[2].ChangeSets)
+			assert.Equal(t, []*Changeset{c6}, chains[3].ChangeSets)
+			for _, chain := range chains {
+				assert.NoError(t, chain.Validate())
+			}
+		}
+
+		// the branches wait for the changesets they share, which isn't an integrity problem
+		graph.ValidateChains(chains, logger)
+		assert.Empty(t, graph.Report.ValidationErrors)
+		if assert.Len(t, graph.Report.WaitingForParent, 2) {
+			assert.Equal(t, c5, graph.Report.WaitingForParent[0].Changeset)
+			assert.Equal(t, c2, graph.Report.WaitingForParent[0].Parent)
+			assert.Equal(t, c3, graph.Report.WaitingForParent[1].Changeset)
+		}
+		assert.False(t, graph.Report.UnitIsWaiting(&Unit{Chains: []*Chain{chains[0]}}))
+		assert.True(t, graph.Report.UnitIsWaiting(&Unit{Chains: []*Chain{chains[2]}}))
+		assert.True(t, graph.Report.UnitIsValid(&Unit{Chains: []*Chain{chains[2]}}))
+
+		trees := graph.Trees()
+		if assert.Len(t, trees, 1) {
+			assert.Equal(t, c1, trees[0].Changeset)
+			if assert.Len(t, trees[0].Children, 1) {
+				assert.Len(t, trees[0].Children[0].Children, 2)
+			}
+		}
+	})
+
+	t.Run("outdated dependencies connect to the current patchset", func(t *testing.T) {
+		c7 := &Changeset{Number: 7, CommitID: "c7", ParentCommitIDs: []string{"c2ps1"}}
+		dependencies := map[string]*Dependency{
+			"c7": {Number: 2, PatchSetNumber: 1},
+		}
+		graph := AssembleChangeGraph([]*Changeset{c1, c2, c3, c7}, dependencies, logger)
+		chains := graph.Chains()
+		if assert.Len(t, chains, 3) {
+			assert.Equal(t, []*Changeset{c1, c2}, chains[0].ChangeSets)
+			assert.Equal(t, []*Changeset{c3}, chains[1].ChangeSets)
+			assert.False(t, chains[1].HasOutdatedDependencies())
+			assert.Equal(t, []*Changeset{c7}, chains[2].ChangeSets)
+			assert.True(t, chains[2].HasOutdatedDependencies())
+			assert.NoError(t, chains[2].Validate())
+		}
+	})
+
+	t.Run("merge commits", func(t *testing.T) {
+		// merges 5 into 2
+		merge := &Changeset{Number: 8, CommitID: "m", ParentCommitIDs: []string{"c2", "c5"}}
+		graph := AssembleChangeGraph([]*Changeset{c1, c2, c5, merge}, nil, logger)
+		chains := graph.Chains()
+		if assert.Len(t, chains, 3) {
+			assert.Equal(t, []*Changeset{c1, c2}, chains[0].ChangeSets)
+			assert.Empty(t, chains[0].ForeignSubmittedTogether)
+			assert.Equal(t, []*Changeset{c5}, chains[1].ChangeSets)
+			assert.Equal(t, []*Changeset{merge}, chains[2].ChangeSets)
+			assert.NoError(t, chains[2].Validate())
+			assert.Equal(t, []int{5}, chains[2].ForeignSubmittedTogether)
+		}
+	})
+
+	t.Run("inconsistent dependencies don't form cycles", func(t *testing.T) {
+		a := &Changeset{Number: 10, CommitID: "a", ParentCommitIDs: []string{"b-old"}}
+		b := &Changeset{Number: 11, CommitID: "b", ParentCommitIDs: []string{"a-old"}}
+		dependencies := map[string]*Dependency{
+			"a": {Number: 11, PatchSetNumber: 1},
+			"b": {Number: 10, PatchSetNumber: 1},
+		}
+		graph := AssembleChangeGraph([]*Changeset{a, b}, dependencies, logger)
+		assert.Len(t, graph.Roots, 1)
+		assert.Len(t, graph.Chains(), 1)
+		if assert.Len(t, graph.Report.Cycles, 1) {
+			assert.ElementsMatch(t, []*Changeset{a, b}, graph.Report.Cycles[0])
+		}
+		assert.Len(t, graph.Report.OutdatedParents, 1, "the cut link isn't reported as outdated parent")
+	})
+
+	t.Run("report", func(t *testing.T) {
+		duplicate := &Changeset{Number: 2, CommitID: "c2", ParentCommitIDs: []string{"c1"}}
+		broken := &Changeset{Number: 9, CommitID: "c9", ParentCommitIDs: []string{"gone"}}
+		dependencies := map[string]*Dependency{
+			"c9": {Number: 42, PatchSetNumber: 3},
+		}
+		graph := AssembleChangeGraph([]*Changeset{c1, c2, duplicate, broken, c6}, dependencies, logger)
+		report := graph.Report
+		assert.Equal(t, []*Changeset{duplicate}, report.Duplicates)
+		if assert.Len(t, report.BrokenLinks, 1) {
+			assert.Equal(t, broken, report.BrokenLinks[0].Changeset)
+			assert.Equal(t, 42, report.BrokenLinks[0].Dependency.Number)
+		}
+		assert.Empty(t, report.Cycles)
+
+		graph.FindOrphans("head")
+		assert.Equal(t, []*Changeset{broken}, report.Orphans)
+
+		chains := graph.Chains()
+		graph.ValidateChains(chains, logger)
+		assert.Empty(t, report.ValidationErrors)
+		assert.False(t, report.IsEmpty())
+	})
+}
+
+func TestValidateChains(t *testing.T) {
+	logger := &log.Logger{Handler: discard.New()}
+
+	c1 := &Changeset{Number: 1, CommitID: "c1", ParentCommitIDs: []string{"head"}}
+	c2 := &Changeset{Number: 2, CommitID: "c2", ParentCommitIDs: []string{"c1"}}
+	// merges its own parent again
+	merge := &Changeset{Number: 3, CommitID: "m", ParentCommitIDs: []string{"c2", "c1"}}
+	c4 := &Changeset{Number: 4, CommitID: "c4", ParentCommitIDs: []string{"m"}}
+	c5 := &Changeset{Number: 5, CommitID: "c5", ParentCommitIDs: []string{"m"}}
+
+	graph := AssembleChangeGraph([]*Changeset{c1, c2, merge, c4, c5}, nil, logger)
+	graph.ValidateChains(graph.Chains(), logger)
+	if assert.Len(t, graph.Report.ValidationErrors, 1) {
+		assert.Equal(t, merge, graph.Report.ValidationErrors[0].Changeset)
+	}
+	// the branches below the merge wait for it
+	if assert.Len(t, graph.Report.WaitingForParent, 2) {
+		assert.Equal(t, c4, graph.Report.WaitingForParent[0].Changeset)
+		assert.Equal(t, c5, graph.Report.WaitingForParent[1].Changeset)
+	}
+	assert.False(t, graph.Report.UnitIsValid(&Unit{Chains: []*Chain{{ChangeSets: []*Changeset{c1, c2, merge}}}}))
+	assert.True(t, graph.Report.UnitIsWaiting(&Unit{Chains: []*Chain{{ChangeSets: []*Changeset{c4}}}}))
+	assert.True(t, graph.Report.UnitIsValid(&Unit{Chains: []*Chain{{ChangeSets: []*Changeset{c1, c2}}}}))
+}
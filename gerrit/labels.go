@@ -0,0 +1,232 @@
+package gerrit
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+)
+
+// VoteSemantics describes how the votes on a label are combined to a single value
+type VoteSemantics string
+
+const (
+	// VoteSemanticsMax uses the highest vote
+	VoteSemanticsMax VoteSemantics = "max"
+	// VoteSemanticsMin uses the lowest vote
+	VoteSemanticsMin VoteSemantics = "min"
+	// VoteSemanticsMaxWithBlock uses the lowest vote if it's the lowest possible value
+	// of the label (a veto), and the highest vote otherwise.
+	// This is what gerrit does for labels with the MaxWithBlock function.
+	VoteSemanticsMaxWithBlock VoteSemantics = "max-with-block"
+)
+
+// ParseVoteSemantics parses the name of vote semantics
+func ParseVoteSemantics(s string) (VoteSemantics, error) {
+	switch semantics := VoteSemantics(s); semantics {
+	case VoteSemanticsMax, VoteSemanticsMin, VoteSemanticsMaxWithBlock:
+		return semantics, nil
+	default:
+		return "", fmt.Errorf("unknown vote semantics: %s", s)
+	}
+}
+
+// LabelRule maps a role to a gerrit label, and the values passing and failing it
+type LabelRule struct {
+	// Name of the label in gerrit
+	Name string
+	// Min and Max are the (inclusive) bounds of values passing the rule
+	Min int
+	Max int
+	// Fail is the highest value failing the rule.
+	// If it's 0, any negative value fails.
+	Fail int
+}
+
+// Passes returns true if the value is within the bounds of the rule
+func (r LabelRule) Passes(value int) bool {
+	return value >= r.Min && value <= r.Max
+}
+
+// Fails returns true if the value is at or below the failing value of the rule
+func (r LabelRule) Fails(value int) bool {
+	if r.Fail == 0 {
+		return value < 0
+	}
+	return value <= r.Fail
+}
+
+func (r LabelRule) String() string {
+	s := fmt.Sprintf("%s:%d", r.Name, r.Min)
+	if r.Max != math.MaxInt32 || r.Fail != 0 {
+		s += ":"
+	}
+	if r.Max != math.MaxInt32 {
+		s += fmt.Sprint(r.Max)
+	}
+	if r.Fail != 0 {
+		s += fmt.Sprintf(":%d", r.Fail)
+	}
+	return s
+}
+
+// voteRegexps caches the regexps matching votes on a label in change messages, by label name
+var voteRegexps sync.Map
+
+// voteRegexp returns a regexp matching votes on the label in change messages, like "Autosubmit+1".
+// It's compiled once per label.
+func (r LabelRule) voteRegexp() *regexp.Regexp {
+	if cached, ok := voteRegexps.Load(r.Name); ok {
+		return cached.(*regexp.Regexp)
+	}
+	re := regexp.MustCompile(`(?:^|\s)` + regexp.QuoteMeta(r.Name) + `([+-]\d+)\b`)
+	cached, _ := voteRegexps.LoadOrStore(r.Name, re)
+	return cached.(*regexp.Regexp)
+}
+
+// ParseLabelRule parses a label rule in the form name:min[:[max][:fail]].
+// Without max, all values from min on pass. Without fail, all negative values fail.
+func ParseLabelRule(s string) (LabelRule, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 4 || parts[0] == "" {
+		return LabelRule{}, fmt.Errorf("invalid label rule %q, expected name:min[:[max][:fail]]", s)
+	}
+	rule := LabelRule{
+		Name: parts[0],
+		Max:  math.MaxInt32,
+	}
+	var err error
+	// values might be passed like gerrit renders them, with a leading +
+	if rule.Min, err = strconv.Atoi(strings.TrimPrefix(parts[1], "+")); err != nil {
+		return LabelRule{}, fmt.Errorf("invalid minimum in label rule %q: %w", s, err)
+	}
+	if len(parts) >= 3 && parts[2] != "" {
+		if rule.Max, err = strconv.Atoi(strings.TrimPrefix(parts[2], "+")); err != nil {
+			return LabelRule{}, fmt.Errorf("invalid maximum in label rule %q: %w", s, err)
+		}
+	}
+	if rule.Max < rule.Min {
+		return LabelRule{}, fmt.Errorf("invalid label rule %q, maximum is lower than minimum", s)
+	}
+	if len(parts) == 4 {
+		if rule.Fail, err = strconv.Atoi(strings.TrimPrefix(parts[3], "+")); err != nil {
+			return LabelRule{}, fmt.Errorf("invalid failing value in label rule %q: %w", s, err)
+		}
+		if rule.Fail >= rule.Min {
+			return LabelRule{}, fmt.Errorf("invalid label rule %q, failing value isn't lower than minimum", s)
+		}
+	}
+	return rule, nil
+}
+
+// LabelPolicy maps the roles the submit queue cares about to gerrit labels
+type LabelPolicy struct {
+	// CI is the label set by CI
+	CI LabelRule
+	// Review is the label used for code review
+	Review LabelRule
+	// OptIn is the label the owner sets to opt in to automatic submission
+	OptIn LabelRule
+	// Semantics describes how multiple votes on a label are combined
+	Semantics VoteSemantics
+}
+
+// DefaultLabelPolicy is used if nothing else is configured
+var DefaultLabelPolicy = LabelPolicy{
+	CI:        LabelRule{Name: "Verified", Min: 1, Max: 1},
+	Review:    LabelRule{Name: "Code-Review", Min: 2, Max: 2},
+	OptIn:     LabelRule{Name: "Autosubmit", Min: 1, Max: 1},
+	Semantics: VoteSemanticsMaxWithBlock,
+}
+
+// LabelValue is the value of a label of a changeset, as rendered in the frontend
+type LabelValue struct {
+	Role    string
+	Name    string
+	Value   int
+	Passing bool
+	Failing bool
+}
+
+func (v LabelValue) String() string {
+	if v.Value > 0 {
+		return fmt.Sprintf("%s +%d", v.Name, v.Value)
+	}
+	return fmt.Sprintf("%s %d", v.Name, v.Value)
+}
+
+// labelValue combines all votes on a label to a single value, according to the policy.
+// If the individual votes aren't known (DETAILED_LABELS wasn't requested),
+// it falls back to the approved/rejected/… shortcuts.
+func (p *LabelPolicy) labelValue(labelInfo goGerrit.LabelInfo) int {
+	if len(labelInfo.All) == 0 {
+		return labelInfoToInt(labelInfo)
+	}
+
+	lowest, highest := 0, 0
+	for _, approval := range labelInfo.All {
+		if approval.Value < lowest {
+			lowest = approval.Value
+		}
+		if approval.Value > highest {
+			highest = approval.Value
+		}
+	}
+
+	switch p.Semantics {
+	case VoteSemanticsMax:
+		return highest
+	case VoteSemanticsMin:
+		return lowest
+	default:
+		// without knowing the possible values, every negative vote blocks
+		if min := minLabelValue(labelInfo); lowest < 0 && (lowest == min || min == math.MinInt32) {
+			return lowest
+		}
+		return highest
+	}
+}
+
+// gerritTimeLayout is the format of timestamps in the gerrit REST API
+const gerritTimeLayout = "2006-01-02 15:04:05.000000000"
+
+// latestPassingVote returns when the latest vote passing the rule was cast,
+// or the zero time if there's none, or it's not known (DETAILED_LABELS wasn't requested).
+func latestPassingVote(labelInfo goGerrit.LabelInfo, rule LabelRule) time.Time {
+	var latest time.Time
+	for _, approval := range labelInfo.All {
+		if !rule.Passes(approval.Value) || approval.Date == "" {
+			continue
+		}
+		date, err := time.Parse(gerritTimeLayout, approval.Date)
+		if err != nil {
+			continue
+		}
+		if date.After(latest) {
+			latest = date
+		}
+	}
+	return latest
+}
+
+// minLabelValue returns the lowest possible value of a label,
+// or math.MinInt32 if the possible values aren't known.
+func minLabelValue(labelInfo goGerrit.LabelInfo) int {
+	min := math.MinInt32
+	for value := range labelInfo.Values {
+		// values are formatted like " 0", "+1", "-2"
+		v, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(value), "+"))
+		if err != nil {
+			continue
+		}
+		if min == math.MinInt32 || v < min {
+			min = v
+		}
+	}
+	return min
+}
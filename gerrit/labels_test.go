@@ -0,0 +1,124 @@
+package gerrit
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLabelRule(t *testing.T) {
+	rule, err := ParseLabelRule("CI-Verified:+2")
+	assert.NoError(t, err)
+	assert.Equal(t, LabelRule{Name: "CI-Verified", Min: 2, Max: math.MaxInt32}, rule)
+	assert.True(t, rule.Passes(2))
+	assert.False(t, rule.Passes(1))
+
+	rule, err = ParseLabelRule("Queue:1:1")
+	assert.NoError(t, err)
+	assert.Equal(t, LabelRule{Name: "Queue", Min: 1, Max: 1}, rule)
+	assert.Equal(t, "Queue:1:1", rule.String())
+
+	// any negative value fails by default
+	assert.True(t, rule.Fails(-1))
+	assert.False(t, rule.Fails(0))
+
+	rule, err = ParseLabelRule("CI-Verified:2::-2")
+	assert.NoError(t, err)
+	assert.Equal(t, LabelRule{Name: "CI-Verified", Min: 2, Max: math.MaxInt32, Fail: -2}, rule)
+	assert.Equal(t, "CI-Verified:2::-2", rule.String())
+	assert.False(t, rule.Fails(-1), "-1 is above the failing value")
+	assert.True(t, rule.Fails(-2))
+
+	rule, err = ParseLabelRule("Queue:1:1:-1")
+	assert.NoError(t, err)
+	assert.Equal(t, LabelRule{Name: "Queue", Min: 1, Max: 1, Fail: -1}, rule)
+	assert.Equal(t, "Queue:1:1:-1", rule.String())
+
+	for _, invalid := range []string{"", "Queue", ":1", "Queue:x", "Queue:1:x", "Queue:2:1", "Queue:1:2:x", "Queue:1:2:1", "Queue:1:2:3:4"} {
+		_, err := ParseLabelRule(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestLabelPolicy(t *testing.T) {
+	policy := LabelPolicy{
+		CI:        LabelRule{Name: "CI-Verified", Min: 2, Max: 2},
+		Review:    LabelRule{Name: "Review", Min: 2, Max: 2},
+		OptIn:     LabelRule{Name: "Queue", Min: 1, Max: 1},
+		Semantics: VoteSemanticsMaxWithBlock,
+	}
+	values := map[string]string{"-2": "", "-1": "", " 0": "", "+1": "", "+2": ""}
+	votes := func(values ...int) []goGerrit.ApprovalInfo {
+		approvals := make([]goGerrit.ApprovalInfo, len(values))
+		for i, value := range values {
+			approvals[i] = goGerrit.ApprovalInfo{Value: value}
+		}
+		return approvals
+	}
+
+	changeset := MakeChangesetWithLabelPolicy(&goGerrit.ChangeInfo{
+		Labels: map[string]goGerrit.LabelInfo{
+			"CI-Verified": {All: votes(1, 0), Values: values},
+			// -1 doesn't block with MaxWithBlock
+			"Review": {All: votes(-1, 2), Values: values},
+			"Queue":  {All: votes(1)},
+			// the default labels are ignored
+			"Verified":   {All: votes(1)},
+			"Autosubmit": {All: votes(1)},
+		},
+	}, policy)
+	assert.False(t, changeset.IsVerified(), "+1 doesn't pass a CI label requiring +2")
+	assert.False(t, changeset.IsCIFailed())
+	assert.True(t, changeset.IsCodeReviewed())
+	assert.True(t, changeset.IsAutosubmit())
+
+	changeset = MakeChangesetWithLabelPolicy(&goGerrit.ChangeInfo{
+		Labels: map[string]goGerrit.LabelInfo{
+			"CI-Verified": {All: votes(2)},
+			// -2 is a veto
+			"Review": {All: votes(-2, 2), Values: values},
+		},
+	}, policy)
+	assert.True(t, changeset.IsVerified())
+	assert.False(t, changeset.IsCodeReviewed())
+	assert.Equal(t, -2, changeset.CodeReviewed)
+	assert.False(t, changeset.IsAutosubmit())
+
+	policy.Semantics = VoteSemanticsMax
+	changeset = MakeChangesetWithLabelPolicy(&goGerrit.ChangeInfo{
+		Labels: map[string]goGerrit.LabelInfo{
+			"Review": {All: votes(-2, 2), Values: values},
+		},
+	}, policy)
+	assert.True(t, changeset.IsCodeReviewed(), "only the highest vote counts")
+	assert.Equal(t, []string{"CI-Verified 0", "Review +2", "Queue 0"}, func() []string {
+		var labels []string
+		for _, label := range changeset.LabelValues() {
+			labels = append(labels, label.String())
+		}
+		return labels
+	}())
+}
+
+func TestLatestPassingVote(t *testing.T) {
+	rule := LabelRule{Name: "Autosubmit", Min: 1, Max: 1}
+	labelInfo := goGerrit.LabelInfo{All: []goGerrit.ApprovalInfo{
+		{Value: 1, Date: "2024-01-01 10:00:00.000000000"},
+		{Value: 1, Date: "2024-01-02 10:00:00.000000000"},
+		// non-passing votes don't count
+		{Value: 0, Date: "2024-01-03 10:00:00.000000000"},
+		{Value: 1},
+	}}
+	assert.Equal(t, time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC), latestPassingVote(labelInfo, rule))
+	assert.True(t, latestPassingVote(goGerrit.LabelInfo{}, rule).IsZero())
+}
+
+func TestLabelRuleVoteRegexp(t *testing.T) {
+	rule := LabelRule{Name: "Queue", Min: 1, Max: 1}
+	assert.Same(t, rule.voteRegexp(), rule.voteRegexp(), "the regexp should be compiled once")
+	assert.Equal(t, []string{" Queue+1", "+1"}, rule.voteRegexp().FindStringSubmatch("Patch Set 2: Queue+1"))
+	assert.Nil(t, rule.voteRegexp().FindStringSubmatch("Patch Set 2: MyQueue+1"))
+}
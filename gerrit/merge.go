@@ -0,0 +1,44 @@
+package gerrit
+
+import (
+	"fmt"
+)
+
+// MergeStrategy selects how chains containing merge commits are brought up to date with HEAD
+type MergeStrategy string
+
+const (
+	// MergeStrategyRequireHEAD never rebases merge commits.
+	// Chains containing a merge commit are only submitted once their first changeset
+	// is based on HEAD, which is up to the owner.
+	MergeStrategyRequireHEAD MergeStrategy = "require-head"
+	// MergeStrategyRemerge asks gerrit to rebase merge commits, which moves their first parent
+	// to HEAD and merges the other parents again. This needs gerrit 3.7 or newer.
+	MergeStrategyRemerge MergeStrategy = "remerge"
+)
+
+// ParseMergeStrategy parses the name of a merge strategy
+func ParseMergeStrategy(s string) (MergeStrategy, error) {
+	switch strategy := MergeStrategy(s); strategy {
+	case MergeStrategyRequireHEAD, MergeStrategyRemerge:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown merge strategy: %s", s)
+	}
+}
+
+// SetMergeStrategy configures how chains containing merge commits are rebased
+func (c *Client) SetMergeStrategy(strategy MergeStrategy) {
+	c.mergeStrategy = strategy
+}
+
+// ChainCanBeRebased returns false if the chain isn't rebased on HEAD,
+// but contains merge commits the merge strategy doesn't allow to be rebased.
+func (c *Client) ChainCanBeRebased(chain *Chain) bool {
+	return c.mergeStrategy == MergeStrategyRemerge || !chain.HasMerges() || c.ChainIsRebasedOnHEAD(chain)
+}
+
+// UnitCanBeRebased returns true if all chains of the unit can be rebased on HEAD, see ChainCanBeRebased.
+func (c *Client) UnitCanBeRebased(unit *Unit) bool {
+	return unit.AllChains(c.ChainCanBeRebased)
+}
@@ -0,0 +1,24 @@
+package gerrit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainCanBeRebased(t *testing.T) {
+	c := &Client{head: "head", mergeStrategy: MergeStrategyRequireHEAD}
+
+	linear := &Chain{ChangeSets: []*Changeset{{Number: 1, CommitID: "c1", ParentCommitIDs: []string{"old"}}}}
+	mergeOnHEAD := &Chain{ChangeSets: []*Changeset{{Number: 2, CommitID: "m1", ParentCommitIDs: []string{"head", "feature"}}}}
+	outdatedMerge := &Chain{ChangeSets: []*Changeset{{Number: 3, CommitID: "m2", ParentCommitIDs: []string{"old", "feature"}}}}
+
+	assert.True(t, c.ChainIsRebasedOnHEAD(mergeOnHEAD), "merges are based on their first parent")
+
+	assert.True(t, c.ChainCanBeRebased(linear))
+	assert.True(t, c.ChainCanBeRebased(mergeOnHEAD))
+	assert.False(t, c.ChainCanBeRebased(outdatedMerge))
+
+	c.SetMergeStrategy(MergeStrategyRemerge)
+	assert.True(t, c.ChainCanBeRebased(outdatedMerge))
+}
@@ -0,0 +1,101 @@
+package gerrit
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+)
+
+// messageTag marks messages posted by the submit queue as automated,
+// so gerrit can hide them together with other bot messages.
+const messageTag = "autogenerated:gerrit-queue"
+
+// ChangesetIsMergeable asks gerrit whether the current patchset of a changeset, including the changesets
+// it's based on, can be merged into the target branch without conflicts.
+// Gerrit computes this according to the submit type of the project, against the current tip of the branch.
+func (c *Client) ChangesetIsMergeable(ctx context.Context, changeset *Changeset) (bool, error) {
+	u := fmt.Sprintf("changes/%s/revisions/current/mergeable", url.PathEscape(changeset.ChangeID))
+	var mergeableInfo goGerrit.MergeableInfo
+	err := c.retry(ctx, "check mergeable", func() (*goGerrit.Response, error) {
+		return c.call(ctx, "GET", u, nil, &mergeableInfo)
+	})
+	if err != nil {
+		return false, err
+	}
+	return mergeableInfo.Mergeable, nil
+}
+
+// FindUnmergeable checks whether every chain of the unit can be merged without conflicts,
+// by checking the last changeset of each chain. Foreign changesets aren't checked.
+// It returns the first changeset that can't be merged, or nil.
+func (c *Client) FindUnmergeable(ctx context.Context, unit *Unit) (*Changeset, error) {
+	for _, chain := range unit.Chains {
+		if len(chain.ChangeSets) == 0 {
+			continue
+		}
+		leaf := chain.ChangeSets[len(chain.ChangeSets)-1]
+		mergeable, err := c.ChangesetIsMergeable(ctx, leaf)
+		if err != nil {
+			return nil, err
+		}
+		if !mergeable {
+			return leaf, nil
+		}
+	}
+	return nil, nil
+}
+
+// NotifyOwner posts a message on the current patchset of a changeset, only notifying its owner.
+// Posting isn't idempotent, so it's not retried.
+func (c *Client) NotifyOwner(ctx context.Context, changeset *Changeset, message string) error {
+	u := fmt.Sprintf("changes/%s/revisions/current/review", url.PathEscape(changeset.ChangeID))
+	resp, err := c.call(ctx, "POST", u, &goGerrit.ReviewInput{
+		Message: message,
+		Tag:     messageTag,
+		Notify:  "OWNER",
+	}, nil)
+	return classifyError("post message", resp, err)
+}
+
+// PostMessage posts a message on the current patchset of a changeset, without notifying anybody.
+// It's not tagged as autogenerated, so CI systems triggered by comments pick it up.
+// Posting isn't idempotent, so it's not retried.
+func (c *Client) PostMessage(ctx context.Context, changeset *Changeset, message string) error {
+	u := fmt.Sprintf("changes/%s/revisions/current/review", url.PathEscape(changeset.ChangeID))
+	resp, err := c.call(ctx, "POST", u, &goGerrit.ReviewInput{
+		Message: message,
+		Notify:  "NONE",
+	}, nil)
+	return classifyError("post message", resp, err)
+}
+
+// ResetOptIn removes the votes opting a changeset in to automatic submission, and posts a message
+// on its current patchset, only notifying its owner.
+// Votes are deleted one by one, which needs the permission to remove reviewers,
+// the message is posted even if that's not allowed.
+// Posting isn't idempotent, so it's not retried.
+func (c *Client) ResetOptIn(ctx context.Context, changeset *Changeset, message string) error {
+	label := c.labelPolicy.OptIn.Name
+	var voteErr error
+	if changeset.changeInfo != nil {
+		for _, approval := range changeset.changeInfo.Labels[label].All {
+			if approval.Value == 0 {
+				continue
+			}
+			u := fmt.Sprintf("changes/%s/reviewers/%d/votes/%s/delete",
+				url.PathEscape(changeset.ChangeID), approval.AccountID, url.PathEscape(label))
+			resp, err := c.call(ctx, "POST", u, &goGerrit.DeleteVoteInput{Notify: "NONE"}, nil)
+			if err := classifyError("delete vote", resp, err); err != nil {
+				voteErr = err
+				break
+			}
+		}
+	}
+
+	if err := c.NotifyOwner(ctx, changeset, message); err != nil {
+		return err
+	}
+	return voteErr
+}
@@ -0,0 +1,89 @@
+package gerrit
+
+import (
+	"fmt"
+)
+
+// Priority decides which units are submitted first, regardless of the strategy
+type Priority int
+
+const (
+	// PriorityNormal is the priority of all units nobody asked to prioritize
+	PriorityNormal Priority = iota
+	// PriorityHigh units are picked before normal ones, like hotfixes and reverts
+	PriorityHigh
+	// PriorityEmergency units are picked first, and can preempt the unit in progress
+	PriorityEmergency
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityEmergency:
+		return "emergency"
+	default:
+		return fmt.Sprintf("priority %d", int(p))
+	}
+}
+
+// PriorityPolicy describes how changesets ask for priority, through hashtags or a label.
+// Empty names disable the respective mechanism.
+type PriorityPolicy struct {
+	// Hashtag gives a changeset high priority
+	Hashtag string
+	// EmergencyHashtag gives a changeset emergency priority
+	EmergencyHashtag string
+	// Label gives a changeset high priority if voted +1, and emergency priority if voted +2 or higher
+	Label string
+}
+
+// DefaultPriorityPolicy is used if nothing else is configured
+var DefaultPriorityPolicy = PriorityPolicy{
+	Hashtag:          "queue-priority",
+	EmergencyHashtag: "queue-emergency",
+}
+
+// Priority returns the priority a changeset asks for
+func (p PriorityPolicy) Priority(c *Changeset) Priority {
+	priority := PriorityNormal
+	if p.Label != "" {
+		switch value := c.LabelValue(p.Label); {
+		case value >= 2:
+			priority = PriorityEmergency
+		case value == 1:
+			priority = PriorityHigh
+		}
+	}
+	switch {
+	case p.EmergencyHashtag != "" && c.HasHashtag(p.EmergencyHashtag):
+		priority = PriorityEmergency
+	case p.Hashtag != "" && c.HasHashtag(p.Hashtag) && priority < PriorityHigh:
+		priority = PriorityHigh
+	}
+	return priority
+}
+
+// SetPriorityPolicy configures how changesets ask for priority
+func (c *Client) SetPriorityPolicy(policy PriorityPolicy) {
+	c.priorityPolicy = policy
+}
+
+// GetPriorityPolicy returns how changesets ask for priority
+func (c *Client) GetPriorityPolicy() PriorityPolicy {
+	return c.priorityPolicy
+}
+
+// UnitPriority returns the highest priority any changeset of the unit asks for.
+// Units are submitted as a whole, so a single prioritized changeset prioritizes all of them.
+func (c *Client) UnitPriority(unit *Unit) Priority {
+	priority := PriorityNormal
+	for _, changeset := range unit.Changesets() {
+		if p := c.priorityPolicy.Priority(changeset); p > priority {
+			priority = p
+		}
+	}
+	return priority
+}
@@ -0,0 +1,33 @@
+package gerrit
+
+import (
+	"testing"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPriorityPolicy(t *testing.T) {
+	policy := DefaultPriorityPolicy
+	assert.Equal(t, PriorityNormal, policy.Priority(&Changeset{}))
+	assert.Equal(t, PriorityHigh, policy.Priority(&Changeset{Hashtags: []string{"queue-priority"}}))
+	assert.Equal(t, PriorityEmergency, policy.Priority(&Changeset{Hashtags: []string{"queue-priority", "queue-emergency"}}))
+
+	priority := func(value int) *Changeset {
+		return MakeChangeset(&goGerrit.ChangeInfo{Labels: map[string]goGerrit.LabelInfo{
+			"Priority": {All: []goGerrit.ApprovalInfo{{Value: value}}},
+		}})
+	}
+	assert.Equal(t, PriorityNormal, policy.Priority(priority(2)), "the label is disabled by default")
+	policy.Label = "Priority"
+	assert.Equal(t, PriorityNormal, policy.Priority(priority(-1)))
+	assert.Equal(t, PriorityHigh, policy.Priority(priority(1)))
+	assert.Equal(t, PriorityEmergency, policy.Priority(priority(2)))
+
+	c := &Client{priorityPolicy: DefaultPriorityPolicy}
+	unit := &Unit{Chains: []*Chain{{ChangeSets: []*Changeset{
+		{Number: 1},
+		{Number: 2, Hashtags: []string{"queue-priority"}},
+	}}}}
+	assert.Equal(t, PriorityHigh, c.UnitPriority(unit), "a single changeset prioritizes the whole unit")
+}
@@ -0,0 +1,206 @@
+package gerrit
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/apex/log"
+)
+
+// ChainMode selects how changesets are grouped together to chains
+type ChainMode string
+
+const (
+	// ChainModeParents only matches parent commit IDs against the commit IDs of other changesets.
+	// A chain that was partially rebased (for example in the web interface)
+	// ends up as multiple independent chains.
+	ChainModeParents ChainMode = "parents"
+	// ChainModeRelated additionally asks gerrit for the related changes of changesets that
+	// can't be matched, which keeps changesets based on an outdated patchset in the chain.
+	ChainModeRelated ChainMode = "related"
+)
+
+// ParseChainMode parses the name of a chain mode
+func ParseChainMode(s string) (ChainMode, error) {
+	switch mode := ChainMode(s); mode {
+	case ChainModeParents, ChainModeRelated:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown chain mode: %s", s)
+	}
+}
+
+// SetChainMode configures how changesets are grouped together to chains
+func (c *Client) SetChainMode(mode ChainMode) {
+	c.chainMode = mode
+}
+
+// Dependency points to the patchset of a change another commit is based on
+type Dependency struct {
+	Number         int
+	PatchSetNumber int
+}
+
+// AssembleRelatedChain groups changesets together to chains, like AssembleChain.
+//
+// In addition to matching parent commit IDs against current commit IDs, it consults
+// dependencies, which maps commit IDs to the patchset their parent commit belongs to.
+// This keeps changesets based on an outdated patchset of another changeset in its chain,
+// the outdated dependency is recorded in the chain.
+func AssembleRelatedChain(changesets []*Changeset, dependencies map[string]*Dependency, logger *log.Logger) []*Chain {
+	graph := AssembleChangeGraph(changesets, dependencies, logger)
+	chains := graph.Chains()
+	graph.ValidateChains(chains, logger)
+	return chains
+}
+
+// fetchRelatedChanges returns the related changes of the current patchset of a changeset,
+// newest first.
+func (c *Client) fetchRelatedChanges(ctx context.Context, changeset *Changeset) ([]goGerrit.RelatedChangeAndCommitInfo, error) {
+	u := fmt.Sprintf("changes/%s/revisions/%s/related", url.PathEscape(changeset.ChangeID), changeset.CommitID)
+	var relatedChanges goGerrit.RelatedChangesInfo
+	err := c.retry(ctx, "get related changes", func() (*goGerrit.Response, error) {
+		relatedChanges = goGerrit.RelatedChangesInfo{}
+		return c.call(ctx, "GET", u, nil, &relatedChanges)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return relatedChanges.Changes, nil
+}
+
+// fetchSubmittedTogether returns the numbers of all changes gerrit would submit together with the changeset
+func (c *Client) fetchSubmittedTogether(ctx context.Context, changeset *Changeset) ([]int, error) {
+	u := fmt.Sprintf("changes/%s/submitted_together", url.PathEscape(changeset.ChangeID))
+	var changes []goGerrit.ChangeInfo
+	err := c.retry(ctx, "get submitted together", func() (*goGerrit.Response, error) {
+		changes = nil
+		return c.call(ctx, "GET", u, nil, &changes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]int, len(changes))
+	for i, change := range changes {
+		numbers[i] = change.Number
+	}
+	return numbers, nil
+}
+
+// resolveDependencies looks up the patchsets the given changesets are based on,
+// for all changesets whose parent commit is neither HEAD nor the current patchset of another changeset.
+//
+// The ancestry of a commit never changes, so results are cached by commit ID.
+// A nil entry means the parent doesn't belong to a change.
+func (c *Client) resolveDependencies(ctx context.Context, changesets []*Changeset) (map[string]*Dependency, error) {
+	currentCommitIDs := make(map[string]bool, len(changesets))
+	for _, changeset := range changesets {
+		currentCommitIDs[changeset.CommitID] = true
+	}
+
+	// forget about commits that aren't current anymore
+	for commitID := range c.dependencies {
+		if !currentCommitIDs[commitID] {
+			delete(c.dependencies, commitID)
+		}
+	}
+	if c.dependencies == nil {
+		c.dependencies = make(map[string]*Dependency)
+	}
+
+	for _, changeset := range changesets {
+		if len(changeset.ParentCommitIDs) != 1 {
+			continue
+		}
+		parentCommitID := changeset.ParentCommitIDs[0]
+		if parentCommitID == c.head || currentCommitIDs[parentCommitID] {
+			continue
+		}
+		if _, ok := c.dependencies[changeset.CommitID]; ok {
+			continue
+		}
+
+		c.logger.WithField("changeset", changeset.String()).Debug("fetching related changes")
+		relatedChanges, err := c.fetchRelatedChanges(ctx, changeset)
+		if err != nil {
+			return nil, err
+		}
+
+		// every related change tells us about its parent, if it's related as well
+		relatedByCommitID := make(map[string]*goGerrit.RelatedChangeAndCommitInfo, len(relatedChanges))
+		for i := range relatedChanges {
+			relatedByCommitID[relatedChanges[i].Commit.Commit] = &relatedChanges[i]
+		}
+		c.dependencies[changeset.CommitID] = nil
+		for _, relatedChange := range relatedChanges {
+			if len(relatedChange.Commit.Parents) != 1 {
+				continue
+			}
+			if parent, ok := relatedByCommitID[relatedChange.Commit.Parents[0].Commit]; ok {
+				c.dependencies[relatedChange.Commit.Commit] = &Dependency{
+					Number:         parent.ChangeNumber,
+					PatchSetNumber: parent.RevisionNumber,
+				}
+			}
+		}
+	}
+
+	return c.dependencies, nil
+}
+
+// submittedTogetherKey identifies a chain by its patchsets, and their topics
+func submittedTogetherKey(chain *Chain) string {
+	parts := make([]string, len(chain.ChangeSets))
+	for i, changeset := range chain.ChangeSets {
+		parts[i] = changeset.CommitID + "@" + changeset.Topic
+	}
+	return strings.Join(parts, ",")
+}
+
+// checkSubmittedTogether reports changes gerrit would submit together with a chain that aren't part of it.
+// Results are cached by submittedTogetherKey, so only new and updated chains are checked.
+func (c *Client) checkSubmittedTogether(ctx context.Context, chains []*Chain) error {
+	cache := make(map[string][]int, len(chains))
+	for _, chain := range chains {
+		// a single changeset based on HEAD is submitted on its own
+		if len(chain.ChangeSets) == 1 && c.ChainIsRebasedOnHEAD(chain) {
+			continue
+		}
+		key := submittedTogetherKey(chain)
+		submittedTogether, ok := c.submittedTogether[key]
+		if !ok {
+			leaf := chain.ChangeSets[len(chain.ChangeSets)-1]
+			var err error
+			submittedTogether, err = c.fetchSubmittedTogether(ctx, leaf)
+			if err != nil {
+				return err
+			}
+		}
+		cache[key] = submittedTogether
+
+		inChain := make(map[int]bool, len(chain.ChangeSets))
+		for _, changeset := range chain.ChangeSets {
+			inChain[changeset.Number] = true
+		}
+		for _, number := range chain.ForeignSubmittedTogether {
+			inChain[number] = true
+		}
+		for _, number := range submittedTogether {
+			if !inChain[number] {
+				chain.ForeignSubmittedTogether = append(chain.ForeignSubmittedTogether, number)
+			}
+		}
+		if len(chain.ForeignSubmittedTogether) != 0 {
+			c.logger.WithFields(log.Fields{
+				"chain":   chain.String(),
+				"changes": chain.ForeignSubmittedTogether,
+			}).Warn("gerrit would submit changes outside of the chain together with it")
+		}
+	}
+	// forget about chains that are gone
+	c.submittedTogether = cache
+	return nil
+}
@@ -0,0 +1,113 @@
+package gerrit
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssembleRelatedChain(t *testing.T) {
+	logger := &log.Logger{Handler: discard.New()}
+
+	// 1 <- 2 <- 3, where 3 is based on patchset 1 of 2, which is at patchset 2 now
+	c1 := &Changeset{Number: 1, CommitID: "c1", PatchSetNumber: 1, ParentCommitIDs: []string{"head"}}
+	c2 := &Changeset{Number: 2, CommitID: "c2ps2", PatchSetNumber: 2, ParentCommitIDs: []string{"c1"}}
+	c3 := &Changeset{Number: 3, CommitID: "c3", PatchSetNumber: 1, ParentCommitIDs: []string{"c2ps1"}}
+	// an unrelated changeset
+	c4 := &Changeset{Number: 4, CommitID: "c4", PatchSetNumber: 1, ParentCommitIDs: []string{"head"}}
+
+	t.Run("without dependencies, the chain is split", func(t *testing.T) {
+		chains := AssembleRelatedChain([]*Changeset{c3, c2, c1, c4}, nil, logger)
+		assert.Len(t, chains, 3)
+	})
+
+	t.Run("outdated dependencies keep the chain together", func(t *testing.T) {
+		dependencies := map[string]*Dependency{
+			"c3": {Number: 2, PatchSetNumber: 1},
+		}
+		chains := AssembleRelatedChain([]*Changeset{c3, c2, c1, c4}, dependencies, logger)
+		if assert.Len(t, chains, 2) {
+			assert.Equal(t, []*Changeset{c1, c2, c3}, chains[0].ChangeSets)
+			assert.NoError(t, chains[0].Validate())
+			if assert.Len(t, chains[0].OutdatedDependencies, 1) {
+				assert.Equal(t, c3, chains[0].OutdatedDependencies[0].Changeset)
+				assert.Equal(t, c2, chains[0].OutdatedDependencies[0].Dependency)
+				assert.Equal(t, 1, chains[0].OutdatedDependencies[0].PatchSetNumber)
+			}
+			assert.Equal(t, []*Changeset{c4}, chains[1].ChangeSets)
+			assert.False(t, chains[1].HasOutdatedDependencies())
+		}
+	})
+
+	t.Run("siblings split into chains", func(t *testing.T) {
+		sibling := &Changeset{Number: 5, CommitID: "c5", PatchSetNumber: 1, ParentCommitIDs: []string{"c1"}}
+		chains := AssembleRelatedChain([]*Changeset{c1, c2, sibling}, nil, logger)
+		if assert.Len(t, chains, 3) {
+			assert.Equal(t, []*Changeset{c1}, chains[0].ChangeSets)
+			assert.Equal(t, []*Changeset{c2}, chains[1].ChangeSets)
+			assert.Equal(t, []*Changeset{sibling}, chains[2].ChangeSets)
+		}
+	})
+}
+
+func TestResolveDependencies(t *testing.T) {
+	relatedRequests := 0
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/a/changes/I3/revisions/c3/related", r.URL.Path)
+		relatedRequests++
+		// newest first, including the outdated patchset of 2
+		writeJSON(w, goGerrit.RelatedChangesInfo{Changes: []goGerrit.RelatedChangeAndCommitInfo{{
+			ChangeNumber: 3, RevisionNumber: 1, CurrentRevisionNumber: 1,
+			Commit: goGerrit.CommitInfo{Commit: "c3", Parents: []goGerrit.CommitInfo{{Commit: "c2ps1"}}},
+		}, {
+			ChangeNumber: 2, RevisionNumber: 1, CurrentRevisionNumber: 2,
+			Commit: goGerrit.CommitInfo{Commit: "c2ps1", Parents: []goGerrit.CommitInfo{{Commit: "c1"}}},
+		}, {
+			ChangeNumber: 1, RevisionNumber: 1, CurrentRevisionNumber: 1,
+			Commit: goGerrit.CommitInfo{Commit: "c1", Parents: []goGerrit.CommitInfo{{Commit: "head"}}},
+		}}})
+	}))
+	c.head = "head"
+
+	changesets := []*Changeset{
+		{Number: 1, ChangeID: "I1", CommitID: "c1", ParentCommitIDs: []string{"head"}},
+		{Number: 2, ChangeID: "I2", CommitID: "c2ps2", ParentCommitIDs: []string{"c1"}},
+		{Number: 3, ChangeID: "I3", CommitID: "c3", ParentCommitIDs: []string{"c2ps1"}},
+	}
+
+	for i := 0; i < 2; i++ {
+		dependencies, err := c.resolveDependencies(context.Background(), changesets)
+		assert.NoError(t, err)
+		assert.Equal(t, &Dependency{Number: 2, PatchSetNumber: 1}, dependencies["c3"])
+	}
+	assert.Equal(t, 1, relatedRequests, "related changes should only be fetched once per commit")
+}
+
+func TestCheckSubmittedTogether(t *testing.T) {
+	requests := 0
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		writeJSON(w, []goGerrit.ChangeInfo{{Number: 1}, {Number: 2}, {Number: 9}})
+	}))
+	c.head = "head"
+
+	c1 := &Changeset{Number: 1, ChangeID: "I1", CommitID: "c1", ParentCommitIDs: []string{"head"}}
+	c2 := &Changeset{Number: 2, ChangeID: "I2", CommitID: "c2", ParentCommitIDs: []string{"c1"}}
+	for i := 0; i < 2; i++ {
+		chain := &Chain{ChangeSets: []*Changeset{c1, c2}}
+		assert.NoError(t, c.checkSubmittedTogether(context.Background(), []*Chain{chain}))
+		assert.Equal(t, []int{9}, chain.ForeignSubmittedTogether)
+	}
+	assert.Equal(t, 1, requests, "unchanged chains should only be checked once")
+
+	// a new patchset is checked again
+	c2 = &Changeset{Number: 2, ChangeID: "I2", CommitID: "c2ps2", ParentCommitIDs: []string{"c1"}}
+	assert.NoError(t, c.checkSubmittedTogether(context.Background(), []*Chain{{ChangeSets: []*Changeset{c1, c2}}}))
+	assert.Equal(t, 2, requests)
+	assert.Len(t, c.submittedTogether, 1, "results of chains that are gone should be forgotten")
+}
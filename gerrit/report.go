@@ -0,0 +1,138 @@
+package gerrit
+
+import (
+	"fmt"
+
+	"github.com/apex/log"
+)
+
+// AssemblyReport collects the problems found while assembling changesets to chains
+type AssemblyReport struct {
+	// Orphans are changesets based neither on HEAD, nor on another changeset.
+	// They need to be rebased, or are based on a change that isn't open anymore.
+	Orphans []*Changeset
+	// BrokenLinks are changesets based on a patchset of a change that isn't open
+	BrokenLinks []*BrokenLink
+	// OutdatedParents are changesets based on an outdated patchset of another changeset
+	OutdatedParents []*OutdatedDependency
+	// Duplicates are changesets whose change or commit was seen before, they're left out
+	Duplicates []*Changeset
+	// Cycles lists the changesets of each dependency cycle that had to be broken up
+	Cycles [][]*Changeset
+	// ValidationErrors contains the integrity check failures of the assembled chains
+	ValidationErrors []*ValidationError
+	// TruncatedTopics are the topics with more changes than the query maximum.
+	// Their units might be missing changesets, so they fail the integrity check.
+	TruncatedTopics []string
+	// WaitingForParent are the first changesets of chains of a branch below a fork.
+	// That's not a problem, they're queued once the changeset they're based on was submitted.
+	WaitingForParent []*WaitingChangeset
+}
+
+// BrokenLink describes a changeset whose dependency couldn't be found among the open changesets
+type BrokenLink struct {
+	Changeset  *Changeset
+	Dependency *Dependency
+}
+
+func (l *BrokenLink) String() string {
+	return fmt.Sprintf("%d depends on patchset %d of %d, which isn't open",
+		l.Changeset.Number, l.Dependency.PatchSetNumber, l.Dependency.Number)
+}
+
+// ValidationError describes why a changeset breaks the integrity of its chain
+type ValidationError struct {
+	// Changeset is nil for problems of the chain as a whole
+	Changeset *Changeset
+	Reason    string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Changeset == nil {
+		return e.Reason
+	}
+	return fmt.Sprintf("changeset %d: %s", e.Changeset.Number, e.Reason)
+}
+
+// WaitingChangeset describes a changeset waiting for its parent changeset to be submitted,
+// as other changesets are based on the parent as well
+type WaitingChangeset struct {
+	Changeset *Changeset
+	Parent    *Changeset
+}
+
+func (w *WaitingChangeset) String() string {
+	return fmt.Sprintf("%d waits for change %d, which other changes are based on as well, to be submitted",
+		w.Changeset.Number, w.Parent.Number)
+}
+
+// IsEmpty returns true if no problems were found
+func (r *AssemblyReport) IsEmpty() bool {
+	return len(r.Orphans) == 0 && len(r.BrokenLinks) == 0 && len(r.OutdatedParents) == 0 &&
+		len(r.Duplicates) == 0 && len(r.Cycles) == 0 && len(r.ValidationErrors) == 0 && len(r.TruncatedTopics) == 0
+}
+
+// UnitIsValid returns false if any changeset of the unit failed the integrity check,
+// or not all changes of its topics could be fetched
+func (r *AssemblyReport) UnitIsValid(unit *Unit) bool {
+	for _, topic := range unit.Topics {
+		if r.TopicIsTruncated(topic) {
+			return false
+		}
+	}
+	if len(r.ValidationErrors) == 0 {
+		return true
+	}
+	invalid := make(map[*Changeset]bool, len(r.ValidationErrors))
+	for _, validationError := range r.ValidationErrors {
+		invalid[validationError.Changeset] = true
+	}
+	return unit.AllChangesets(func(c *Changeset) bool {
+		return !invalid[c]
+	})
+}
+
+// TopicIsTruncated returns true if the topic has more changes than could be fetched
+func (r *AssemblyReport) TopicIsTruncated(topic string) bool {
+	for _, t := range r.TruncatedTopics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// UnitIsWaiting returns true if a chain of the unit waits for the changeset it's based on to be submitted
+func (r *AssemblyReport) UnitIsWaiting(unit *Unit) bool {
+	if len(r.WaitingForParent) == 0 {
+		return false
+	}
+	waiting := make(map[*Changeset]bool, len(r.WaitingForParent))
+	for _, w := range r.WaitingForParent {
+		waiting[w.Changeset] = true
+	}
+	return !unit.AllChangesets(func(c *Changeset) bool {
+		return !waiting[c]
+	})
+}
+
+// log logs the problems found during assembly.
+// Orphans and validation errors are found later, so they're logged where they're found.
+func (r *AssemblyReport) log(logger *log.Logger) {
+	for _, changeset := range r.Duplicates {
+		logger.WithField("changeset", changeset.String()).Warn("changeset was seen before, leaving it out")
+	}
+	for _, brokenLink := range r.BrokenLinks {
+		logger.WithField("brokenLink", brokenLink.String()).Warn("changeset depends on a change that isn't open")
+	}
+	for _, outdatedDependency := range r.OutdatedParents {
+		logger.WithField("outdatedDependency", outdatedDependency.String()).Warn("changeset is based on an outdated patchset")
+	}
+	for _, cycle := range r.Cycles {
+		numbers := make([]int, len(cycle))
+		for i, changeset := range cycle {
+			numbers[i] = changeset.Number
+		}
+		logger.WithField("changes", numbers).Error("changesets form a dependency cycle, breaking it up")
+	}
+}
@@ -0,0 +1,68 @@
+package gerrit
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+)
+
+// RetryPolicy describes how often and how fast idempotent operations are retried
+// when they fail with a transient error.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one
+	MaxAttempts int
+	// InitialBackoff is the upper bound of the delay before the first retry,
+	// it's doubled for each further retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the upper bound of the delay between two attempts
+	MaxBackoff time.Duration
+}
+
+// DefaultRetryPolicy is used if nothing else is configured
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+}
+
+// backoff returns the delay before the given retry (starting at 0).
+// It uses "full jitter", picking a random delay up to the exponentially growing bound,
+// so multiple clients don't retry in lockstep.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	bound := p.InitialBackoff << uint(retry)
+	if bound > p.MaxBackoff || bound <= 0 {
+		bound = p.MaxBackoff
+	}
+	if bound <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(bound)))
+}
+
+// SetRetryPolicy configures how idempotent operations are retried
+func (c *Client) SetRetryPolicy(policy RetryPolicy) {
+	c.retryPolicy = policy
+}
+
+// retry runs an idempotent operation, retrying it on transient errors according to the retry policy.
+// It gives up early if the context is done. The returned error is classified.
+func (c *Client) retry(ctx context.Context, op string, f func() (*goGerrit.Response, error)) error {
+	var err error
+	for attempt := 0; ; attempt++ {
+		resp, rawErr := f()
+		err = classifyError(op, resp, rawErr)
+		if err == nil || !errors.Is(err, ErrTransient) || attempt+1 >= c.retryPolicy.MaxAttempts {
+			return err
+		}
+		delay := c.retryPolicy.backoff(attempt)
+		c.logger.WithError(err).WithField("attempt", attempt+1).Warnf("%s failed, retrying in %s", op, delay)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
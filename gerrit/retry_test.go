@@ -0,0 +1,64 @@
+package gerrit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetry(t *testing.T) {
+	attempts := 0
+	c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		// fail the first two attempts
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		writeJSON(w, goGerrit.BranchInfo{Revision: "deadbeef"})
+	}))
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+	head, err := c.refreshHEAD(context.Background())
+	assert.NoError(t, err, "transient errors should be retried")
+	assert.Equal(t, "deadbeef", head)
+	assert.Equal(t, 3, attempts)
+
+	// running out of attempts returns the transient error
+	attempts = 0
+	c.SetRetryPolicy(RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	_, err = c.refreshHEAD(context.Background())
+	assert.True(t, errors.Is(err, ErrTransient))
+	assert.Equal(t, 2, attempts)
+}
+
+func TestErrorClassification(t *testing.T) {
+	for _, tc := range []struct {
+		statusCode int
+		kind       error
+	}{
+		{http.StatusConflict, ErrConflict},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusBadGateway, ErrTransient},
+	} {
+		attempts := 0
+		c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(tc.statusCode)
+		}))
+		c.SetRetryPolicy(RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+
+		_, err := c.RebaseChangeset(context.Background(), &Changeset{ChangeID: "I0123"}, "deadbeef")
+		assert.True(t, errors.Is(err, tc.kind), "status %d should be classified as %s, got %v", tc.statusCode, tc.kind, err)
+		var gerritErr *Error
+		assert.True(t, errors.As(err, &gerritErr))
+		assert.Equal(t, tc.statusCode, gerritErr.StatusCode)
+		assert.Equal(t, 1, attempts, "rebases must not be retried")
+	}
+}
@@ -0,0 +1,159 @@
+package gerrit
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Strategy decides in which order chains are submitted
+type Strategy interface {
+	// Name returns the name the strategy is selected by
+	Name() string
+	// Sort returns the chains in the order they should be submitted, without modifying the passed slice.
+	// Chains the strategy doesn't distinguish keep their order.
+	Sort(chains []*Chain) []*Chain
+}
+
+// Names of the available strategies
+const (
+	StrategyLongestFirst  = "longest-first"
+	StrategyShortestFirst = "shortest-first"
+	StrategyFIFO          = "fifo"
+	StrategyOldestFirst   = "oldest-first"
+	StrategyRoundRobin    = "round-robin"
+)
+
+// DefaultStrategy is used if nothing else is configured
+var DefaultStrategy Strategy = LongestFirst{}
+
+// ParseStrategy returns the strategy with the given name
+func ParseStrategy(name string) (Strategy, error) {
+	switch name {
+	case StrategyLongestFirst:
+		return LongestFirst{}, nil
+	case StrategyShortestFirst:
+		return ShortestFirst{}, nil
+	case StrategyFIFO:
+		return FIFO{}, nil
+	case StrategyOldestFirst:
+		return OldestFirst{}, nil
+	case StrategyRoundRobin:
+		return RoundRobin{}, nil
+	default:
+		return nil, fmt.Errorf("unknown strategy: %s", name)
+	}
+}
+
+// SetStrategy configures in which order chains are submitted
+func (c *Client) SetStrategy(strategy Strategy) {
+	c.strategy = strategy
+}
+
+// GetStrategy returns the strategy deciding in which order chains are submitted
+func (c *Client) GetStrategy() Strategy {
+	return c.strategy
+}
+
+// sortChainsStable returns a sorted copy of chains, keeping the order of chains that are equal
+func sortChainsStable(chains []*Chain, less func(a, b *Chain) bool) []*Chain {
+	newChains := make([]*Chain, len(chains))
+	copy(newChains, chains)
+	sort.SliceStable(newChains, func(i, j int) bool {
+		return less(newChains[i], newChains[j])
+	})
+	return newChains
+}
+
+// timeLess orders times ascending, unknown (zero) times go last
+func timeLess(a, b time.Time) bool {
+	if a.IsZero() || b.IsZero() {
+		return !a.IsZero() && b.IsZero()
+	}
+	return a.Before(b)
+}
+
+// LongestFirst submits chains with more changesets first.
+// This ensures longer chains are merged faster, and less rebases are triggered.
+type LongestFirst struct{}
+
+// Name implements Strategy
+func (LongestFirst) Name() string { return StrategyLongestFirst }
+
+// Sort implements Strategy
+func (LongestFirst) Sort(chains []*Chain) []*Chain {
+	return SortChains(chains)
+}
+
+// ShortestFirst submits chains with less changesets first, so small changes don't wait for big ones.
+type ShortestFirst struct{}
+
+// Name implements Strategy
+func (ShortestFirst) Name() string { return StrategyShortestFirst }
+
+// Sort implements Strategy
+func (ShortestFirst) Sort(chains []*Chain) []*Chain {
+	return sortChainsStable(chains, func(a, b *Chain) bool {
+		return len(a.ChangeSets) < len(b.ChangeSets)
+	})
+}
+
+// FIFO submits chains in the order their owners opted in to automatic submission.
+// A chain is opted in once all of its changesets are, so its latest opt-in vote counts.
+type FIFO struct{}
+
+// Name implements Strategy
+func (FIFO) Name() string { return StrategyFIFO }
+
+// Sort implements Strategy
+func (FIFO) Sort(chains []*Chain) []*Chain {
+	return sortChainsStable(chains, func(a, b *Chain) bool {
+		return timeLess(a.AutosubmitDate(), b.AutosubmitDate())
+	})
+}
+
+// OldestFirst submits chains containing the oldest changes first
+type OldestFirst struct{}
+
+// Name implements Strategy
+func (OldestFirst) Name() string { return StrategyOldestFirst }
+
+// Sort implements Strategy
+func (OldestFirst) Sort(chains []*Chain) []*Chain {
+	return sortChainsStable(chains, func(a, b *Chain) bool {
+		return timeLess(a.Created(), b.Created())
+	})
+}
+
+// RoundRobin takes turns between the owners of chains, so a single owner with many chains
+// can't keep others waiting. The chains of each owner are submitted in FIFO order,
+// and owners take turns in the order of their first chain.
+//
+// With n owners, the k-th chain of an owner is at most at position k*n.
+type RoundRobin struct{}
+
+// Name implements Strategy
+func (RoundRobin) Name() string { return StrategyRoundRobin }
+
+// Sort implements Strategy
+func (RoundRobin) Sort(chains []*Chain) []*Chain {
+	ownerIDs := make([]int, 0)
+	chainsByOwner := make(map[int][]*Chain)
+	for _, chain := range (FIFO{}).Sort(chains) {
+		ownerID := chain.Owner().ID
+		if _, ok := chainsByOwner[ownerID]; !ok {
+			ownerIDs = append(ownerIDs, ownerID)
+		}
+		chainsByOwner[ownerID] = append(chainsByOwner[ownerID], chain)
+	}
+
+	newChains := make([]*Chain, 0, len(chains))
+	for round := 0; len(newChains) < len(chains); round++ {
+		for _, ownerID := range ownerIDs {
+			if ownerChains := chainsByOwner[ownerID]; round < len(ownerChains) {
+				newChains = append(newChains, ownerChains[round])
+			}
+		}
+	}
+	return newChains
+}
@@ -0,0 +1,111 @@
+package gerrit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// makeStrategyChain returns a chain of size changesets by the given owner,
+// created and opted in to autosubmit at the given minute
+func makeStrategyChain(number, size, ownerID, minute int) *Chain {
+	date := time.Date(2024, 1, 1, 0, minute, 0, 0, time.UTC)
+	chain := &Chain{}
+	for i := 0; i < size; i++ {
+		chain.ChangeSets = append(chain.ChangeSets, &Changeset{
+			Number:         number + i,
+			Owner:          Account{ID: ownerID},
+			Created:        date,
+			AutosubmitDate: date,
+		})
+	}
+	return chain
+}
+
+func TestParseStrategy(t *testing.T) {
+	for _, name := range []string{StrategyLongestFirst, StrategyShortestFirst, StrategyFIFO, StrategyOldestFirst, StrategyRoundRobin} {
+		strategy, err := ParseStrategy(name)
+		if assert.NoError(t, err) {
+			assert.Equal(t, name, strategy.Name())
+		}
+	}
+	_, err := ParseStrategy("random")
+	assert.Error(t, err)
+}
+
+func TestStrategies(t *testing.T) {
+	a := makeStrategyChain(10, 1, 1, 3)
+	b := makeStrategyChain(20, 3, 2, 1)
+	c := makeStrategyChain(30, 2, 3, 2)
+	unknown := &Chain{ChangeSets: []*Changeset{{Number: 40}}}
+	chains := []*Chain{a, b, c, unknown}
+
+	t.Run("longest-first", func(t *testing.T) {
+		assert.Equal(t, []*Chain{b, c, a, unknown}, LongestFirst{}.Sort(chains))
+	})
+	t.Run("shortest-first", func(t *testing.T) {
+		assert.Equal(t, []*Chain{a, unknown, c, b}, ShortestFirst{}.Sort(chains))
+	})
+	t.Run("fifo", func(t *testing.T) {
+		// chains without a known vote date go last
+		assert.Equal(t, []*Chain{b, c, a, unknown}, FIFO{}.Sort(chains))
+	})
+	t.Run("fifo uses the latest vote of a chain", func(t *testing.T) {
+		late := makeStrategyChain(50, 2, 1, 0)
+		late.ChangeSets[1].AutosubmitDate = time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
+		assert.Equal(t, []*Chain{a, late}, FIFO{}.Sort([]*Chain{late, a}))
+	})
+	t.Run("oldest-first", func(t *testing.T) {
+		older := makeStrategyChain(50, 2, 1, 5)
+		older.ChangeSets[1].Created = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+		assert.Equal(t, []*Chain{older, b, c, a, unknown}, OldestFirst{}.Sort(append(chains, older)))
+	})
+	t.Run("stable", func(t *testing.T) {
+		x := makeStrategyChain(50, 1, 1, 0)
+		y := makeStrategyChain(60, 1, 1, 0)
+		z := makeStrategyChain(70, 1, 1, 0)
+		for _, strategy := range []Strategy{LongestFirst{}, ShortestFirst{}, FIFO{}, OldestFirst{}, RoundRobin{}} {
+			assert.Equal(t, []*Chain{y, z, x}, strategy.Sort([]*Chain{y, z, x}), strategy.Name())
+		}
+	})
+	t.Run("doesn't modify the input", func(t *testing.T) {
+		for _, strategy := range []Strategy{LongestFirst{}, ShortestFirst{}, FIFO{}, OldestFirst{}, RoundRobin{}} {
+			strategy.Sort(chains)
+			assert.Equal(t, []*Chain{a, b, c, unknown}, chains, strategy.Name())
+		}
+	})
+}
+
+func TestRoundRobin(t *testing.T) {
+	// owner 1 opted in 20 chains before anyone else
+	chains := make([]*Chain, 0)
+	for i := 0; i < 20; i++ {
+		chains = append(chains, makeStrategyChain(100+i, 1, 1, i))
+	}
+	other := makeStrategyChain(200, 1, 2, 30)
+	third := makeStrategyChain(300, 1, 3, 31)
+	thirdLater := makeStrategyChain(301, 1, 3, 40)
+	chains = append(chains, thirdLater, other, third)
+
+	sorted := RoundRobin{}.Sort(chains)
+	if !assert.Len(t, sorted, len(chains)) {
+		return
+	}
+
+	// FIFO starves the other owners behind owner 1
+	assert.Equal(t, other, FIFO{}.Sort(chains)[20])
+	// round robin doesn't, with 3 owners, each owner's first chain is within the first 3
+	assert.Equal(t, []*Chain{chains[0], other, third}, sorted[:3])
+	// and their second one within the next 3
+	assert.Equal(t, []*Chain{chains[1], thirdLater}, sorted[3:5])
+	// once the others are done, the rest of owner 1 follows in FIFO order
+	assert.Equal(t, chains[2:20], sorted[5:])
+
+	// every chain is kept exactly once
+	seen := make(map[*Chain]bool)
+	for _, chain := range sorted {
+		assert.False(t, seen[chain])
+		seen[chain] = true
+	}
+}
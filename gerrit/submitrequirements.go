@@ -0,0 +1,156 @@
+package gerrit
+
+import (
+	"fmt"
+	"strings"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+)
+
+// Submit requirement status values, as reported by gerrit
+const (
+	SubmitRequirementSatisfied     = "SATISFIED"
+	SubmitRequirementUnsatisfied   = "UNSATISFIED"
+	SubmitRequirementOverridden    = "OVERRIDDEN"
+	SubmitRequirementNotApplicable = "NOT_APPLICABLE"
+	SubmitRequirementError         = "ERROR"
+	SubmitRequirementForced        = "FORCED"
+)
+
+// SubmitRequirement is the result of evaluating a single submit requirement on a changeset
+type SubmitRequirement struct {
+	Name   string
+	Status string
+	// FailedExpressions contains the parts of the requirement that aren't fulfilled,
+	// or an error message if it couldn't be evaluated.
+	FailedExpressions []string
+	// Legacy is set for requirements gerrit derived from submit rules or label functions.
+	Legacy bool
+}
+
+// IsSatisfied returns true if the requirement doesn't block submission
+func (r *SubmitRequirement) IsSatisfied() bool {
+	switch r.Status {
+	case SubmitRequirementSatisfied, SubmitRequirementOverridden, SubmitRequirementNotApplicable, SubmitRequirementForced:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *SubmitRequirement) String() string {
+	if len(r.FailedExpressions) == 0 {
+		return fmt.Sprintf("%s: %s", r.Name, r.Status)
+	}
+	return fmt.Sprintf("%s: %s (%s)", r.Name, r.Status, strings.Join(r.FailedExpressions, ", "))
+}
+
+// changeInfo extends goGerrit.ChangeInfo with the submit requirements and records,
+// which go-gerrit doesn't know about.
+type changeInfo struct {
+	goGerrit.ChangeInfo
+	SubmitRequirements []submitRequirementResultInfo `json:"submit_requirements,omitempty"`
+	SubmitRecords      []submitRecordInfo            `json:"submit_records,omitempty"`
+	// Mergeable shadows goGerrit.ChangeInfo.Mergeable, which can't tell false from missing
+	Mergeable *bool `json:"mergeable,omitempty"`
+}
+
+// submitRequirementResultInfo describes the result of evaluating a submit requirement on a change
+type submitRequirementResultInfo struct {
+	Name                           string                           `json:"name"`
+	Status                         string                           `json:"status"`
+	IsLegacy                       bool                             `json:"is_legacy"`
+	SubmittabilityExpressionResult *submitRequirementExpressionInfo `json:"submittability_expression_result,omitempty"`
+}
+
+// submitRequirementExpressionInfo describes the result of evaluating a single submit requirement expression
+type submitRequirementExpressionInfo struct {
+	Expression   string   `json:"expression"`
+	Fulfilled    bool     `json:"fulfilled"`
+	FailingAtoms []string `json:"failing_atoms,omitempty"`
+	ErrorMessage string   `json:"error_message,omitempty"`
+}
+
+// submitRecordInfo describes the result of a submit rule, as reported by older gerrit versions
+type submitRecordInfo struct {
+	RuleName string `json:"rule_name"`
+	Status   string `json:"status"`
+	Labels   []struct {
+		Label  string `json:"label"`
+		Status string `json:"status"`
+	} `json:"labels,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+}
+
+// makeChangeset creates a new Changeset object, including the submit requirements and mergeability
+func makeChangeset(info *changeInfo, labelPolicy LabelPolicy) *Changeset {
+	changeset := MakeChangesetWithLabelPolicy(&info.ChangeInfo, labelPolicy)
+	changeset.SubmitRequirements = parseSubmitRequirements(info)
+	changeset.Mergeable = info.Mergeable
+	return changeset
+}
+
+// parseSubmitRequirements returns the submit requirements of a change.
+// Gerrit 3.5 and newer report submit requirements, which include the legacy submit rules.
+// If there are none, they're derived from the submit records.
+func parseSubmitRequirements(info *changeInfo) []*SubmitRequirement {
+	requirements := make([]*SubmitRequirement, 0)
+
+	for _, result := range info.SubmitRequirements {
+		requirement := &SubmitRequirement{
+			Name:   result.Name,
+			Status: result.Status,
+			Legacy: result.IsLegacy,
+		}
+		if expression := result.SubmittabilityExpressionResult; expression != nil && !requirement.IsSatisfied() {
+			switch {
+			case expression.ErrorMessage != "":
+				requirement.FailedExpressions = []string{expression.ErrorMessage}
+			case len(expression.FailingAtoms) != 0:
+				requirement.FailedExpressions = expression.FailingAtoms
+			case expression.Expression != "":
+				requirement.FailedExpressions = []string{expression.Expression}
+			}
+		}
+		requirements = append(requirements, requirement)
+	}
+	if len(requirements) != 0 {
+		return requirements
+	}
+
+	for _, record := range info.SubmitRecords {
+		switch record.Status {
+		case "RULE_ERROR":
+			requirements = append(requirements, &SubmitRequirement{
+				Name:              record.RuleName,
+				Status:            SubmitRequirementError,
+				FailedExpressions: []string{record.ErrorMessage},
+				Legacy:            true,
+			})
+			continue
+		case "FORCED":
+			requirements = append(requirements, &SubmitRequirement{
+				Name:   record.RuleName,
+				Status: SubmitRequirementForced,
+				Legacy: true,
+			})
+			continue
+		}
+		for _, label := range record.Labels {
+			requirement := &SubmitRequirement{
+				Name:   label.Label,
+				Status: SubmitRequirementSatisfied,
+				Legacy: true,
+			}
+			switch label.Status {
+			case "OK", "MAY":
+			default:
+				// NEED, REJECT or IMPOSSIBLE
+				requirement.Status = SubmitRequirementUnsatisfied
+				requirement.FailedExpressions = []string{fmt.Sprintf("label:%s is %s", label.Label, label.Status)}
+			}
+			requirements = append(requirements, requirement)
+		}
+	}
+	return requirements
+}
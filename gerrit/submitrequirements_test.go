@@ -0,0 +1,88 @@
+package gerrit
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSubmitRequirements(t *testing.T) {
+	t.Run("submit requirements", func(t *testing.T) {
+		var info changeInfo
+		err := json.Unmarshal([]byte(`{
+			"_number": 1,
+			"submittable": false,
+			"submit_requirements": [{
+				"name": "Code-Review",
+				"status": "UNSATISFIED",
+				"submittability_expression_result": {
+					"expression": "label:Code-Review=MAX AND -label:Code-Review=MIN",
+					"fulfilled": false,
+					"failing_atoms": ["label:Code-Review=MAX"]
+				}
+			}, {
+				"name": "Verified",
+				"status": "SATISFIED",
+				"submittability_expression_result": {"expression": "label:Verified=MAX", "fulfilled": true}
+			}, {
+				"name": "No-Unresolved-Comments",
+				"status": "NOT_APPLICABLE",
+				"is_legacy": true
+			}],
+			"submit_records": [{"rule_name": "gerrit~DefaultSubmitRule", "status": "NOT_READY"}]
+		}`), &info)
+		assert.NoError(t, err)
+
+		changeset := makeChangeset(&info, DefaultLabelPolicy)
+		assert.Equal(t, 1, changeset.Number)
+		assert.Len(t, changeset.SubmitRequirements, 3)
+		assert.False(t, changeset.IsSubmittable())
+		if unsatisfied := changeset.UnsatisfiedSubmitRequirements(); assert.Len(t, unsatisfied, 1) {
+			assert.Equal(t, "Code-Review: UNSATISFIED (label:Code-Review=MAX)", unsatisfied[0].String())
+		}
+	})
+
+	t.Run("submit records", func(t *testing.T) {
+		var info changeInfo
+		err := json.Unmarshal([]byte(`{
+			"submittable": true,
+			"submit_records": [{
+				"rule_name": "gerrit~DefaultSubmitRule",
+				"status": "NOT_READY",
+				"labels": [{"label": "Code-Review", "status": "OK"}, {"label": "Verified", "status": "NEED"}]
+			}]
+		}`), &info)
+		assert.NoError(t, err)
+
+		changeset := makeChangeset(&info, DefaultLabelPolicy)
+		assert.False(t, changeset.IsSubmittable(), "submit requirements take precedence over the submittable field")
+		if unsatisfied := changeset.UnsatisfiedSubmitRequirements(); assert.Len(t, unsatisfied, 1) {
+			assert.Equal(t, "Verified", unsatisfied[0].Name)
+			assert.True(t, unsatisfied[0].Legacy)
+		}
+	})
+
+	t.Run("no submit requirements", func(t *testing.T) {
+		changeset := makeChangeset(&changeInfo{}, DefaultLabelPolicy)
+		assert.Empty(t, changeset.SubmitRequirements)
+		assert.False(t, changeset.IsSubmittable())
+		changeset.Submittable = true
+		assert.True(t, changeset.IsSubmittable(), "without submit requirements, the submittable field is used")
+	})
+
+	t.Run("satisfied submit requirements", func(t *testing.T) {
+		var info changeInfo
+		err := json.Unmarshal([]byte(`{
+			"submittable": false,
+			"submit_requirements": [{"name": "Verified", "status": "SATISFIED"}]
+		}`), &info)
+		assert.NoError(t, err)
+
+		changeset := makeChangeset(&info, DefaultLabelPolicy)
+		assert.Empty(t, changeset.UnsatisfiedSubmitRequirements())
+		assert.False(t, changeset.IsSubmittable(), "gerrit refusing to submit it takes precedence")
+		changeset.Submittable = true
+		assert.True(t, changeset.IsSubmittable())
+	})
+}
@@ -0,0 +1,245 @@
+package gerrit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// Unit is a group of chains that need to be submitted together.
+//
+// Chains without a topic form a unit on their own. Chains sharing a topic are grouped
+// together, as gerrit submits the whole topic at once (with change.submitWholeTopic enabled).
+// Topics can span multiple projects and branches, changesets of the topic
+// outside of our project and branch are kept in ForeignChangesets.
+type Unit struct {
+	// Topics is empty for units consisting of a single chain without topic.
+	// It usually contains one topic, unless a chain mixes multiple topics.
+	Topics            []string
+	Chains            []*Chain
+	ForeignChangesets []*Changeset
+}
+
+// IsTopic returns true if the unit groups chains by topic
+func (u *Unit) IsTopic() bool {
+	return len(u.Topics) != 0
+}
+
+// Changesets returns all changesets of the unit, the ones in the chains first,
+// followed by the foreign ones.
+func (u *Unit) Changesets() []*Changeset {
+	changesets := make([]*Changeset, 0)
+	for _, chain := range u.Chains {
+		changesets = append(changesets, chain.ChangeSets...)
+	}
+	return append(changesets, u.ForeignChangesets...)
+}
+
+// AllChains applies a filter function on all of the chains in the unit.
+// returns true if it returns true for all chains, false otherwise
+func (u *Unit) AllChains(f func(c *Chain) bool) bool {
+	for _, chain := range u.Chains {
+		if !f(chain) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllChangesets applies a filter function on all of the changesets in the unit, including the foreign ones.
+// returns true if it returns true for all changesets, false otherwise
+func (u *Unit) AllChangesets(f func(c *Changeset) bool) bool {
+	for _, changeset := range u.Changesets() {
+		if !f(changeset) {
+			return false
+		}
+	}
+	return true
+}
+
+// ForeignSubmittedTogether returns the numbers of changes gerrit would submit
+// together with the unit, but which aren't part of it.
+func (u *Unit) ForeignSubmittedTogether() []int {
+	inUnit := make(map[int]bool)
+	for _, changeset := range u.Changesets() {
+		inUnit[changeset.Number] = true
+	}
+	numbers := make([]int, 0)
+	for _, chain := range u.Chains {
+		for _, number := range chain.ForeignSubmittedTogether {
+			if !inUnit[number] {
+				inUnit[number] = true
+				numbers = append(numbers, number)
+			}
+		}
+	}
+	return numbers
+}
+
+// HasSameChanges returns true if both units consist of the same changes
+func (u *Unit) HasSameChanges(other *Unit) bool {
+	changeIDs := make(map[string]bool)
+	for _, changeset := range u.Changesets() {
+		changeIDs[changeset.ChangeID] = true
+	}
+	otherChangesets := other.Changesets()
+	if len(changeIDs) != len(otherChangesets) {
+		return false
+	}
+	for _, changeset := range otherChangesets {
+		if !changeIDs[changeset.ChangeID] {
+			return false
+		}
+	}
+	return true
+}
+
+// Prefix returns a unit of the first n changesets of the unit's chain.
+// Topics are submitted as a whole, so they don't have a prefix, and nil is returned.
+func (u *Unit) Prefix(n int) *Unit {
+	if u.IsTopic() || len(u.Chains) != 1 || n <= 0 || n > len(u.Chains[0].ChangeSets) {
+		return nil
+	}
+	return &Unit{Chains: []*Chain{u.Chains[0].Prefix(n)}}
+}
+
+// ReadyPrefix returns a unit of the longest prefix of the unit's chain whose changesets are all ready.
+// It returns nil if there's no such prefix, the whole chain is ready, or the unit is a topic.
+func (u *Unit) ReadyPrefix(ready func(c *Changeset) bool) *Unit {
+	if u.IsTopic() || len(u.Chains) != 1 {
+		return nil
+	}
+	changesets := u.Chains[0].ChangeSets
+	n := 0
+	for n < len(changesets) && ready(changesets[n]) {
+		n++
+	}
+	if n == len(changesets) {
+		return nil
+	}
+	return u.Prefix(n)
+}
+
+func (u *Unit) String() string {
+	var sb strings.Builder
+	sb.WriteString("Unit")
+	if u.IsTopic() {
+		sb.WriteString(fmt.Sprintf("(topic: %s)", strings.Join(u.Topics, ", ")))
+	}
+	sb.WriteString("[")
+	for i, chain := range u.Chains {
+		if i != 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(chain.String())
+	}
+	sb.WriteString("]")
+	if len(u.ForeignChangesets) != 0 {
+		sb.WriteString(fmt.Sprintf("(+%d foreign)", len(u.ForeignChangesets)))
+	}
+	return sb.String()
+}
+
+// AssembleUnits groups chains together to units.
+// Chains sharing a topic end up in the same unit, if a chain has multiple topics,
+// their units are merged. The order of units follows the order of their first chain.
+func AssembleUnits(chains []*Chain, logger *log.Logger) []*Unit {
+	units := make([]*Unit, 0)
+	unitByTopic := make(map[string]*Unit)
+
+	for _, chain := range chains {
+		topics := chain.Topics()
+		if len(topics) == 0 {
+			units = append(units, &Unit{Chains: []*Chain{chain}})
+			continue
+		}
+
+		// find the unit to add the chain to, merging units of other topics of the chain into it
+		var unit *Unit
+		for _, topic := range topics {
+			other, ok := unitByTopic[topic]
+			switch {
+			case !ok:
+				continue
+			case unit == nil:
+				unit = other
+			case other != unit:
+				logger.WithFields(log.Fields{
+					"chain":  chain.String(),
+					"topics": topics,
+				}).Warn("chain spans multiple topics, merging them")
+				unit.Topics = append(unit.Topics, other.Topics...)
+				unit.Chains = append(unit.Chains, other.Chains...)
+				for _, otherTopic := range other.Topics {
+					unitByTopic[otherTopic] = unit
+				}
+				other.Chains = nil
+			}
+		}
+		if unit == nil {
+			unit = &Unit{}
+			units = append(units, unit)
+		}
+		for _, topic := range topics {
+			if _, ok := unitByTopic[topic]; !ok {
+				unit.Topics = append(unit.Topics, topic)
+				unitByTopic[topic] = unit
+			}
+		}
+		unit.Chains = append(unit.Chains, chain)
+	}
+
+	// remove units emptied by merging
+	newUnits := make([]*Unit, 0, len(units))
+	for _, unit := range units {
+		if len(unit.Chains) != 0 {
+			newUnits = append(newUnits, unit)
+		}
+	}
+	return newUnits
+}
+
+// fetchForeignChangesets fetches the open changesets of a topic outside of our project and branch.
+// If the topic has more changes than the query maximum, the result is marked as truncated.
+func (c *Client) fetchForeignChangesets(ctx context.Context, topic string) ([]*Changeset, bool, error) {
+	changes, truncated, err := c.queryChanges(ctx, "query topic", fmt.Sprintf("status:open topic:%q", topic))
+	if err != nil {
+		return nil, false, err
+	}
+	if truncated {
+		c.logger.WithFields(log.Fields{
+			"topic":      topic,
+			"maxChanges": c.queryMaxChanges,
+		}).Warn("topic has more changes than the query maximum, not picking it")
+	}
+
+	changesets := make([]*Changeset, 0)
+	for _, change := range changes {
+		changeset := makeChangeset(change, c.labelPolicy)
+		if changeset.Project != c.projectName || changeset.Branch != c.branchName {
+			changesets = append(changesets, changeset)
+		}
+	}
+	return changesets, truncated, nil
+}
+
+// assembleUnits groups chains to units, and fetches the foreign changesets of topics.
+// Topics with more changes than the query maximum are recorded in the report, see AssemblyReport.TruncatedTopics.
+func (c *Client) assembleUnits(ctx context.Context, chains []*Chain, report *AssemblyReport) ([]*Unit, error) {
+	units := AssembleUnits(chains, c.logger)
+	for _, unit := range units {
+		for _, topic := range unit.Topics {
+			foreignChangesets, truncated, err := c.fetchForeignChangesets(ctx, topic)
+			if err != nil {
+				return nil, err
+			}
+			if truncated && !report.TopicIsTruncated(topic) {
+				report.TruncatedTopics = append(report.TruncatedTopics, topic)
+			}
+			unit.ForeignChangesets = append(unit.ForeignChangesets, foreignChangesets...)
+		}
+	}
+	return units, nil
+}
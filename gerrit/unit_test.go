@@ -0,0 +1,84 @@
+package gerrit
+
+import (
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssembleUnits(t *testing.T) {
+	logger := &log.Logger{Handler: discard.New()}
+	makeChain := func(topics ...string) *Chain {
+		chain := &Chain{}
+		for i, topic := range topics {
+			chain.ChangeSets = append(chain.ChangeSets, &Changeset{Number: i + 1, Topic: topic})
+		}
+		return chain
+	}
+
+	withoutTopic := makeChain("")
+	fooA := makeChain("foo")
+	bar := makeChain("bar")
+	fooB := makeChain("", "foo")
+	// links the bar and baz topics together
+	barBaz := makeChain("baz", "bar")
+
+	units := AssembleUnits([]*Chain{withoutTopic, fooA, bar, fooB, barBaz}, logger)
+	if assert.Len(t, units, 3) {
+		assert.False(t, units[0].IsTopic())
+		assert.Equal(t, []*Chain{withoutTopic}, units[0].Chains)
+
+		assert.Equal(t, []string{"foo"}, units[1].Topics)
+		assert.Equal(t, []*Chain{fooA, fooB}, units[1].Chains)
+
+		assert.Equal(t, []string{"bar", "baz"}, units[2].Topics)
+		assert.Equal(t, []*Chain{bar, barBaz}, units[2].Chains)
+	}
+}
+
+func TestUnitHasSameChanges(t *testing.T) {
+	a := &Unit{
+		Chains:            []*Chain{{ChangeSets: []*Changeset{{ChangeID: "I1"}, {ChangeID: "I2"}}}},
+		ForeignChangesets: []*Changeset{{ChangeID: "I3"}},
+	}
+	// a refreshed unit with the chains in a different order
+	b := &Unit{
+		Chains:            []*Chain{{ChangeSets: []*Changeset{{ChangeID: "I2"}}}, {ChangeSets: []*Changeset{{ChangeID: "I1"}}}},
+		ForeignChangesets: []*Changeset{{ChangeID: "I3"}},
+	}
+	assert.True(t, a.HasSameChanges(b))
+
+	b.ForeignChangesets = nil
+	assert.False(t, a.HasSameChanges(b), "a unit missing changes is not the same")
+}
+
+func TestUnitReadyPrefix(t *testing.T) {
+	c1 := &Changeset{Number: 1, CommitID: "c1", ParentCommitIDs: []string{"head"}, Autosubmit: 1}
+	c2 := &Changeset{Number: 2, CommitID: "c2", ParentCommitIDs: []string{"old"}, Autosubmit: 1}
+	c3 := &Changeset{Number: 3, CommitID: "c3", ParentCommitIDs: []string{"c2"}}
+	chain := &Chain{
+		ChangeSets:           []*Changeset{c1, c2, c3},
+		OutdatedDependencies: []*OutdatedDependency{{Changeset: c2, Dependency: c1, PatchSetNumber: 1}},
+	}
+	unit := &Unit{Chains: []*Chain{chain}}
+	ready := func(c *Changeset) bool { return c.Autosubmit == 1 }
+
+	prefix := unit.ReadyPrefix(ready)
+	if assert.NotNil(t, prefix) {
+		assert.Equal(t, []*Changeset{c1, c2}, prefix.Chains[0].ChangeSets)
+		assert.Equal(t, chain.OutdatedDependencies, prefix.Chains[0].OutdatedDependencies)
+		assert.Len(t, chain.ChangeSets, 3, "the unit is left alone")
+	}
+
+	c3.Autosubmit = 1
+	assert.Nil(t, unit.ReadyPrefix(ready), "the whole unit is ready")
+	c1.Autosubmit = 0
+	assert.Nil(t, unit.ReadyPrefix(ready), "nothing is ready")
+
+	c1.Autosubmit = 1
+	c3.Autosubmit = 0
+	unit.Topics = []string{"foo"}
+	assert.Nil(t, unit.ReadyPrefix(ready), "topics are submitted as a whole")
+}
@@ -1,14 +1,22 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"net/http"
 
+	"github.com/flokli/gerrit-queue/events"
 	"github.com/flokli/gerrit-queue/frontend"
 	"github.com/flokli/gerrit-queue/gerrit"
 	"github.com/flokli/gerrit-queue/misc"
+	"github.com/flokli/gerrit-queue/store"
 	"github.com/flokli/gerrit-queue/submitqueue"
 
 	"github.com/urfave/cli"
@@ -20,8 +28,16 @@ import (
 
 func main() {
 	var URL, username, password, projectName, branchName string
-	var fetchOnly bool
-	var triggerInterval int
+	var authMethod, passwordFile, token, tokenFile, gitCookiesFile, netrcFile string
+	var chainModeName, mergeStrategyName, strategyName string
+	var ciLabel, reviewLabel, optInLabel, voteSemanticsName string
+	var priorityHashtag, emergencyHashtag, priorityLabel string
+	var eventsSource, sshAddress, sshUsername, sshIdentityFile, webhookSecret string
+	var stateStoreKind, statePath string
+	var ciTimeoutActionName, recheckMessage string
+	var fetchOnly, submitRequirements, emergencyPreemption, submitReadyPrefix, keepOptIn bool
+	var queueSpecs, queueStrategySpecs cli.StringSlice
+	var triggerInterval, eventsLogPollInterval, eventDebounceDelay, queryPageSize, queryMaxChanges, gerritTimeout, batchSize, ciTimeout int
 
 	app := cli.NewApp()
 	app.Name = "gerrit-queue"
@@ -35,34 +51,234 @@ func main() {
 			Destination: &URL,
 			Required:    true,
 		},
+		cli.StringFlag{
+			Name:        "auth",
+			Usage:       "How to authenticate against gerrit (none, basic, digest, gitcookies, bearer, netrc)",
+			EnvVar:      "GERRIT_AUTH",
+			Destination: &authMethod,
+			Value:       "basic",
+		},
 		cli.StringFlag{
 			Name:        "username",
-			Usage:       "Username to use to login to gerrit",
+			Usage:       "Username to use to login to gerrit (basic and digest auth)",
 			EnvVar:      "GERRIT_USERNAME",
 			Destination: &username,
-			Required:    true,
 		},
 		cli.StringFlag{
 			Name:        "password",
-			Usage:       "Password to use to login to gerrit",
+			Usage:       "Password to use to login to gerrit (basic and digest auth)",
 			EnvVar:      "GERRIT_PASSWORD",
 			Destination: &password,
-			Required:    true,
+		},
+		cli.StringFlag{
+			Name:        "password-file",
+			Usage:       "File to read the password from, instead of passing it directly",
+			EnvVar:      "GERRIT_PASSWORD_FILE",
+			Destination: &passwordFile,
+		},
+		cli.StringFlag{
+			Name:        "token",
+			Usage:       "Token to use to login to gerrit (bearer auth)",
+			EnvVar:      "GERRIT_TOKEN",
+			Destination: &token,
+		},
+		cli.StringFlag{
+			Name:        "token-file",
+			Usage:       "File to read the token from, instead of passing it directly",
+			EnvVar:      "GERRIT_TOKEN_FILE",
+			Destination: &tokenFile,
+		},
+		cli.StringFlag{
+			Name:        "gitcookies-file",
+			Usage:       "Cookie file to use to login to gerrit (gitcookies auth, defaults to ~/.gitcookies)",
+			EnvVar:      "GERRIT_GITCOOKIES_FILE",
+			Destination: &gitCookiesFile,
+		},
+		cli.StringFlag{
+			Name:        "netrc-file",
+			Usage:       "netrc file to read credentials from (netrc auth, defaults to ~/.netrc)",
+			EnvVar:      "GERRIT_NETRC_FILE",
+			Destination: &netrcFile,
 		},
 		cli.StringFlag{
 			Name:        "project",
 			Usage:       "Gerrit project name to run the submit queue for",
 			EnvVar:      "GERRIT_PROJECT",
 			Destination: &projectName,
-			Required:    true,
 		},
 		cli.StringFlag{
 			Name:        "branch",
-			Usage:       "Destination branch",
+			Usage:       "Destination branch (also the default for --queue)",
 			EnvVar:      "GERRIT_BRANCH",
 			Destination: &branchName,
 			Value:       "master",
 		},
+		cli.StringSliceFlag{
+			Name:   "queue",
+			Usage:  "Additional project[:branch] to run a submit queue for, can be passed multiple times",
+			EnvVar: "SUBMIT_QUEUE_QUEUES",
+			Value:  &queueSpecs,
+		},
+		cli.IntFlag{
+			Name:        "gerrit-timeout",
+			Usage:       "Deadline for a single request to gerrit (in seconds)",
+			EnvVar:      "GERRIT_TIMEOUT",
+			Destination: &gerritTimeout,
+			Value:       int(gerrit.DefaultCallTimeout / time.Second),
+		},
+		cli.IntFlag{
+			Name:        "query-page-size",
+			Usage:       "How many changesets to request from gerrit at once",
+			EnvVar:      "SUBMIT_QUEUE_QUERY_PAGE_SIZE",
+			Destination: &queryPageSize,
+			Value:       gerrit.DefaultQueryPageSize,
+		},
+		cli.IntFlag{
+			Name:        "query-max-changes",
+			Usage:       "Maximum number of open changesets to fetch, further ones are ignored",
+			EnvVar:      "SUBMIT_QUEUE_QUERY_MAX_CHANGES",
+			Destination: &queryMaxChanges,
+			Value:       gerrit.DefaultQueryMaxChanges,
+		},
+		cli.StringFlag{
+			Name:        "ci-label",
+			Usage:       "Label set by CI, and the values passing it (name:min[:[max][:fail]])",
+			EnvVar:      "SUBMIT_QUEUE_CI_LABEL",
+			Destination: &ciLabel,
+			Value:       gerrit.DefaultLabelPolicy.CI.String(),
+		},
+		cli.StringFlag{
+			Name:        "review-label",
+			Usage:       "Label used for code review, and the values passing it (name:min[:[max][:fail]])",
+			EnvVar:      "SUBMIT_QUEUE_REVIEW_LABEL",
+			Destination: &reviewLabel,
+			Value:       gerrit.DefaultLabelPolicy.Review.String(),
+		},
+		cli.StringFlag{
+			Name:        "opt-in-label",
+			Usage:       "Label used to opt in to automatic submission, and the values doing so (name:min[:[max][:fail]])",
+			EnvVar:      "SUBMIT_QUEUE_OPT_IN_LABEL",
+			Destination: &optInLabel,
+			Value:       gerrit.DefaultLabelPolicy.OptIn.String(),
+		},
+		cli.StringFlag{
+			Name:        "vote-semantics",
+			Usage:       "How multiple votes on a label are combined (max, min, max-with-block)",
+			EnvVar:      "SUBMIT_QUEUE_VOTE_SEMANTICS",
+			Destination: &voteSemanticsName,
+			Value:       string(gerrit.DefaultLabelPolicy.Semantics),
+		},
+		cli.BoolFlag{
+			Name:        "submit-requirements",
+			Usage:       "Use gerrit's submit requirements to decide whether changesets are submittable (needs gerrit 3.5 or newer)",
+			EnvVar:      "SUBMIT_QUEUE_SUBMIT_REQUIREMENTS",
+			Destination: &submitRequirements,
+		},
+		cli.StringFlag{
+			Name:        "chain-mode",
+			Usage:       "How to group changesets to chains (parents, related)",
+			EnvVar:      "SUBMIT_QUEUE_CHAIN_MODE",
+			Destination: &chainModeName,
+			Value:       string(gerrit.ChainModeParents),
+		},
+		cli.StringFlag{
+			Name:        "merge-strategy",
+			Usage:       "How to bring chains containing merge commits up to date with HEAD (require-head, remerge)",
+			EnvVar:      "SUBMIT_QUEUE_MERGE_STRATEGY",
+			Destination: &mergeStrategyName,
+			Value:       string(gerrit.MergeStrategyRequireHEAD),
+		},
+		cli.StringFlag{
+			Name:        "strategy",
+			Usage:       "In which order chains are submitted (longest-first, shortest-first, fifo, oldest-first, round-robin)",
+			EnvVar:      "SUBMIT_QUEUE_STRATEGY",
+			Destination: &strategyName,
+			Value:       gerrit.DefaultStrategy.Name(),
+		},
+		cli.StringSliceFlag{
+			Name:   "queue-strategy",
+			Usage:  "project[:branch]=strategy to override --strategy for a single queue, can be passed multiple times",
+			EnvVar: "SUBMIT_QUEUE_QUEUE_STRATEGIES",
+			Value:  &queueStrategySpecs,
+		},
+		cli.StringFlag{
+			Name:        "priority-hashtag",
+			Usage:       "Hashtag giving a changeset high priority, it's picked before others (disabled if empty)",
+			EnvVar:      "SUBMIT_QUEUE_PRIORITY_HASHTAG",
+			Destination: &priorityHashtag,
+			Value:       gerrit.DefaultPriorityPolicy.Hashtag,
+		},
+		cli.StringFlag{
+			Name:        "emergency-hashtag",
+			Usage:       "Hashtag giving a changeset emergency priority, it's picked first (disabled if empty)",
+			EnvVar:      "SUBMIT_QUEUE_EMERGENCY_HASHTAG",
+			Destination: &emergencyHashtag,
+			Value:       gerrit.DefaultPriorityPolicy.EmergencyHashtag,
+		},
+		cli.StringFlag{
+			Name:        "priority-label",
+			Usage:       "Label giving a changeset high priority when voted +1, and emergency priority when voted +2 (disabled if empty)",
+			EnvVar:      "SUBMIT_QUEUE_PRIORITY_LABEL",
+			Destination: &priorityLabel,
+		},
+		cli.BoolFlag{
+			Name:        "keep-opt-in-on-ci-failure",
+			Usage:       "Only comment on units failing CI, instead of also resetting their opt-in label",
+			EnvVar:      "SUBMIT_QUEUE_KEEP_OPT_IN_ON_CI_FAILURE",
+			Destination: &keepOptIn,
+		},
+		cli.BoolFlag{
+			Name:        "emergency-preemption",
+			Usage:       "Let changesets with emergency priority preempt the unit waiting for CI, which is put back in the queue",
+			EnvVar:      "SUBMIT_QUEUE_EMERGENCY_PREEMPTION",
+			Destination: &emergencyPreemption,
+		},
+		cli.BoolFlag{
+			Name:        "submit-ready-prefix",
+			Usage:       "Submit the ready changesets at the beginning of a chain, even if the rest of it isn't ready yet",
+			EnvVar:      "SUBMIT_QUEUE_SUBMIT_READY_PREFIX",
+			Destination: &submitReadyPrefix,
+		},
+		cli.StringFlag{
+			Name:        "state-path",
+			Usage:       "Persist the state of the queues in this file, and restore it on startup. Empty disables persistence",
+			EnvVar:      "SUBMIT_QUEUE_STATE_PATH",
+			Destination: &statePath,
+		},
+		cli.StringFlag{
+			Name:        "state-store",
+			Value:       "file",
+			Usage:       "How the state is persisted: file (a single JSON file) or kv (an append-only key-value log)",
+			EnvVar:      "SUBMIT_QUEUE_STATE_STORE",
+			Destination: &stateStoreKind,
+		},
+		cli.IntFlag{
+			Name:        "ci-timeout",
+			Usage:       "How long to wait for CI feedback on a rebased unit (in seconds), before applying the ci-timeout-action. 0 waits forever",
+			EnvVar:      "SUBMIT_QUEUE_CI_TIMEOUT",
+			Destination: &ciTimeout,
+		},
+		cli.StringFlag{
+			Name:        "ci-timeout-action",
+			Value:       "recheck",
+			Usage:       "What to do when CI times out: recheck (ask CI to run again once, then discard), discard, or requeue (discard, and move to the back of the queue)",
+			EnvVar:      "SUBMIT_QUEUE_CI_TIMEOUT_ACTION",
+			Destination: &ciTimeoutActionName,
+		},
+		cli.StringFlag{
+			Name:        "recheck-message",
+			Value:       submitqueue.DefaultRecheckMessage,
+			Usage:       "The comment asking CI to run again",
+			EnvVar:      "SUBMIT_QUEUE_RECHECK_MESSAGE",
+			Destination: &recheckMessage,
+		},
+		cli.IntFlag{
+			Name:        "batch-size",
+			Usage:       "Stack up to this many units on top of each other, and wait for CI on all of them at once. The size shrinks when units fail CI. 1 disables batching",
+			EnvVar:      "SUBMIT_QUEUE_BATCH_SIZE",
+			Value:       1,
+			Destination: &batchSize,
+		},
 		cli.IntFlag{
 			Name:        "trigger-interval",
 			Usage:       "How often we should trigger ourselves (interval in seconds)",
@@ -70,6 +286,51 @@ func main() {
 			Destination: &triggerInterval,
 			Value:       600,
 		},
+		cli.StringFlag{
+			Name:        "events-source",
+			Usage:       "Where to receive gerrit events from, to trigger ourselves immediately (none, ssh, events-log)",
+			EnvVar:      "SUBMIT_QUEUE_EVENTS_SOURCE",
+			Destination: &eventsSource,
+			Value:       "none",
+		},
+		cli.StringFlag{
+			Name:        "ssh-address",
+			Usage:       "host:port of the gerrit SSH daemon, used for stream-events",
+			EnvVar:      "GERRIT_SSH_ADDRESS",
+			Destination: &sshAddress,
+		},
+		cli.StringFlag{
+			Name:        "ssh-username",
+			Usage:       "Username to use to login to the gerrit SSH daemon (defaults to --username)",
+			EnvVar:      "GERRIT_SSH_USERNAME",
+			Destination: &sshUsername,
+		},
+		cli.StringFlag{
+			Name:        "ssh-identity-file",
+			Usage:       "Private key to use to login to the gerrit SSH daemon",
+			EnvVar:      "GERRIT_SSH_IDENTITY_FILE",
+			Destination: &sshIdentityFile,
+		},
+		cli.IntFlag{
+			Name:        "events-log-poll-interval",
+			Usage:       "How often to poll the events-log plugin (interval in seconds)",
+			EnvVar:      "SUBMIT_QUEUE_EVENTS_LOG_POLL_INTERVAL",
+			Destination: &eventsLogPollInterval,
+			Value:       30,
+		},
+		cli.IntFlag{
+			Name:        "event-debounce-delay",
+			Usage:       "How long to wait for more events before triggering ourselves (in seconds)",
+			EnvVar:      "SUBMIT_QUEUE_EVENT_DEBOUNCE_DELAY",
+			Destination: &eventDebounceDelay,
+			Value:       5,
+		},
+		cli.StringFlag{
+			Name:        "webhook-secret",
+			Usage:       "Shared secret to accept events from the gerrit webhooks plugin at /webhooks/gerrit (disabled if empty)",
+			EnvVar:      "SUBMIT_QUEUE_WEBHOOK_SECRET",
+			Destination: &webhookSecret,
+		},
 		cli.BoolFlag{
 			Name:        "fetch-only",
 			Usage:       "Only fetch changes and assemble queue, but don't actually write",
@@ -88,43 +349,210 @@ func main() {
 	}
 
 	app.Action = func(c *cli.Context) error {
-		gerrit, err := gerrit.NewClient(l, URL, username, password, projectName, branchName)
+		authConfig := &gerrit.AuthConfig{
+			Method:         authMethod,
+			Username:       username,
+			Password:       password,
+			PasswordFile:   passwordFile,
+			Token:          token,
+			TokenFile:      tokenFile,
+			GitCookiesFile: gitCookiesFile,
+			NetrcFile:      netrcFile,
+		}
+		authenticator, err := authConfig.NewAuthenticator(URL)
 		if err != nil {
 			return err
 		}
-		log.Infof("Successfully connected to gerrit at %s", URL)
 
-		runner := submitqueue.NewRunner(l, gerrit)
+		chainMode, err := gerrit.ParseChainMode(chainModeName)
+		if err != nil {
+			return err
+		}
+		mergeStrategy, err := gerrit.ParseMergeStrategy(mergeStrategyName)
+		if err != nil {
+			return err
+		}
 
-		handler := frontend.MakeFrontend(rotatingLogHandler, gerrit, runner)
+		labelPolicy := gerrit.LabelPolicy{}
+		if labelPolicy.CI, err = gerrit.ParseLabelRule(ciLabel); err != nil {
+			return err
+		}
+		if labelPolicy.Review, err = gerrit.ParseLabelRule(reviewLabel); err != nil {
+			return err
+		}
+		if labelPolicy.OptIn, err = gerrit.ParseLabelRule(optInLabel); err != nil {
+			return err
+		}
+		if labelPolicy.Semantics, err = gerrit.ParseVoteSemantics(voteSemanticsName); err != nil {
+			return err
+		}
 
-		// fetch only on first run
-		err = runner.Trigger(fetchOnly)
+		targets, err := parseQueueTargets(projectName, branchName, queueSpecs)
+		if err != nil {
+			return err
+		}
+		strategy, err := gerrit.ParseStrategy(strategyName)
+		if err != nil {
+			return err
+		}
+		queueStrategies, err := parseQueueStrategies(targets, branchName, queueStrategySpecs)
 		if err != nil {
-			log.Error(err.Error())
+			return err
 		}
 
-		// ticker
-		go func() {
-			for {
-				time.Sleep(time.Duration(triggerInterval) * time.Second)
-				err = runner.Trigger(fetchOnly)
-				if err != nil {
-					log.Error(err.Error())
+		ciTimeoutAction, err := submitqueue.ParseTimeoutAction(ciTimeoutActionName)
+		if err != nil {
+			return err
+		}
+
+		var stateStore store.Store
+		if statePath != "" {
+			stateStore, err = store.Open(stateStoreKind, statePath)
+			if err != nil {
+				return err
+			}
+			defer stateStore.Close()
+		}
+
+		// cancelled on SIGINT/SIGTERM, aborting in-flight work
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		// each queue gets its own client and runner, sharing the authenticator
+		var queues []*frontend.Queue
+		var wg sync.WaitGroup
+		for _, target := range targets {
+			queueRotatingLogHandler := misc.NewRotatingLogHandler(10000)
+			ql := &log.Logger{
+				Handler: multi.New(
+					misc.NewFieldsHandler(l.Handler, log.Fields{
+						"project": target.projectName,
+						"branch":  target.branchName,
+					}),
+					queueRotatingLogHandler,
+				),
+				Level: log.DebugLevel,
+			}
+
+			gerritClient, err := gerrit.NewClient(ql, URL, authenticator, target.projectName, target.branchName)
+			if err != nil {
+				return err
+			}
+			if err := gerritClient.SetQueryLimits(queryPageSize, queryMaxChanges); err != nil {
+				return err
+			}
+			gerritClient.SetCallTimeout(time.Duration(gerritTimeout) * time.Second)
+			gerritClient.SetChainMode(chainMode)
+			gerritClient.SetMergeStrategy(mergeStrategy)
+			if queueStrategy, ok := queueStrategies[target]; ok {
+				gerritClient.SetStrategy(queueStrategy)
+			} else {
+				gerritClient.SetStrategy(strategy)
+			}
+			gerritClient.SetSubmitRequirements(submitRequirements)
+			gerritClient.SetLabelPolicy(labelPolicy)
+			gerritClient.SetPriorityPolicy(gerrit.PriorityPolicy{
+				Hashtag:          priorityHashtag,
+				EmergencyHashtag: emergencyHashtag,
+				Label:            priorityLabel,
+			})
+			// credentials are shared, so verifying them once is enough
+			if len(queues) == 0 {
+				if err := gerritClient.VerifyAuth(ctx); err != nil {
+					return err
 				}
+				log.Infof("Successfully connected to gerrit at %s", URL)
 			}
-		}()
+
+			runner := submitqueue.NewRunner(ql, gerritClient)
+			runner.SetEmergencyPreemption(emergencyPreemption)
+			runner.SetKeepOptIn(keepOptIn)
+			runner.SetSubmitReadyPrefix(submitReadyPrefix)
+			runner.SetBatchSize(batchSize)
+			runner.SetStateStore(stateStore)
+			runner.SetCITimeout(time.Duration(ciTimeout)*time.Second, ciTimeoutAction, recheckMessage)
+
+			// events received via the event source or webhooks are debounced
+			debouncer := events.NewDebouncer(time.Duration(eventDebounceDelay)*time.Second, runner.RequestTrigger)
+
+			queues = append(queues, &frontend.Queue{
+				GerritClient:       gerritClient,
+				Runner:             runner,
+				RotatingLogHandler: queueRotatingLogHandler,
+				Trigger:            debouncer.Trigger,
+			})
+		}
+
+		for _, queue := range queues {
+			// fetch only on first run
+			err = queue.Runner.Trigger(ctx, fetchOnly)
+			if err != nil {
+				log.Error(err.Error())
+			}
+
+			// the ticker is kept as a fallback in case events get lost
+			wg.Add(1)
+			go func(runner *submitqueue.Runner) {
+				defer wg.Done()
+				runner.Run(ctx, time.Duration(triggerInterval)*time.Second, fetchOnly)
+			}(queue.Runner)
+		}
+
+		handler := frontend.MakeFrontend(rotatingLogHandler, queues, webhookSecret)
+
+		// event source
+		var source events.Source
+		switch eventsSource {
+		case "", "none":
+		case "ssh":
+			if sshUsername == "" {
+				sshUsername = username
+			}
+			source, err = events.NewSSHSource(l, sshAddress, sshUsername, sshIdentityFile)
+			if err != nil {
+				return err
+			}
+		case "events-log":
+			// the events log isn't specific to a project, any client can poll it
+			source = events.NewEventsLogSource(l, queues[0].GerritClient, time.Duration(eventsLogPollInterval)*time.Second)
+		default:
+			return fmt.Errorf("unknown events source: %s", eventsSource)
+		}
+		if source != nil {
+			var filters []func(*events.Event)
+			for _, queue := range queues {
+				filters = append(filters, events.FilterTarget(queue.GerritClient.GetProjectName(), queue.GerritClient.GetBranchName(), queue.Trigger))
+			}
+			listener := events.NewListener(l, source, func(event *events.Event) {
+				for _, filter := range filters {
+					filter(event)
+				}
+			})
+			go listener.Run(ctx)
+		}
 
 		server := http.Server{
 			Addr:    ":8080",
 			Handler: handler,
 		}
 
+		go func() {
+			<-ctx.Done()
+			log.Info("shutting down")
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.Warnf("failed to shut down http server: %s", err)
+			}
+		}()
+
 		err = server.ListenAndServe()
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf(err.Error())
 		}
 
+		// wait for the current runs to be aborted
+		wg.Wait()
 		return nil
 	}
 
@@ -132,7 +560,83 @@ func main() {
 	if err != nil {
 		log.Fatal(err.Error())
 	}
+}
+
+// queueTarget is a project and branch to run a submit queue for
+type queueTarget struct {
+	projectName string
+	branchName  string
+}
+
+// parseQueueTargets returns the queue targets from --project/--branch and the project[:branch] specs passed via --queue.
+// Specs without a branch use defaultBranch.
+func parseQueueTargets(projectName, defaultBranch string, specs []string) ([]queueTarget, error) {
+	var targets []queueTarget
+	seen := make(map[queueTarget]bool)
+	add := func(target queueTarget) error {
+		if target.projectName == "" || target.branchName == "" {
+			return fmt.Errorf("invalid queue %s:%s", target.projectName, target.branchName)
+		}
+		if seen[target] {
+			return fmt.Errorf("duplicate queue %s:%s", target.projectName, target.branchName)
+		}
+		seen[target] = true
+		targets = append(targets, target)
+		return nil
+	}
+
+	if projectName != "" {
+		if err := add(queueTarget{projectName, defaultBranch}); err != nil {
+			return nil, err
+		}
+	}
+	for _, spec := range specs {
+		target := queueTarget{spec, defaultBranch}
+		// the branch name follows the last colon
+		if i := strings.LastIndex(spec, ":"); i != -1 {
+			target = queueTarget{spec[:i], spec[i+1:]}
+		}
+		if err := add(target); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no queues configured, pass --project or --queue")
+	}
+	return targets, nil
+}
+
+// parseQueueStrategies returns the strategies passed as project[:branch]=strategy via --queue-strategy,
+// by queue target. Specs without a branch use defaultBranch.
+func parseQueueStrategies(targets []queueTarget, defaultBranch string, specs []string) (map[queueTarget]gerrit.Strategy, error) {
+	known := make(map[queueTarget]bool, len(targets))
+	for _, target := range targets {
+		known[target] = true
+	}
 
-	// TODOS:
-	// - handle event log, either by accepting webhooks, or by streaming events?
+	strategies := make(map[queueTarget]gerrit.Strategy)
+	for _, spec := range specs {
+		i := strings.LastIndex(spec, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid queue strategy %s, expected project[:branch]=strategy", spec)
+		}
+		queue := spec[:i]
+		target := queueTarget{queue, defaultBranch}
+		if j := strings.LastIndex(queue, ":"); j != -1 {
+			target = queueTarget{queue[:j], queue[j+1:]}
+		}
+		if !known[target] {
+			return nil, fmt.Errorf("strategy for unknown queue %s:%s", target.projectName, target.branchName)
+		}
+		if _, ok := strategies[target]; ok {
+			return nil, fmt.Errorf("duplicate strategy for queue %s:%s", target.projectName, target.branchName)
+		}
+		strategy, err := gerrit.ParseStrategy(spec[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		strategies[target] = strategy
+	}
+	return strategies, nil
 }
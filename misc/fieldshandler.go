@@ -0,0 +1,34 @@
+package misc
+
+import (
+	"github.com/apex/log"
+)
+
+// FieldsHandler is a log handler adding a fixed set of fields to each entry,
+// before passing it on to another handler.
+type FieldsHandler struct {
+	handler log.Handler
+	fields  log.Fields
+}
+
+// NewFieldsHandler creates a new fields handler
+func NewFieldsHandler(handler log.Handler, fields log.Fields) *FieldsHandler {
+	return &FieldsHandler{
+		handler: handler,
+		fields:  fields,
+	}
+}
+
+// HandleLog implements log.Handler.
+func (h *FieldsHandler) HandleLog(e *log.Entry) error {
+	fields := make(log.Fields, len(e.Fields)+len(h.fields))
+	for k, v := range h.fields {
+		fields[k] = v
+	}
+	for k, v := range e.Fields {
+		fields[k] = v
+	}
+	entry := *e
+	entry.Fields = fields
+	return h.handler.HandleLog(&entry)
+}
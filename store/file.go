@@ -0,0 +1,94 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps all values in a single JSON object.
+// Saving rewrites the whole file, so it's meant for a handful of small values.
+type FileStore struct {
+	mu     sync.Mutex
+	path   string
+	values map[string]json.RawMessage
+}
+
+var _ Store = &FileStore{}
+
+// NewFileStore opens the JSON file at path, which is created on the first save if it doesn't exist
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path:   path,
+		values: make(map[string]json.RawMessage),
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.values); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Load decodes the value saved under the key into v
+func (s *FileStore) Load(key string, v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(value, v)
+}
+
+// Save saves v under the key, and writes the file
+func (s *FileStore) Save(key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+	data, err := json.MarshalIndent(s.values, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data)
+}
+
+// Close does nothing, the file is only open while saving
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// writeFileAtomic replaces the file at path with data.
+// It's written to a temporary file first, so a crash leaves either the old or the new file behind.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
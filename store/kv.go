@@ -0,0 +1,158 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// minCompactRecords is the number of records below which the log is never compacted
+const minCompactRecords = 64
+
+// record is a single line of the log
+type record struct {
+	Key   string          `json:"key"`
+	Value json.RawMessage `json:"value"`
+}
+
+// KVStore is an embedded key-value store.
+// Saves are appended to a log file, so they don't get slower with the number of keys.
+// The log is replayed when opening the store, and rewritten with only the latest values
+// once it contains mostly outdated records.
+type KVStore struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	values map[string]json.RawMessage
+	// records is the number of records in the log
+	records int
+}
+
+var _ Store = &KVStore{}
+
+// NewKVStore opens the log at path, creating it if it doesn't exist.
+// A partially written record at the end of the log, left behind by a crash, is discarded.
+// If any record before it is corrupt, an error is returned, and the log is left untouched.
+func NewKVStore(path string) (*KVStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s := &KVStore{
+		path:   path,
+		f:      f,
+		values: make(map[string]json.RawMessage),
+	}
+	if err := s.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay reads the log, and truncates a partially written record at its end.
+// That's the last record if it's missing its trailing newline, or can't be decoded,
+// as a crash can leave the newline, but not the rest of the record on disk.
+// Records followed by other records are never dropped, if one can't be decoded, an error is returned.
+func (s *KVStore) replay() error {
+	reader := bufio.NewReader(s.f)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// without its trailing newline, the record wasn't written completely
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var r record
+		if err := json.Unmarshal(bytes.TrimSpace(line), &r); err != nil {
+			if _, peekErr := reader.Peek(1); peekErr == io.EOF {
+				break
+			}
+			return fmt.Errorf("corrupt record at offset %d of %s: %w", offset, s.path, err)
+		}
+		s.values[r.Key] = r.Value
+		s.records++
+		offset += int64(len(line))
+	}
+	if err := s.f.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := s.f.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Load decodes the latest value saved under the key into v
+func (s *KVStore) Load(key string, v interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(value, v)
+}
+
+// Save appends v to the log, and compacts it if necessary
+func (s *KVStore) Save(key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(&record{Key: key, Value: value})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	s.values[key] = value
+	s.records++
+	if s.records >= minCompactRecords && s.records > 2*len(s.values) {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact replaces the log with one containing only the latest value of each key
+func (s *KVStore) compact() error {
+	var buf bytes.Buffer
+	for key, value := range s.values {
+		line, err := json.Marshal(&record{Key: key, Value: value})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := writeFileAtomic(s.path, buf.Bytes()); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.f.Close()
+	s.f = f
+	s.records = len(s.values)
+	return nil
+}
+
+// Close closes the log
+func (s *KVStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
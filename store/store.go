@@ -0,0 +1,40 @@
+// Package store persists state across restarts.
+package store
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned when loading a key that was never saved
+var ErrNotFound = errors.New("not found")
+
+// Store persists values by key. Values are encoded as JSON.
+// Implementations are safe for concurrent use.
+type Store interface {
+	// Load decodes the value saved under the key into v, or returns ErrNotFound
+	Load(key string, v interface{}) error
+	// Save encodes v, and saves it under the key. It's durable once Save returns.
+	Save(key string, v interface{}) error
+	// Close releases the underlying file
+	Close() error
+}
+
+const (
+	// KindFile keeps all values in a single JSON file, which is rewritten on every save
+	KindFile = "file"
+	// KindKV appends values to a log, which is compacted from time to time
+	KindKV = "kv"
+)
+
+// Open opens a store of the given kind at path
+func Open(kind, path string) (Store, error) {
+	switch kind {
+	case KindFile:
+		return NewFileStore(path)
+	case KindKV:
+		return NewKVStore(path)
+	default:
+		return nil, fmt.Errorf("unknown state store %q, must be one of %s, %s", kind, KindFile, KindKV)
+	}
+}
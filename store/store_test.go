@@ -0,0 +1,144 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type value struct {
+	Name  string
+	Count int
+}
+
+func TestStores(t *testing.T) {
+	for _, kind := range []string{KindFile, KindKV} {
+		t.Run(kind, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state")
+			s, err := Open(kind, path)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			var v value
+			assert.ErrorIs(t, s.Load("a", &v), ErrNotFound)
+
+			assert.NoError(t, s.Save("a", &value{Name: "a", Count: 1}))
+			assert.NoError(t, s.Save("b", &value{Name: "b", Count: 1}))
+			assert.NoError(t, s.Save("a", &value{Name: "a", Count: 2}))
+			assert.NoError(t, s.Load("a", &v))
+			assert.Equal(t, value{Name: "a", Count: 2}, v)
+			assert.NoError(t, s.Close())
+
+			// values survive reopening
+			s, err = Open(kind, path)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer s.Close()
+			assert.NoError(t, s.Load("a", &v))
+			assert.Equal(t, value{Name: "a", Count: 2}, v)
+			assert.NoError(t, s.Load("b", &v))
+			assert.Equal(t, value{Name: "b", Count: 1}, v)
+		})
+	}
+
+	_, err := Open("sqlite", filepath.Join(t.TempDir(), "state"))
+	assert.Error(t, err)
+}
+
+func TestKVStoreCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	s, err := NewKVStore(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, s.Save(fmt.Sprintf("key%d", i%3), &value{Count: i}))
+	}
+	// the log was compacted at 64 records, and grew from there
+	assert.Equal(t, 100-64+3, s.records)
+	assert.NoError(t, s.Close())
+
+	s, err = NewKVStore(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	assert.Equal(t, 100-64+3, s.records)
+	var v value
+	assert.NoError(t, s.Load("key0", &v))
+	assert.Equal(t, 99, v.Count)
+}
+
+func TestKVStorePartialRecord(t *testing.T) {
+	for name, tail := range map[string]string{
+		"unterminated": `{"key":"a","val`,
+		// the newline made it to disk, but not all of the record before it
+		"terminated": `{"key":"a","val` + "\x00\x00\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state")
+			s, err := NewKVStore(path)
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.NoError(t, s.Save("a", &value{Count: 1}))
+			assert.NoError(t, s.Close())
+
+			// a crash while appending leaves a partial record behind
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			if !assert.NoError(t, err) {
+				return
+			}
+			_, err = f.WriteString(tail)
+			assert.NoError(t, err)
+			assert.NoError(t, f.Close())
+
+			s, err = NewKVStore(path)
+			if !assert.NoError(t, err) {
+				return
+			}
+			var v value
+			assert.NoError(t, s.Load("a", &v))
+			assert.Equal(t, 1, v.Count)
+
+			// it's discarded, so new records are readable
+			assert.NoError(t, s.Save("a", &value{Count: 2}))
+			assert.NoError(t, s.Close())
+			data, err := ioutil.ReadFile(path)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, strings.Count(string(data), "\n"))
+
+			s, err = NewKVStore(path)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer s.Close()
+			assert.NoError(t, s.Load("a", &v))
+			assert.Equal(t, 2, v.Count)
+		})
+	}
+}
+
+func TestKVStoreCorruptRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state")
+	contents := `{"key":"a","value":{"count":1}}` + "\n" +
+		`{"key":"a","val` + "\n" +
+		`{"key":"b","value":{"count":2}}` + "\n"
+	assert.NoError(t, ioutil.WriteFile(path, []byte(contents), 0644))
+
+	// it's not the last record, so it's not a partial write, and records after it would be lost.
+	// That's an error.
+	_, err := NewKVStore(path)
+	assert.Error(t, err)
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, string(data))
+}
@@ -0,0 +1,382 @@
+package submitqueue
+
+import (
+	"context"
+	"errors"
+
+	"github.com/apex/log"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+)
+
+// batchWindow is the number of recent CI results the batch size is derived from
+const batchWindow = 20
+
+// SetBatchSize enables speculative batching of up to maxSize units.
+// Instead of waiting for CI on one unit at a time, units are stacked on top of each other,
+// and CI runs on all of them at the same time.
+// A size of 0 or 1 disables batching.
+func (r *Runner) SetBatchSize(maxSize int) {
+	r.maxBatchSize = maxSize
+}
+
+// GetBatch returns the units of the current batch, bottom first, or nil if there's none.
+// Acquires a lock, so check with IsCurrentlyRunning first
+func (r *Runner) GetBatch() []*gerrit.Unit {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return append([]*gerrit.Unit{}, r.batch...)
+}
+
+// GetBatchSize returns the size new batches are built with, and the configured maximum.
+// Acquires a lock, so check with IsCurrentlyRunning first
+func (r *Runner) GetBatchSize() (int, int) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.batchSize(), r.maxBatchSize
+}
+
+// batchSize is the size of the next batch, adapted to the failure rate of the most recent units.
+// With a failure rate of f, batches of 1/f units contain one failing unit on average.
+func (r *Runner) batchSize() int {
+	if r.maxBatchSize <= 1 {
+		return 1
+	}
+	results, failures := 0, 0
+	for i := len(r.history) - 1; i >= 0 && results < batchWindow; i-- {
+		switch r.history[i].Outcome {
+		case OutcomeSubmitted:
+			results++
+		case OutcomeFailedCI:
+			results++
+			failures++
+		}
+	}
+	if failures == 0 {
+		return r.maxBatchSize
+	}
+	size := results / failures
+	if size < 1 {
+		return 1
+	}
+	if size > r.maxBatchSize {
+		return r.maxBatchSize
+	}
+	return size
+}
+
+// isBatchable returns true if the unit can be stacked on top of other units.
+// Topics span multiple projects, and merge commits can't be rebased, so both are submitted on their own.
+func (r *Runner) isBatchable(unit *gerrit.Unit) bool {
+	return !unit.IsTopic() && len(unit.Chains) == 1 && !unit.Chains[0].HasMerges()
+}
+
+// inBatch returns true if the unit contains changes of the current batch
+func (r *Runner) inBatch(unit *gerrit.Unit) bool {
+	changeIDs := make(map[string]bool)
+	for _, u := range r.batch {
+		for _, changeset := range u.Changesets() {
+			changeIDs[changeset.ChangeID] = true
+		}
+	}
+	return !unit.AllChangesets(func(c *gerrit.Changeset) bool { return !changeIDs[c.ChangeID] })
+}
+
+// refreshBatch replaces the units of the batch with how they look like in gerrit now.
+// Stacked units are assembled into a single chain by the client, so they're looked up by their changes.
+// If a change of the batch disappeared, the batch is discarded.
+func (r *Runner) refreshBatch() {
+	changesets := r.changesetsByChangeID()
+	batch := make([]*gerrit.Unit, 0, len(r.batch))
+	for _, unit := range r.batch {
+		chain := &gerrit.Chain{}
+		for _, changeset := range unit.Chains[0].ChangeSets {
+			current, ok := changesets[changeset.ChangeID]
+			if !ok {
+				r.logger.WithFields(log.Fields{
+					"unit":      unit,
+					"changeset": changeset,
+				}).Warn("changeset of the batch has disappeared, discarding the batch")
+				r.discardBatch(DiscardDisappeared)
+				return
+			}
+			chain.ChangeSets = append(chain.ChangeSets, current)
+		}
+		batch = append(batch, &gerrit.Unit{Chains: []*gerrit.Chain{chain}})
+	}
+	r.setBatch(batch)
+}
+
+// discardBatch drops all units of the batch, and emits UnitDiscarded for each of them
+func (r *Runner) discardBatch(reason DiscardReason) {
+	batch := r.batch
+	r.setBatch(nil)
+	for _, unit := range batch {
+		r.emit(&UnitDiscarded{unitEvent{unit}, reason})
+	}
+}
+
+// setBatch replaces the current batch
+func (r *Runner) setBatch(batch []*gerrit.Unit) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.batch = batch
+}
+
+// batchIsStacked returns true if the first unit of the batch is based on HEAD,
+// and every other unit on the leaf of the unit below it.
+func (r *Runner) batchIsStacked() bool {
+	base := r.gerrit.GetHEAD()
+	for _, unit := range r.batch {
+		changesets := unit.Chains[0].ChangeSets
+		parents := changesets[0].ParentCommitIDs
+		if len(parents) == 0 || parents[0] != base {
+			return false
+		}
+		base = changesets[len(changesets)-1].CommitID
+	}
+	return true
+}
+
+// processBatch submits the units at the bottom of the batch that passed CI.
+// If a unit failed CI, the batch is split at it, see bisectBatch.
+// It returns true if the batch is still waiting for CI.
+// The changes of submitted units are added to submitted, as the local cache still contains them.
+func (r *Runner) processBatch(ctx context.Context, submitted map[string]bool) (bool, error) {
+	l := r.logger.WithField("batch", r.batch)
+	l.Info("Checking batch")
+
+	// HEAD moved without going through the submit queue, or a unit was updated
+	if !r.batchIsStacked() {
+		l.Warnf("batch isn't stacked on HEAD %v anymore, discarding it", r.gerrit.GetHEAD())
+		r.discardBatch(DiscardHEADMoved)
+		return false, nil
+	}
+
+	// CI ran on each unit with all units below it, so the bottom unit can be submitted
+	// as soon as it passed, no matter how the units above it do.
+	for len(r.batch) != 0 {
+		unit := r.batch[0]
+		if !r.isAutoSubmittable(unit) || !unit.AllChangesets(func(c *gerrit.Changeset) bool { return c.IsVerified() }) {
+			break
+		}
+		l := l.WithField("unit", unit)
+		r.emit(&CIPassed{unitEvent{unit}})
+		l.Info("submitting unit of the batch")
+		err := r.submitUnit(ctx, unit)
+		if err != nil {
+			l := l.WithError(err)
+			switch {
+			case errors.Is(err, gerrit.ErrTransient):
+				l.Warn("transient error submitting changeset, retrying later")
+				return true, err
+			case errors.Is(err, gerrit.ErrConflict), errors.Is(err, gerrit.ErrNotFound):
+				l.Warn("changeset can't be submitted, discarding the batch")
+				r.discardBatch(DiscardSubmitFailed)
+				return false, nil
+			default:
+				l.Error("error submitting changeset")
+				r.discardBatch(DiscardSubmitFailed)
+				return false, err
+			}
+		}
+		for _, changeset := range unit.Changesets() {
+			submitted[changeset.ChangeID] = true
+		}
+		r.setBatch(r.batch[1:])
+		r.emit(&UnitSubmitted{unitEvent{unit}})
+	}
+	if len(r.batch) == 0 {
+		r.setBatch(nil)
+		return false, nil
+	}
+
+	for i, unit := range r.batch {
+		for _, changeset := range unit.Changesets() {
+			if changeset.IsCIFailed() {
+				return r.bisectBatch(ctx, i, changeset), nil
+			}
+		}
+	}
+	if r.ciTimedOut() && !r.handleCITimeout(ctx, r.batch) {
+		r.discardBatch(DiscardCITimeout)
+		return false, nil
+	}
+	l.Info("still waiting for CI feedback in the batch, going back to sleep.")
+	return true, nil
+}
+
+// bisectBatch handles a CI failure of the unit at the given index of the batch.
+// CI ran on it together with the units below it, so they might have caused the failure as well.
+// They don't depend on the units above them, so they stay in the batch, and keep waiting for CI.
+// If all of them passed already, the failing unit is to blame: it's dropped, and its owner told, see reportCIFailure.
+// Otherwise, it's retested once the units below it are done.
+// It's split off the batch together with the units above it, which were tested on top of it,
+// and they're put back at the front of the queue as bisected units.
+// They're rebased when they're picked again, so a unit is only rebased once it's clear what to rebase it on.
+// It returns true if the batch is still waiting for CI.
+func (r *Runner) bisectBatch(ctx context.Context, failed int, failing *gerrit.Changeset) bool {
+	unit := r.batch[failed]
+	bisected := append([]*gerrit.Unit{}, r.batch[failed+1:]...)
+	l := r.logger.WithFields(log.Fields{
+		"batch":  r.batch,
+		"failed": unit,
+	})
+	// CI ran on it on top of the leaf of the unit below it
+	var base *gerrit.Changeset
+	tested := true
+	for _, u := range r.batch[:failed] {
+		changesets := u.Changesets()
+		base = changesets[len(changesets)-1]
+		if !u.AllChangesets(func(c *gerrit.Changeset) bool { return c.IsVerified() }) {
+			tested = false
+		}
+	}
+	r.setBatch(r.batch[:failed])
+
+	if tested {
+		l.Warnf("unit of the batch failed CI on top of passing units, discarding it, and keeping %d units", failed)
+		r.reportCIFailure(ctx, unit, failing, base)
+		r.emit(&CIFailed{unitEvent{unit}, failing})
+		r.emit(&UnitDiscarded{unitEvent{unit}, DiscardCIFailed})
+	} else {
+		l.Warnf("unit of the batch failed CI on top of units still waiting for CI, retesting it once they're done")
+		bisected = append([]*gerrit.Unit{unit}, bisected...)
+	}
+	for _, unit := range bisected {
+		r.emit(&UnitDiscarded{unitEvent{unit}, DiscardBisected})
+	}
+	// they were stacked below the units bisected earlier
+	r.mut.Lock()
+	r.bisected = append(bisected, r.bisected...)
+	r.mut.Unlock()
+	return len(r.batch) != 0
+}
+
+// isOptedIn returns true if the owner still wants the changeset to be submitted.
+// Bisected units are queued while they are, even though their CI result doesn't allow submitting them.
+func isOptedIn(c *gerrit.Changeset) bool {
+	return c.IsAutosubmit() && !c.IsWorkInProgress()
+}
+
+// isBisected returns true if the unit contains changes of bisected units
+func (r *Runner) isBisected(unit *gerrit.Unit) bool {
+	changeIDs := make(map[string]bool)
+	for _, u := range r.bisected {
+		for _, changeset := range u.Changesets() {
+			changeIDs[changeset.ChangeID] = true
+		}
+	}
+	return !unit.AllChangesets(func(c *gerrit.Changeset) bool { return !changeIDs[c.ChangeID] })
+}
+
+// GetBisected returns the units split off a batch that are retested next, see bisectBatch.
+// Acquires a lock, so check with IsCurrentlyRunning first
+func (r *Runner) GetBisected() []*gerrit.Unit {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return append([]*gerrit.Unit{}, r.bisected...)
+}
+
+// refreshBisected replaces the bisected units with how they look like in gerrit now.
+// Bisected units stay stacked on the units below them until they're picked again,
+// so the client assembles them into a single unit, and they're looked up by their changes.
+// Units that were updated or are gone are forgotten, they're queued like any other unit.
+func (r *Runner) refreshBisected() {
+	changesets := r.changesetsByChangeID()
+	bisected := make([]*gerrit.Unit, 0, len(r.bisected))
+	for _, unit := range r.bisected {
+		current, err := restoreUnit(r.persistUnit(unit), changesets)
+		if err != nil {
+			r.logger.WithField("unit", unit).WithError(err).Info("forgetting bisected unit")
+			continue
+		}
+		bisected = append(bisected, current)
+	}
+	r.mut.Lock()
+	r.bisected = bisected
+	r.mut.Unlock()
+}
+
+// forgetBisected drops bisected units once their changes are picked again, or submitted or discarded otherwise.
+// It's subscribed to the runner's events.
+func (r *Runner) forgetBisected(event Event) {
+	if e, ok := event.(*UnitDiscarded); ok && e.Reason == DiscardBisected {
+		return
+	}
+	changeIDs := make(map[string]bool)
+	for _, changeset := range event.GetUnit().Changesets() {
+		changeIDs[changeset.ChangeID] = true
+	}
+	bisected := make([]*gerrit.Unit, 0, len(r.bisected))
+	for _, u := range r.bisected {
+		if u.AllChangesets(func(c *gerrit.Changeset) bool { return !changeIDs[c.ChangeID] }) {
+			bisected = append(bisected, u)
+		}
+	}
+	r.mut.Lock()
+	r.bisected = bisected
+	r.mut.Unlock()
+}
+
+// buildBatch stacks the given units on top of each other, starting at HEAD, and makes them the batch.
+// Units that conflict with HEAD, or with the units below them, are skipped.
+func (r *Runner) buildBatch(ctx context.Context, units []*gerrit.Unit, skippedUnits map[*gerrit.Unit]bool) error {
+	base := r.gerrit.GetHEAD()
+	batch := make([]*gerrit.Unit, 0, len(units))
+	for _, unit := range units {
+		l := r.logger.WithField("unit", unit)
+		chain := unit.Chains[0]
+		r.emit(&UnitPicked{unitEvent{unit}})
+		if len(batch) == 0 && r.gerrit.ChainIsRebasedOnHEAD(chain) {
+			batch = append(batch, unit)
+			base = chain.ChangeSets[len(chain.ChangeSets)-1].CommitID
+			continue
+		}
+		// a conflict would leave the unit half-rebased, so ask gerrit first
+		if !r.checkMergeable(ctx, unit) {
+			skippedUnits[unit] = true
+			r.emit(&UnitDiscarded{unitEvent{unit}, DiscardConflict})
+			continue
+		}
+		leaf, changeset, err := r.rebaseChain(ctx, chain, base)
+		if err != nil {
+			l := l.WithField("changeset", changeset).WithError(err)
+			reason := DiscardRebaseFailed
+			switch {
+			case errors.Is(err, gerrit.ErrConflict):
+				reason = DiscardConflict
+				if len(batch) == 0 {
+					l.Warn("unit can't be rebased on HEAD without conflicts, skipping it")
+					r.recordConflict(ctx, unit, changeset)
+				} else {
+					// it might not conflict with HEAD, so it's tried again once the batch is done
+					l.Warn("unit can't be stacked on the batch without conflicts, skipping it")
+				}
+			case errors.Is(err, gerrit.ErrForbidden):
+				l.Error("not allowed to rebase unit, skipping it")
+			case errors.Is(err, gerrit.ErrNotFound):
+				l.Warn("changeset disappeared while rebasing, skipping unit")
+				reason = DiscardDisappeared
+			default:
+				l.Error("error rebasing unit")
+				r.setBatch(batch)
+				r.emit(&UnitDiscarded{unitEvent{unit}, reason})
+				return err
+			}
+			skippedUnits[unit] = true
+			r.emit(&UnitDiscarded{unitEvent{unit}, reason})
+			continue
+		}
+		r.countAttempt(unit)
+		r.emit(&UnitRebased{unitEvent{unit}, base})
+		l.WithField("base", base).Info("stacked unit on the batch")
+		batch = append(batch, unit)
+		base = leaf
+	}
+	r.setBatch(batch)
+	if len(batch) == 0 {
+		r.setBatch(nil)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package submitqueue
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+	"github.com/flokli/gerrit-queue/store"
+)
+
+// failedVotes are the votes of a change that failed CI
+func failedVotes() map[string]int {
+	return map[string]int{"Verified": -1, "Code-Review": 2, "Autosubmit": 1}
+}
+
+// parentOf returns the parent commit of the current revision of the change with the given number
+func (f *fakeGerrit) parentOf(number int) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, change := range f.changes {
+		if change.Number == number {
+			return change.Revisions[change.CurrentRevision].Commit.Parents[0].Commit
+		}
+	}
+	return ""
+}
+
+func TestBatch(t *testing.T) {
+	f, c := newFakeGerrit(t)
+	f.addChange(1, "c1", "old", readyVotes())
+	f.addChange(2, "c2", "old", readyVotes())
+	f.addChange(3, "c3", "old", readyVotes())
+
+	r := NewRunner(&log.Logger{Handler: discard.New()}, c)
+	r.SetBatchSize(3)
+	assert.NoError(t, r.Trigger(context.Background(), false))
+
+	// each unit is rebased on the leaf of the one below it
+	assert.Equal(t, []int{1, 2, 3}, f.rebased)
+	assert.Equal(t, "head", f.parentOf(1))
+	assert.Equal(t, "c1-r2", f.parentOf(2))
+	assert.Equal(t, "c2-r2", f.parentOf(3))
+	assert.Nil(t, r.GetWIPUnit())
+	assert.Len(t, r.GetBatch(), 3)
+
+	diagnoses := r.Diagnose()
+	if assert.Len(t, diagnoses, 3) {
+		for i, d := range diagnoses {
+			assert.Equal(t, UnitStatusInProgress, d.Status)
+			assert.Equal(t, i, d.Position)
+		}
+	}
+
+	// the passing units at the bottom are submitted, even if the ones above are still pending
+	f.setVotes(1, readyVotes())
+	f.setVotes(2, readyVotes())
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, []int{1, 2}, f.submitted)
+	assert.Len(t, r.GetBatch(), 1)
+
+	f.setVotes(3, readyVotes())
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, []int{1, 2, 3}, f.submitted)
+	assert.Empty(t, r.GetBatch())
+	assert.Equal(t, []int{1, 2, 3}, f.rebased)
+}
+
+func TestBatchSplit(t *testing.T) {
+	f, c := newFakeGerrit(t)
+	f.addChange(1, "c1", "old", readyVotes())
+	f.addChange(2, "c2", "old", readyVotes())
+	f.addChange(3, "c3", "old", readyVotes())
+	f.addChange(4, "c4", "old", readyVotes())
+	s, err := store.NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	r := NewRunner(&log.Logger{Handler: discard.New()}, c)
+	r.SetStateStore(s)
+	r.SetBatchSize(4)
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Len(t, r.GetBatch(), 4)
+
+	// change 3 fails, but the units below it might have caused it, so they keep waiting.
+	// It's split off with the unit above it, which are neither blamed nor rebased yet.
+	f.setVotes(3, failedVotes())
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, []int{1, 2, 3, 4}, f.rebased)
+	assert.Empty(t, f.deletedVotes)
+	assert.Empty(t, f.messages)
+	if batch := r.GetBatch(); assert.Len(t, batch, 2) {
+		assert.Equal(t, 1, batch[0].Changesets()[0].Number)
+		assert.Equal(t, 2, batch[1].Changesets()[0].Number)
+	}
+	if bisected := r.GetBisected(); assert.Len(t, bisected, 2) {
+		assert.Equal(t, 3, bisected[0].Changesets()[0].Number)
+		assert.Equal(t, 4, bisected[1].Changesets()[0].Number)
+	}
+
+	// the bisected units survive restarts
+	r = NewRunner(&log.Logger{Handler: discard.New()}, c)
+	r.SetStateStore(s)
+	r.SetBatchSize(4)
+
+	// change 1 fails with nothing below it, so it's to blame, and its owner needs to opt in again.
+	// Change 2 is split off, and retested first, rebased on HEAD on its own, as the failure rate went up.
+	f.setVotes(1, failedVotes())
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, []string{"Autosubmit"}, f.deletedVotes[1])
+	assert.Len(t, f.messages[1], 1)
+	assert.Empty(t, f.deletedVotes[3])
+	assert.Empty(t, r.GetBatch())
+	assert.Empty(t, f.submitted)
+	assert.Equal(t, []int{1, 2, 3, 4, 2}, f.rebased)
+	assert.Equal(t, "head", f.parentOf(2))
+	if wipUnit := r.GetWIPUnit(); assert.NotNil(t, wipUnit) {
+		assert.Equal(t, 2, wipUnit.Changesets()[0].Number)
+	}
+	// the others are still stacked on it, and queued after it
+	assert.Equal(t, "c2-r2", f.parentOf(3))
+	assert.Len(t, r.GetBisected(), 2)
+	assert.NoError(t, r.Trigger(context.Background(), true))
+	diagnosed := false
+	for _, d := range r.Diagnose() {
+		if d.Contains(3) {
+			diagnosed = true
+			assert.Equal(t, UnitStatusQueued, d.Status)
+			assert.Equal(t, 1, d.Position)
+		}
+	}
+	assert.True(t, diagnosed)
+
+	size, maxSize := r.GetBatchSize()
+	assert.Equal(t, 1, size)
+	assert.Equal(t, 4, maxSize)
+
+	// change 2 passes. Change 3 was tested on top of its old patchset, so it's retested with change 4
+	// instead of being blamed.
+	f.setVotes(2, readyVotes())
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, []int{2}, f.submitted)
+	assert.Empty(t, f.deletedVotes[3])
+	assert.Equal(t, []int{1, 2, 3, 4, 2, 3, 4}, f.rebased)
+	assert.Equal(t, "c2-r2-r3", f.parentOf(3))
+	assert.Len(t, r.GetBatch(), 2)
+	assert.Empty(t, r.GetBisected())
+}
+
+func TestBatchSize(t *testing.T) {
+	r := &Runner{}
+	assert.Equal(t, 1, r.batchSize())
+
+	r.SetBatchSize(8)
+	assert.Equal(t, 8, r.batchSize())
+
+	unit := &gerrit.Unit{}
+	// one in four units failing
+	for i := 0; i < batchWindow; i++ {
+		if i%4 == 0 {
+			r.recordOutcome(unit, OutcomeFailedCI)
+		} else {
+			r.recordOutcome(unit, OutcomeSubmitted)
+		}
+	}
+	assert.Equal(t, 4, r.batchSize())
+
+	// only the most recent CI results count
+	for i := 0; i < batchWindow; i++ {
+		r.recordOutcome(unit, OutcomeSubmitted)
+		r.recordOutcome(unit, OutcomeDiscarded)
+	}
+	assert.Equal(t, 8, r.batchSize())
+
+	r.recordOutcome(unit, OutcomeFailedCI)
+	assert.Equal(t, 8, r.batchSize())
+	for i := 0; i < batchWindow; i++ {
+		r.recordOutcome(unit, OutcomeFailedCI)
+	}
+	assert.Equal(t, 1, r.batchSize())
+}
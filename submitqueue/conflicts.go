@@ -0,0 +1,99 @@
+package submitqueue
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+)
+
+// conflict records that a unit couldn't be rebased on HEAD without conflicts
+type conflict struct {
+	// head is the HEAD the unit conflicted with, it's checked again once HEAD moves
+	head string
+	// changeset is the changeset that couldn't be merged or rebased
+	changeset *gerrit.Changeset
+}
+
+// unitKey identifies a unit by the patchsets it consists of.
+// Uploading a new patchset changes it, so updated units are checked again.
+func unitKey(unit *gerrit.Unit) string {
+	changesets := unit.Changesets()
+	commitIDs := make([]string, len(changesets))
+	for i, changeset := range changesets {
+		commitIDs[i] = changeset.CommitID
+	}
+	sort.Strings(commitIDs)
+	return strings.Join(commitIDs, ",")
+}
+
+// getConflict returns the conflict of the unit with the current HEAD, or nil if it's not known to conflict
+func (r *Runner) getConflict(unit *gerrit.Unit) *conflict {
+	c, ok := r.conflicts[unitKey(unit)]
+	if !ok || c.head != r.gerrit.GetHEAD() {
+		return nil
+	}
+	return c
+}
+
+// pruneConflicts forgets about conflicts of units that don't exist anymore
+func (r *Runner) pruneConflicts() {
+	keys := make(map[string]bool, len(r.candidates))
+	for _, unit := range r.candidates {
+		keys[unitKey(unit)] = true
+	}
+	for key := range r.conflicts {
+		if !keys[key] {
+			delete(r.conflicts, key)
+		}
+	}
+}
+
+// recordConflict remembers that the unit conflicts with the current HEAD, so it isn't tried again
+// until HEAD moves, or the unit is updated. The owner of the conflicting changeset is notified once per unit.
+func (r *Runner) recordConflict(ctx context.Context, unit *gerrit.Unit, changeset *gerrit.Changeset) {
+	head := r.gerrit.GetHEAD()
+	key := unitKey(unit)
+	_, known := r.conflicts[key]
+	r.conflicts[key] = &conflict{head: head, changeset: changeset}
+	if known {
+		return
+	}
+
+	branch := r.gerrit.GetBranchName()
+	message := fmt.Sprintf("This change can't be rebased on %s (%.7s) without conflicts. "+
+		"The submit queue skips it, and tries again once it's updated, or %s moves. "+
+		"If it still conflicts then, please rebase it manually.",
+		branch, head, branch)
+	err := r.gerrit.NotifyOwner(ctx, changeset, message)
+	if err != nil {
+		r.logger.WithFields(log.Fields{
+			"unit":      unit,
+			"changeset": changeset,
+		}).WithError(err).Warn("unable to notify the owner about the conflict")
+	}
+}
+
+// checkMergeable asks gerrit whether the unit can be rebased on HEAD without conflicts.
+// Conflicts are recorded, see recordConflict.
+// If gerrit can't tell, the unit is assumed to be mergeable, and conflicts are found while rebasing it.
+func (r *Runner) checkMergeable(ctx context.Context, unit *gerrit.Unit) bool {
+	changeset, err := r.gerrit.FindUnmergeable(ctx, unit)
+	if err != nil {
+		r.logger.WithField("unit", unit).WithError(err).Warn("unable to check mergeability, trying to rebase anyways")
+		return true
+	}
+	if changeset != nil {
+		r.logger.WithFields(log.Fields{
+			"unit":      unit,
+			"changeset": changeset,
+		}).Warn("unit can't be rebased on HEAD without conflicts, skipping it")
+		r.recordConflict(ctx, unit, changeset)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+package submitqueue
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConflicts(t *testing.T) {
+	f, c := newFakeGerrit(t)
+	f.addChange(1, "c1", "old", readyVotes())
+	f.addChange(2, "c2", "old", readyVotes())
+	f.conflicting[1] = true
+
+	r := NewRunner(&log.Logger{Handler: discard.New()}, c)
+	assert.NoError(t, r.Trigger(context.Background(), false))
+
+	// the conflicting unit isn't rebased, the next one is picked instead
+	assert.Equal(t, []int{2}, f.rebased)
+	assert.Equal(t, 2, f.mergeableChecks)
+	if assert.Len(t, f.messages[1], 1) {
+		assert.Contains(t, f.messages[1][0], "without conflicts")
+		assert.Contains(t, f.messages[1][0], "tries again once it's updated, or master moves")
+	}
+
+	diagnoses := r.Diagnose()
+	if assert.Len(t, diagnoses, 2) {
+		assert.Equal(t, UnitStatusBlocked, diagnoses[0].Status)
+		if assert.Len(t, diagnoses[0].Reasons, 1) {
+			assert.Equal(t, ReasonMergeConflict, diagnoses[0].Reasons[0].Code)
+		}
+	}
+
+	// submitting change 2 moves HEAD, so change 1 is checked again, but the owner was already notified
+	f.setVotes(2, readyVotes())
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, []int{2}, f.submitted)
+	assert.Equal(t, 3, f.mergeableChecks)
+	assert.Len(t, f.messages[1], 1)
+
+	// HEAD didn't move, so it's not checked again
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, 3, f.mergeableChecks)
+
+	// HEAD moved, and the conflict is gone, so it's rebased
+	delete(f.conflicting, 1)
+	f.head = "head2"
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, []int{2, 1}, f.rebased)
+}
+
+func TestConflictWhileRebasing(t *testing.T) {
+	f, c := newFakeGerrit(t)
+	f.addChange(1, "c1", "old", readyVotes())
+	// gerrit thinks it's mergeable, but rebasing it fails
+	f.failRebase[1] = http.StatusConflict
+
+	r := NewRunner(&log.Logger{Handler: discard.New()}, c)
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Len(t, f.messages[1], 1)
+	assert.Nil(t, r.GetWIPUnit())
+
+	// it's not tried again until HEAD moves
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, 1, f.mergeableChecks)
+}
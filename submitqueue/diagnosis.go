@@ -0,0 +1,317 @@
+package submitqueue
+
+import (
+	"fmt"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+)
+
+// Codes of the reasons a unit isn't submitted
+const (
+	ReasonNotOptedIn         = "not-opted-in"
+	ReasonOptInOutdated      = "opt-in-outdated"
+	ReasonWorkInProgress     = "work-in-progress"
+	ReasonMissingReview      = "missing-review"
+	ReasonCIPending          = "ci-pending"
+	ReasonCIFailed           = "ci-failed"
+	ReasonNotSubmittable     = "not-submittable"
+	ReasonChainBroken        = "chain-broken"
+	ReasonWaitsForParent     = "waits-for-parent"
+	ReasonForeignChanges     = "foreign-changes"
+	ReasonTopicTruncated     = "topic-truncated"
+	ReasonMergeNotRebaseable = "merge-not-rebaseable"
+	ReasonMergeConflict      = "merge-conflict"
+	ReasonBehindInQueue      = "behind-in-queue"
+)
+
+// Status values of a unit
+const (
+	// UnitStatusInProgress is the unit currently being submitted
+	UnitStatusInProgress = "in-progress"
+	// UnitStatusNext is picked next
+	UnitStatusNext = "next"
+	// UnitStatusQueued is waiting for other units to be submitted
+	UnitStatusQueued = "queued"
+	// UnitStatusBlocked was opted in to automatic submission, but something blocks it
+	UnitStatusBlocked = "blocked"
+	// UnitStatusIdle was never opted in to automatic submission
+	UnitStatusIdle = "idle"
+)
+
+// BlockingReason explains why a unit, chain or changeset isn't submitted
+type BlockingReason struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (r *BlockingReason) String() string {
+	return r.Message
+}
+
+// ChangesetDiagnosis lists the reasons blocking a single changeset
+type ChangesetDiagnosis struct {
+	Changeset *gerrit.Changeset `json:"-"`
+	Number    int               `json:"number"`
+	Subject   string            `json:"subject"`
+	URL       string            `json:"url"`
+	Reasons   []*BlockingReason `json:"reasons"`
+}
+
+// ChainDiagnosis lists the reasons blocking a chain as a whole, and its changesets
+type ChainDiagnosis struct {
+	Reasons    []*BlockingReason     `json:"reasons"`
+	Changesets []*ChangesetDiagnosis `json:"changesets"`
+}
+
+// UnitDiagnosis describes the state of a unit in the queue, and why it isn't submitted
+type UnitDiagnosis struct {
+	Unit   *gerrit.Unit `json:"-"`
+	Topics []string     `json:"topics,omitempty"`
+	Status string       `json:"status"`
+	// Priority is normal, high or emergency
+	Priority string `json:"priority"`
+	// Position is the number of units submitted before this one, or -1 if it's not queued
+	Position int `json:"position"`
+	// ReadyPrefix is the number of changesets at the beginning of the chain submitted on their own,
+	// while the rest stays queued. It's 0 if the unit is submitted as a whole.
+	ReadyPrefix int `json:"readyPrefix,omitempty"`
+	// Attempts is how often the unit was rebased by the submit queue
+	Attempts          int                   `json:"attempts,omitempty"`
+	Reasons           []*BlockingReason     `json:"reasons"`
+	Chains            []*ChainDiagnosis     `json:"chains"`
+	ForeignChangesets []*ChangesetDiagnosis `json:"foreignChangesets,omitempty"`
+}
+
+// AllReasons returns the reasons of the unit, its chains and changesets
+func (d *UnitDiagnosis) AllReasons() []*BlockingReason {
+	reasons := append([]*BlockingReason{}, d.Reasons...)
+	for _, chain := range d.Chains {
+		reasons = append(reasons, chain.Reasons...)
+		for _, changeset := range chain.Changesets {
+			reasons = append(reasons, changeset.Reasons...)
+		}
+	}
+	for _, changeset := range d.ForeignChangesets {
+		reasons = append(reasons, changeset.Reasons...)
+	}
+	return reasons
+}
+
+// Contains returns true if the unit contains the change with the given number
+func (d *UnitDiagnosis) Contains(number int) bool {
+	for _, changeset := range d.Unit.Changesets() {
+		if changeset.Number == number {
+			return true
+		}
+	}
+	return false
+}
+
+// diagnoseChangeset returns the reasons blocking a single changeset
+func (r *Runner) diagnoseChangeset(c *gerrit.Changeset, report *gerrit.AssemblyReport) *ChangesetDiagnosis {
+	d := &ChangesetDiagnosis{
+		Changeset: c,
+		Number:    c.Number,
+		Subject:   c.Subject,
+		URL:       r.gerrit.GetChangesetURL(c),
+		Reasons:   make([]*BlockingReason, 0),
+	}
+	add := func(code, format string, a ...interface{}) {
+		d.Reasons = append(d.Reasons, &BlockingReason{Code: code, Message: fmt.Sprintf(format, a...)})
+	}
+
+	if !c.IsAutosubmit() {
+		if patchSetNumber := c.OptInPatchSetNumber(); patchSetNumber != 0 && patchSetNumber < c.PatchSetNumber {
+			add(ReasonOptInOutdated, "owner opted in on patchset %d, but not on the current patchset %d", patchSetNumber, c.PatchSetNumber)
+		} else {
+			add(ReasonNotOptedIn, "not opted in to autosubmit")
+		}
+	}
+	if c.IsWorkInProgress() {
+		add(ReasonWorkInProgress, "work in progress")
+	}
+	if !c.IsCodeReviewed() {
+		add(ReasonMissingReview, "missing code review")
+	}
+	switch {
+	case c.IsCIFailed():
+		add(ReasonCIFailed, "CI failed")
+	case !c.IsVerified():
+		add(ReasonCIPending, "waiting for CI")
+	}
+	if !c.IsSubmittable() {
+		unsatisfied := c.UnsatisfiedSubmitRequirements()
+		if len(unsatisfied) == 0 {
+			add(ReasonNotSubmittable, "not submittable according to gerrit")
+		}
+		for _, requirement := range unsatisfied {
+			add(ReasonNotSubmittable, "%s", requirement.String())
+		}
+	}
+	for _, validationError := range report.ValidationErrors {
+		if validationError.Changeset == c {
+			add(ReasonChainBroken, "%s", validationError.Reason)
+		}
+	}
+	for _, waiting := range report.WaitingForParent {
+		if waiting.Changeset == c {
+			add(ReasonWaitsForParent, "waits for parent change %d to be submitted first", waiting.Parent.Number)
+		}
+	}
+	return d
+}
+
+// diagnoseChain returns the reasons blocking a chain
+func (r *Runner) diagnoseChain(chain *gerrit.Chain, report *gerrit.AssemblyReport) *ChainDiagnosis {
+	d := &ChainDiagnosis{
+		Reasons:    make([]*BlockingReason, 0),
+		Changesets: make([]*ChangesetDiagnosis, 0, len(chain.ChangeSets)),
+	}
+	if len(chain.ForeignSubmittedTogether) != 0 {
+		d.Reasons = append(d.Reasons, &BlockingReason{
+			Code:    ReasonForeignChanges,
+			Message: fmt.Sprintf("would be submitted together with changes outside of the chain: %v", chain.ForeignSubmittedTogether),
+		})
+	}
+	if !r.gerrit.ChainCanBeRebased(chain) {
+		d.Reasons = append(d.Reasons, &BlockingReason{
+			Code:    ReasonMergeNotRebaseable,
+			Message: "contains merge commits, which need to be based on HEAD by their owner",
+		})
+	}
+	for _, changeset := range chain.ChangeSets {
+		d.Changesets = append(d.Changesets, r.diagnoseChangeset(changeset, report))
+	}
+	return d
+}
+
+// Diagnose explains for each unit why it isn't submitted (yet).
+// Acquires a lock, so check with IsCurrentlyRunning first
+func (r *Runner) Diagnose() []*UnitDiagnosis {
+	wipUnit := r.GetWIPUnit()
+	batch := r.GetBatch()
+	report := r.gerrit.GetAssemblyReport()
+
+	// the unit or batch in progress is submitted first
+	position := make(map[*gerrit.Unit]int)
+	// bisected units are still stacked, and assembled into a single unit by the client,
+	// so the position of its bottom-most one is used, by change ID
+	bisectedPosition := make(map[string]int)
+	next := len(batch)
+	if wipUnit != nil {
+		next = 1
+	}
+	for _, unit := range r.queuedUnits(report) {
+		if wipUnit != nil && wipUnit.HasSameChanges(unit) {
+			continue
+		}
+		position[unit] = next
+		if r.isBisected(unit) {
+			bisectedPosition[unit.Changesets()[0].ChangeID] = next
+		}
+		next++
+	}
+
+	diagnoses := make([]*UnitDiagnosis, 0)
+	for _, unit := range r.gerrit.FilterUnits(func(u *gerrit.Unit) bool { return true }) {
+		d := &UnitDiagnosis{
+			Unit:     unit,
+			Topics:   unit.Topics,
+			Priority: r.gerrit.UnitPriority(unit).String(),
+			Position: -1,
+			Reasons:  make([]*BlockingReason, 0),
+			Chains:   make([]*ChainDiagnosis, 0, len(unit.Chains)),
+		}
+		for _, chain := range unit.Chains {
+			d.Chains = append(d.Chains, r.diagnoseChain(chain, report))
+		}
+		for _, changeset := range unit.ForeignChangesets {
+			d.ForeignChangesets = append(d.ForeignChangesets, r.diagnoseChangeset(changeset, report))
+		}
+
+		// the ready prefix is queued in place of the unit, and might be in progress
+		queuedUnit := unit
+		if prefix, ok := r.prefixes[unit]; ok {
+			queuedUnit = prefix
+		} else if wipUnit != nil && r.submitReadyPrefix && len(wipUnit.Chains) == 1 && !wipUnit.HasSameChanges(unit) {
+			if prefix := unit.Prefix(len(wipUnit.Chains[0].ChangeSets)); prefix != nil && wipUnit.HasSameChanges(prefix) {
+				queuedUnit = prefix
+			}
+		}
+		if queuedUnit != unit {
+			d.ReadyPrefix = len(queuedUnit.Chains[0].ChangeSets)
+			d.Priority = r.gerrit.UnitPriority(queuedUnit).String()
+		}
+		d.Attempts = r.getAttempts(queuedUnit)
+		for _, topic := range unit.Topics {
+			if report.TopicIsTruncated(topic) {
+				d.Reasons = append(d.Reasons, &BlockingReason{
+					Code:    ReasonTopicTruncated,
+					Message: fmt.Sprintf("topic %q has more changes than can be fetched, some might be missing", topic),
+				})
+			}
+		}
+		if c := r.getConflict(queuedUnit); c != nil {
+			d.Reasons = append(d.Reasons, &BlockingReason{
+				Code:    ReasonMergeConflict,
+				Message: fmt.Sprintf("change %d can't be rebased on HEAD %.7s without conflicts", c.changeset.Number, c.head),
+			})
+		}
+		isWIPUnit := wipUnit != nil && wipUnit.HasSameChanges(queuedUnit)
+		batchIndex := batchPosition(batch, unit)
+		p, queued := position[queuedUnit]
+		if !queued {
+			p, queued = bisectedPosition[unit.Changesets()[0].ChangeID]
+		}
+		switch {
+		case isWIPUnit:
+			d.Status = UnitStatusInProgress
+			d.Position = 0
+		case batchIndex != -1:
+			d.Status = UnitStatusInProgress
+			d.Position = batchIndex
+		case queued:
+			d.Position = p
+			d.Status = UnitStatusQueued
+			if d.Position == 0 {
+				d.Status = UnitStatusNext
+			} else {
+				d.Reasons = append(d.Reasons, &BlockingReason{
+					Code:    ReasonBehindInQueue,
+					Message: fmt.Sprintf("behind %d other units in the queue", d.Position),
+				})
+			}
+		case unit.AllChangesets(func(c *gerrit.Changeset) bool { return !c.IsAutosubmit() && c.OptInPatchSetNumber() == 0 }):
+			d.Status = UnitStatusIdle
+		default:
+			d.Status = UnitStatusBlocked
+		}
+		diagnoses = append(diagnoses, d)
+	}
+	return diagnoses
+}
+
+// batchPosition returns the position of the first unit of the batch sharing changes with the given unit,
+// or -1 if it's not part of the batch.
+// The client assembles stacked units into a single unit, so this is the bottom-most one.
+func batchPosition(batch []*gerrit.Unit, unit *gerrit.Unit) int {
+	changeIDs := make(map[string]bool)
+	for _, changeset := range unit.Changesets() {
+		changeIDs[changeset.ChangeID] = true
+	}
+	for i, u := range batch {
+		if !u.AllChangesets(func(c *gerrit.Changeset) bool { return !changeIDs[c.ChangeID] }) {
+			return i
+		}
+	}
+	return -1
+}
+
+// reasonMessages returns the messages of the reasons
+func reasonMessages(reasons []*BlockingReason) []string {
+	messages := make([]string, len(reasons))
+	for i, reason := range reasons {
+		messages[i] = reason.Message
+	}
+	return messages
+}
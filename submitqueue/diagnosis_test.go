@@ -0,0 +1,72 @@
+package submitqueue
+
+import (
+	"context"
+	"testing"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiagnose(t *testing.T) {
+	f, c := newFakeGerrit(t)
+	f.addChange(1, "c1", "head", readyVotes())
+	f.addChange(2, "c2", "old", readyVotes())
+	f.addChange(3, "c3", "head", map[string]int{"Autosubmit": 1})
+	f.addChange(4, "c4", "head", nil)
+	outdated := f.addChange(5, "c5", "head", map[string]int{"Verified": 1, "Code-Review": 2})
+	outdated.Revisions["c5"] = goGerrit.RevisionInfo{
+		Number: 2,
+		Commit: goGerrit.CommitInfo{Commit: "c5", Parents: []goGerrit.CommitInfo{{Commit: "head"}}},
+	}
+	outdated.Messages = []goGerrit.ChangeMessageInfo{{
+		Author:         goGerrit.AccountInfo{AccountID: 1},
+		Message:        "Patch Set 1: Autosubmit+1",
+		RevisionNumber: 1,
+	}}
+
+	// a tree forking below 6
+	f.addChange(6, "c6", "head", nil)
+	f.addChange(7, "c7", "c6", readyVotes())
+	f.addChange(8, "c8", "c6", nil)
+
+	r := NewRunner(&log.Logger{Handler: discard.New()}, c)
+	assert.NoError(t, r.Trigger(context.Background(), true))
+
+	diagnoses := make(map[int]*UnitDiagnosis)
+	for _, d := range r.Diagnose() {
+		diagnoses[d.Unit.Chains[0].ChangeSets[0].Number] = d
+	}
+	codes := func(number int) []string {
+		codes := make([]string, 0)
+		for _, reason := range diagnoses[number].AllReasons() {
+			codes = append(codes, reason.Code)
+		}
+		return codes
+	}
+
+	assert.Equal(t, UnitStatusNext, diagnoses[1].Status)
+	assert.Equal(t, 0, diagnoses[1].Position)
+	assert.Empty(t, codes(1))
+
+	assert.Equal(t, UnitStatusQueued, diagnoses[2].Status)
+	assert.Equal(t, 1, diagnoses[2].Position)
+	assert.Equal(t, []string{ReasonBehindInQueue}, codes(2))
+
+	assert.Equal(t, UnitStatusBlocked, diagnoses[3].Status)
+	assert.Equal(t, -1, diagnoses[3].Position)
+	assert.Equal(t, []string{ReasonMissingReview, ReasonCIPending, ReasonNotSubmittable}, codes(3))
+
+	assert.Equal(t, UnitStatusIdle, diagnoses[4].Status)
+
+	assert.Equal(t, UnitStatusBlocked, diagnoses[5].Status, "the owner wants it to be submitted")
+	assert.Equal(t, []string{ReasonOptInOutdated}, codes(5))
+	assert.True(t, diagnoses[5].Contains(5))
+	assert.False(t, diagnoses[5].Contains(1))
+
+	// waiting for the parent the branches share isn't a broken chain
+	assert.Equal(t, UnitStatusBlocked, diagnoses[7].Status)
+	assert.Equal(t, []string{ReasonWaitsForParent}, codes(7))
+}
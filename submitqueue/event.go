@@ -0,0 +1,143 @@
+package submitqueue
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+)
+
+// Event is emitted by the runner on each transition, see Subscribe.
+// It's one of UnitPicked, UnitRebased, CIPassed, CIFailed, CITimedOut, UnitSubmitted and UnitDiscarded.
+// Events are about units, not single chains, as the chains of a unit are always handled together.
+type Event interface {
+	fmt.Stringer
+	// GetUnit returns the unit the event is about
+	GetUnit() *gerrit.Unit
+}
+
+// DiscardReason explains why a unit was discarded
+type DiscardReason string
+
+const (
+	// DiscardHEADMoved means HEAD moved without going through the submit queue while the unit waited for CI
+	DiscardHEADMoved DiscardReason = "head-moved"
+	// DiscardDisappeared means the unit was updated, abandoned or submitted by somebody else
+	DiscardDisappeared DiscardReason = "disappeared"
+	// DiscardCIFailed means the unit failed CI
+	DiscardCIFailed DiscardReason = "ci-failed"
+	// DiscardConflict means the unit can't be rebased on HEAD without conflicts
+	DiscardConflict DiscardReason = "conflict"
+	// DiscardRebaseFailed means gerrit refused to rebase the unit for another reason
+	DiscardRebaseFailed DiscardReason = "rebase-failed"
+	// DiscardSubmitFailed means gerrit refused to submit the unit
+	DiscardSubmitFailed DiscardReason = "submit-failed"
+	// DiscardPreempted means a unit with emergency priority took its place
+	DiscardPreempted DiscardReason = "preempted"
+	// DiscardBisected means the unit failed CI in a batch on top of units still waiting for CI,
+	// or was stacked on top of such a unit, and goes back to the front of the queue to be retested
+	DiscardBisected DiscardReason = "bisected"
+	// DiscardCITimeout means CI didn't report back in time, see SetCITimeout
+	DiscardCITimeout DiscardReason = "ci-timeout"
+	// DiscardNotSubmittable means the unit passed CI, but isn't autosubmittable anymore
+	DiscardNotSubmittable DiscardReason = "not-submittable"
+)
+
+// unitEvent is embedded in all events
+type unitEvent struct {
+	Unit *gerrit.Unit
+}
+
+// GetUnit returns the unit the event is about
+func (e unitEvent) GetUnit() *gerrit.Unit {
+	return e.Unit
+}
+
+// describe formats the event name with the numbers of the unit's changes
+func (e unitEvent) describe(name string, details ...string) string {
+	numbers := make([]string, 0)
+	if e.Unit != nil {
+		for _, changeset := range e.Unit.Changesets() {
+			numbers = append(numbers, fmt.Sprint(changeset.Number))
+		}
+	}
+	return fmt.Sprintf("%s(%s)", name, strings.Join(append([]string{strings.Join(numbers, ",")}, details...), " "))
+}
+
+// UnitPicked is emitted when a queued unit is picked to be submitted next, or stacked on a batch
+type UnitPicked struct{ unitEvent }
+
+func (e *UnitPicked) String() string { return e.describe("UnitPicked") }
+
+// UnitRebased is emitted after a unit was rebased, and CI has to run again
+type UnitRebased struct {
+	unitEvent
+	// Base is the commit the unit was rebased on
+	Base string
+}
+
+func (e *UnitRebased) String() string { return e.describe("UnitRebased") }
+
+// CIPassed is emitted when all changesets of the unit in progress passed CI
+type CIPassed struct{ unitEvent }
+
+func (e *CIPassed) String() string { return e.describe("CIPassed") }
+
+// CIFailed is emitted when a changeset of the unit in progress failed CI
+type CIFailed struct {
+	unitEvent
+	Changeset *gerrit.Changeset
+}
+
+func (e *CIFailed) String() string { return e.describe("CIFailed") }
+
+// CITimedOut is emitted when the unit waited for CI for too long
+type CITimedOut struct {
+	unitEvent
+	// Action is what happens to the unit now
+	Action TimeoutAction
+}
+
+func (e *CITimedOut) String() string { return e.describe("CITimedOut", string(e.Action)) }
+
+// UnitSubmitted is emitted after a unit was submitted
+type UnitSubmitted struct{ unitEvent }
+
+func (e *UnitSubmitted) String() string { return e.describe("UnitSubmitted") }
+
+// UnitDiscarded is emitted when the runner stops working on a unit without submitting it
+type UnitDiscarded struct {
+	unitEvent
+	Reason DiscardReason
+}
+
+func (e *UnitDiscarded) String() string { return e.describe("UnitDiscarded", string(e.Reason)) }
+
+// Subscribe registers a handler called with every event, in the order they happen.
+// Handlers are called synchronously during a run, so they should return quickly.
+// Subscribe before starting the runner.
+func (r *Runner) Subscribe(handler func(Event)) {
+	r.subscribers = append(r.subscribers, handler)
+}
+
+// emit calls the subscribed handlers with the event
+func (r *Runner) emit(event Event) {
+	for _, handler := range r.subscribers {
+		handler(event)
+	}
+}
+
+// recordEvent records the outcome of units in the history, it's subscribed to the runner's events
+func (r *Runner) recordEvent(event Event) {
+	switch e := event.(type) {
+	case *UnitSubmitted:
+		r.recordOutcome(e.Unit, OutcomeSubmitted)
+	case *CIFailed:
+		r.recordOutcome(e.Unit, OutcomeFailedCI)
+	case *UnitDiscarded:
+		// failing CI was recorded already
+		if e.Reason != DiscardCIFailed {
+			r.recordOutcome(e.Unit, OutcomeDiscarded)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package submitqueue
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/apex/log"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+)
+
+// SetKeepOptIn keeps the opt-in votes of units failing CI.
+// By default, they're reset, so the unit isn't picked and rebased again until its owner opts in again.
+// The owner is told about the failure either way.
+func (r *Runner) SetKeepOptIn(keepOptIn bool) {
+	r.keepOptIn = keepOptIn
+}
+
+// reportCIFailure tells the owner of the failing changeset that the unit failed CI on top of the given base,
+// and resets its opt-in votes, unless SetKeepOptIn is set.
+// The base is the leaf of the unit below it in a batch, or nil if it was tested on top of HEAD,
+// no matter whether the submit queue rebased it there.
+func (r *Runner) reportCIFailure(ctx context.Context, unit *gerrit.Unit, failing, base *gerrit.Changeset) {
+	optIn := r.gerrit.GetLabelPolicy().OptIn.Name
+	var message string
+	if base == nil {
+		message = fmt.Sprintf("This change failed CI on top of %s (%.7s): %s\n\n",
+			r.gerrit.GetBranchName(), r.gerrit.GetHEAD(), r.gerrit.GetChangesetURL(failing))
+	} else {
+		message = fmt.Sprintf("This change failed CI on top of change %d (%.7s), which the submit queue tested it with: %s\n\n",
+			base.Number, base.CommitID, r.gerrit.GetChangesetURL(failing))
+	}
+
+	var err error
+	if r.keepOptIn {
+		message += "It stays in the queue, and is tried again."
+		err = r.gerrit.NotifyOwner(ctx, failing, message)
+	} else {
+		message += fmt.Sprintf("%s was reset, please fix it and vote %s again.", optIn, optIn)
+		err = r.gerrit.ResetOptIn(ctx, failing, message)
+	}
+	if err != nil {
+		r.logger.WithFields(log.Fields{
+			"unit":      unit,
+			"changeset": failing,
+		}).WithError(err).Warn("unable to report the CI failure")
+	}
+}
@@ -0,0 +1,218 @@
+package submitqueue
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+)
+
+// fakeGerrit serves the parts of the gerrit REST API the submit queue uses,
+// for a single project "depot" and branch "master".
+type fakeGerrit struct {
+	mu      sync.Mutex
+	head    string
+	changes []*goGerrit.ChangeInfo
+
+	// submitted and rebased record the change numbers of requests, in order
+	submitted []int
+	rebased   []int
+	// failSubmit makes submitting the change with the given number fail with the status code
+	failSubmit map[int]int
+	// failRebase makes rebasing the change with the given number fail with the status code
+	failRebase map[int]int
+	// conflicting changes are reported to not be mergeable
+	conflicting map[int]bool
+	// mergeableChecks counts the mergeability checks
+	mergeableChecks int
+	// messages are the messages posted on each change
+	messages map[int][]string
+	// deletedVotes are the labels votes were deleted from on each change
+	deletedVotes map[int][]string
+	// failDeleteVote makes deleting votes on the change with the given number fail with the status code
+	failDeleteVote map[int]int
+}
+
+// newFakeGerrit returns a fake gerrit, and a client talking to it
+func newFakeGerrit(t *testing.T) (*fakeGerrit, *gerrit.Client) {
+	f := &fakeGerrit{
+		head:        "head",
+		failSubmit:  make(map[int]int),
+		failRebase:  make(map[int]int),
+		conflicting: make(map[int]bool),
+		messages:    make(map[int][]string),
+
+		deletedVotes:   make(map[int][]string),
+		failDeleteVote: make(map[int]int),
+	}
+	server := httptest.NewServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(server.Close)
+
+	c, err := gerrit.NewClient(&log.Logger{Handler: discard.New()}, server.URL, nil, "depot", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, c
+}
+
+// addChange adds an open change with the given label votes, owned by account 1
+func (f *fakeGerrit) addChange(number int, commitID, parentCommitID string, votes map[string]int) *goGerrit.ChangeInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	labels := make(map[string]goGerrit.LabelInfo)
+	for label, value := range votes {
+		labels[label] = goGerrit.LabelInfo{All: []goGerrit.ApprovalInfo{{Value: value}}}
+	}
+	change := &goGerrit.ChangeInfo{
+		ChangeID:        fmt.Sprintf("I%d", number),
+		Number:          number,
+		Project:         "depot",
+		Branch:          "master",
+		Status:          "NEW",
+		Subject:         fmt.Sprintf("change %d", number),
+		Owner:           goGerrit.AccountInfo{AccountID: 1, Name: "owner"},
+		Labels:          labels,
+		Submittable:     votes["Verified"] == 1 && votes["Code-Review"] == 2,
+		CurrentRevision: commitID,
+		Revisions: map[string]goGerrit.RevisionInfo{commitID: {
+			Number: 1,
+			Commit: goGerrit.CommitInfo{Commit: commitID, Parents: []goGerrit.CommitInfo{{Commit: parentCommitID}}},
+		}},
+	}
+	f.changes = append(f.changes, change)
+	return change
+}
+
+// setVotes replaces the label votes of the change with the given number
+func (f *fakeGerrit) setVotes(number int, votes map[string]int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, change := range f.changes {
+		if change.Number != number {
+			continue
+		}
+		change.Labels = make(map[string]goGerrit.LabelInfo)
+		for label, value := range votes {
+			change.Labels[label] = goGerrit.LabelInfo{All: []goGerrit.ApprovalInfo{{Value: value}}}
+		}
+		change.Submittable = votes["Verified"] == 1 && votes["Code-Review"] == 2
+	}
+}
+
+// readyVotes are the votes making a change submittable and opted in
+func readyVotes() map[string]int {
+	return map[string]int{"Verified": 1, "Code-Review": 2, "Autosubmit": 1}
+}
+
+func (f *fakeGerrit) findChange(changeID string) *goGerrit.ChangeInfo {
+	for _, change := range f.changes {
+		if change.ChangeID == changeID {
+			return change
+		}
+	}
+	return nil
+}
+
+func (f *fakeGerrit) writeJSON(w http.ResponseWriter, v interface{}) {
+	data, _ := json.Marshal(v)
+	fmt.Fprintf(w, ")]}'\n%s", data)
+}
+
+func (f *fakeGerrit) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "projects/depot/branches/master":
+		f.writeJSON(w, goGerrit.BranchInfo{Ref: "refs/heads/master", Revision: f.head})
+
+	case path == "changes/":
+		open := make([]*goGerrit.ChangeInfo, 0)
+		for _, change := range f.changes {
+			if change.Status == "NEW" {
+				open = append(open, change)
+			}
+		}
+		f.writeJSON(w, open)
+
+	case len(parts) >= 2 && parts[0] == "changes":
+		change := f.findChange(parts[1])
+		if change == nil {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		switch {
+		case len(parts) == 2:
+			f.writeJSON(w, change)
+		case len(parts) == 3 && parts[2] == "submit":
+			if status, ok := f.failSubmit[change.Number]; ok {
+				http.Error(w, "submit failed", status)
+				return
+			}
+			f.submitted = append(f.submitted, change.Number)
+			change.Status = "MERGED"
+			f.head = change.CurrentRevision
+			f.writeJSON(w, change)
+		case len(parts) == 5 && parts[2] == "revisions" && parts[4] == "mergeable":
+			f.mergeableChecks++
+			f.writeJSON(w, goGerrit.MergeableInfo{Mergeable: !f.conflicting[change.Number]})
+		case len(parts) == 5 && parts[2] == "revisions" && parts[4] == "review":
+			var input goGerrit.ReviewInput
+			_ = json.NewDecoder(r.Body).Decode(&input)
+			f.messages[change.Number] = append(f.messages[change.Number], input.Message)
+			f.writeJSON(w, goGerrit.ReviewResult{})
+		case len(parts) == 7 && parts[2] == "reviewers" && parts[4] == "votes" && parts[6] == "delete":
+			if status, ok := f.failDeleteVote[change.Number]; ok {
+				http.Error(w, "delete vote failed", status)
+				return
+			}
+			label := parts[5]
+			labelInfo := change.Labels[label]
+			all := make([]goGerrit.ApprovalInfo, 0)
+			for _, approval := range labelInfo.All {
+				if fmt.Sprint(approval.AccountID) != parts[3] {
+					all = append(all, approval)
+				}
+			}
+			labelInfo.All = all
+			change.Labels[label] = labelInfo
+			f.deletedVotes[change.Number] = append(f.deletedVotes[change.Number], label)
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 3 && parts[2] == "rebase":
+			if status, ok := f.failRebase[change.Number]; ok {
+				http.Error(w, "rebase failed", status)
+				return
+			}
+			var input goGerrit.RebaseInput
+			_ = json.NewDecoder(r.Body).Decode(&input)
+			f.rebased = append(f.rebased, change.Number)
+			revision := change.Revisions[change.CurrentRevision]
+			commitID := fmt.Sprintf("%s-r%d", change.CurrentRevision, revision.Number+1)
+			change.CurrentRevision = commitID
+			change.Revisions = map[string]goGerrit.RevisionInfo{commitID: {
+				Number: revision.Number + 1,
+				Commit: goGerrit.CommitInfo{Commit: commitID, Parents: []goGerrit.CommitInfo{{Commit: input.Base}}},
+			}}
+			// CI needs to run again
+			delete(change.Labels, "Verified")
+			change.Submittable = false
+			f.writeJSON(w, change)
+		default:
+			http.NotFound(w, r)
+		}
+
+	default:
+		http.NotFound(w, r)
+	}
+}
@@ -0,0 +1,73 @@
+package submitqueue
+
+import (
+	"time"
+
+	"github.com/apex/log"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+)
+
+// maxPreemptions is the number of preemptions kept for the frontend
+const maxPreemptions = 50
+
+// Preemption records a wipUnit that was put back in the queue for a unit with emergency priority
+type Preemption struct {
+	Time      time.Time
+	Preempted *gerrit.Unit
+	By        *gerrit.Unit
+}
+
+// SetEmergencyPreemption allows units with emergency priority to preempt the wipUnit
+// while it's waiting for CI. The preempted unit is put back in the queue.
+func (r *Runner) SetEmergencyPreemption(enabled bool) {
+	r.emergencyPreemption = enabled
+}
+
+// GetPreemptions returns the most recent preemptions, oldest first.
+// Acquires a lock, so check with IsCurrentlyRunning first
+func (r *Runner) GetPreemptions() []*Preemption {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return append([]*Preemption{}, r.preemptions...)
+}
+
+// findPreemptingUnit returns a queued unit with emergency priority, which should replace the wipUnit,
+// or nil if there's none, or preemption is disabled.
+// A wipUnit with emergency priority itself is never preempted,
+// and units that were skipped during this run don't preempt it, as they'd be skipped again.
+func (r *Runner) findPreemptingUnit(report *gerrit.AssemblyReport, skippedUnits map[*gerrit.Unit]bool) *gerrit.Unit {
+	if !r.emergencyPreemption || r.gerrit.UnitPriority(r.wipUnit) >= gerrit.PriorityEmergency {
+		return nil
+	}
+	for _, unit := range r.queuedUnits(report) {
+		if r.gerrit.UnitPriority(unit) < gerrit.PriorityEmergency {
+			// queued units are ordered by priority, so there are no more emergencies
+			return nil
+		}
+		if !skippedUnits[unit] && !unit.HasSameChanges(r.wipUnit) {
+			return unit
+		}
+	}
+	return nil
+}
+
+// preempt discards the wipUnit in favor of the given unit, and records it
+func (r *Runner) preempt(by *gerrit.Unit) {
+	r.logger.WithFields(log.Fields{
+		"wipUnit": r.wipUnit,
+		"by":      by,
+	}).Warn("preempting wipUnit for a unit with emergency priority, putting it back in the queue")
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.preemptions = append(r.preemptions, &Preemption{
+		Time:      time.Now(),
+		Preempted: r.wipUnit,
+		By:        by,
+	})
+	if len(r.preemptions) > maxPreemptions {
+		r.preemptions = r.preemptions[len(r.preemptions)-maxPreemptions:]
+	}
+	r.wipUnit = nil
+}
@@ -0,0 +1,62 @@
+package submitqueue
+
+import (
+	"github.com/flokli/gerrit-queue/gerrit"
+)
+
+// SetSubmitReadyPrefix enables submitting the longest ready prefix of chains that aren't ready as a whole.
+// The rest of the chain stays queued, and is submitted once it's ready as well.
+func (r *Runner) SetSubmitReadyPrefix(enabled bool) {
+	r.submitReadyPrefix = enabled
+}
+
+// isReady returns true if a changeset could be autosubmitted, see isAutoSubmittable
+func isReady(c *gerrit.Changeset) bool {
+	return c.IsSubmittable() && c.IsAutosubmit() && !c.IsWorkInProgress()
+}
+
+// updateCandidates collects the units that might be picked during this run, in the order of the client.
+// If submitting ready prefixes is enabled, units that aren't autosubmittable as a whole
+// are replaced by their ready prefix, if they have one.
+// Each changeset is part of exactly one chain, so prefixes of different units never overlap.
+// This is done once per refresh, so the prefixes stay the same units during a run.
+func (r *Runner) updateCandidates() {
+	units := r.gerrit.FilterUnits(func(u *gerrit.Unit) bool { return true })
+	r.prefixes = make(map[*gerrit.Unit]*gerrit.Unit)
+	if !r.submitReadyPrefix {
+		r.candidates = units
+		return
+	}
+
+	r.candidates = make([]*gerrit.Unit, 0, len(units))
+	for _, unit := range units {
+		prefix := unit.ReadyPrefix(isReady)
+		if prefix == nil {
+			r.candidates = append(r.candidates, unit)
+			continue
+		}
+		r.prefixes[unit] = prefix
+		r.candidates = append(r.candidates, prefix)
+	}
+}
+
+// findUnit returns the candidate consisting of the same changes as the given unit.
+// If submitting ready prefixes is enabled, this can also be the prefix of a longer unit,
+// which is the case for a prefix that was rebased, and waits for CI.
+func (r *Runner) findUnit(unit *gerrit.Unit) *gerrit.Unit {
+	for _, candidate := range r.candidates {
+		if candidate.HasSameChanges(unit) {
+			return candidate
+		}
+	}
+	if !r.submitReadyPrefix || unit.IsTopic() || len(unit.Chains) != 1 {
+		return nil
+	}
+	n := len(unit.Chains[0].ChangeSets)
+	for _, u := range r.gerrit.FilterUnits(func(u *gerrit.Unit) bool { return true }) {
+		if prefix := u.Prefix(n); prefix != nil && prefix.HasSameChanges(unit) {
+			return prefix
+		}
+	}
+	return nil
+}
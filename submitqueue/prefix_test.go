@@ -0,0 +1,52 @@
+package submitqueue
+
+import (
+	"context"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubmitReadyPrefix(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		f, c := newFakeGerrit(t)
+		f.addChange(1, "c1", "old", readyVotes())
+		f.addChange(2, "c2", "c1", readyVotes())
+		f.addChange(3, "c3", "c2", map[string]int{"Verified": 1, "Code-Review": 2})
+
+		r := NewRunner(&log.Logger{Handler: discard.New()}, c)
+		r.SetSubmitReadyPrefix(enabled)
+		assert.NoError(t, r.Trigger(context.Background(), false))
+
+		if !enabled {
+			assert.Empty(t, f.rebased, "the chain isn't ready as a whole")
+			continue
+		}
+		// only the ready prefix is rebased
+		assert.Equal(t, []int{1, 2}, f.rebased)
+		diagnoses := r.Diagnose()
+		if assert.Len(t, diagnoses, 1) {
+			assert.Equal(t, UnitStatusInProgress, diagnoses[0].Status)
+			assert.Equal(t, 2, diagnoses[0].ReadyPrefix)
+			// the rest of the chain is still blocked
+			reasons := diagnoses[0].Chains[0].Changesets[2].Reasons
+			if assert.Len(t, reasons, 1) {
+				assert.Equal(t, ReasonNotOptedIn, reasons[0].Code)
+			}
+		}
+
+		// once CI passed, the prefix is submitted, and the rest stays
+		f.setVotes(1, readyVotes())
+		f.setVotes(2, readyVotes())
+		assert.NoError(t, r.Trigger(context.Background(), false))
+		assert.Equal(t, []int{1, 2}, f.submitted)
+		assert.Nil(t, r.GetWIPUnit())
+
+		// the rest is picked once it's ready
+		f.setVotes(3, readyVotes())
+		assert.NoError(t, r.Trigger(context.Background(), false))
+		assert.Equal(t, []int{1, 2, 3}, f.rebased)
+	}
+}
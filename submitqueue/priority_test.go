@@ -0,0 +1,86 @@
+package submitqueue
+
+import (
+	"context"
+	"testing"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+)
+
+func TestPriority(t *testing.T) {
+	f, c := newFakeGerrit(t)
+	f.addChange(1, "c1", "head", readyVotes())
+	hotfix := f.addChange(2, "c2", "old", readyVotes())
+	hotfix.Hashtags = []string{"queue-priority"}
+
+	r := NewRunner(&log.Logger{Handler: discard.New()}, c)
+	assert.NoError(t, r.Trigger(context.Background(), false))
+
+	// the hotfix is picked, even though it needs a rebase
+	assert.Equal(t, []int{2}, f.rebased)
+	assert.Empty(t, f.submitted)
+	if assert.NotNil(t, r.GetWIPUnit()) {
+		assert.Equal(t, gerrit.PriorityHigh, c.UnitPriority(r.GetWIPUnit()))
+	}
+}
+
+func TestPreemption(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		f, c := newFakeGerrit(t)
+		f.addChange(1, "c1", "old", readyVotes())
+
+		r := NewRunner(&log.Logger{Handler: discard.New()}, c)
+		r.SetEmergencyPreemption(enabled)
+		assert.NoError(t, r.Trigger(context.Background(), false))
+		// change 1 is rebased, and waits for CI
+		assert.Equal(t, []int{1}, f.rebased)
+
+		emergency := f.addChange(2, "c2", "head", readyVotes())
+		emergency.Hashtags = []string{"queue-emergency"}
+		assert.NoError(t, r.Trigger(context.Background(), false))
+
+		if !enabled {
+			assert.Empty(t, f.submitted, "waits for the wipUnit")
+			assert.Empty(t, r.GetPreemptions())
+			continue
+		}
+		assert.Equal(t, []int{2}, f.submitted, "preempts the wipUnit")
+		preemptions := r.GetPreemptions()
+		if assert.Len(t, preemptions, 1) {
+			assert.Equal(t, 1, preemptions[0].Preempted.Chains[0].ChangeSets[0].Number)
+			assert.Equal(t, 2, preemptions[0].By.Chains[0].ChangeSets[0].Number)
+		}
+		// change 1 is back in the queue, once CI passed it's rebased again
+		assert.Nil(t, r.GetWIPUnit())
+		f.setVotes(1, readyVotes())
+		assert.NoError(t, r.Trigger(context.Background(), false))
+		assert.Equal(t, []int{1, 1}, f.rebased)
+	}
+}
+
+func TestPreemptionSkipped(t *testing.T) {
+	f, c := newFakeGerrit(t)
+	f.addChange(1, "c1", "head", readyVotes())
+	f.addChange(2, "c2", "old", readyVotes()).Hashtags = []string{"queue-emergency"}
+
+	r := NewRunner(&log.Logger{Handler: discard.New()}, c)
+	r.SetEmergencyPreemption(true)
+	assert.NoError(t, r.Trigger(context.Background(), true))
+	report := c.GetAssemblyReport()
+	var emergency *gerrit.Unit
+	for _, unit := range r.queuedUnits(report) {
+		if unit.Changesets()[0].Number == 1 {
+			r.wipUnit = unit
+		} else {
+			emergency = unit
+		}
+	}
+
+	assert.Equal(t, emergency, r.findPreemptingUnit(report, map[*gerrit.Unit]bool{}))
+	// it failed to rebase during this run, so it'd fail again
+	assert.Nil(t, r.findPreemptingUnit(report, map[*gerrit.Unit]bool{emergency: true}))
+}
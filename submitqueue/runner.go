@@ -1,48 +1,231 @@
 package submitqueue
 
 import (
+	"context"
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/apex/log"
 
 	"github.com/flokli/gerrit-queue/gerrit"
+	"github.com/flokli/gerrit-queue/store"
 )
 
 // Runner is a struct existing across the lifetime of a single run of the submit queue
 // it contains a mutex to avoid being run multiple times.
 // In fact, it even cancels runs while another one is still in progress.
 // It contains a Gerrit object facilitating access, a log object, the configured submit queue tag
-// and a `wipChain` (only populated if waiting for a rebase)
+// and a `wipUnit` (only populated if waiting for a rebase).
+// Each run steps through the states of the runner, see State, and emits an Event on each transition.
 type Runner struct {
 	mut              sync.Mutex
 	currentlyRunning bool
-	wipChain         *gerrit.Chain
+	state            State
+	wipUnit          *gerrit.Unit
 	logger           *log.Logger
 	gerrit           *gerrit.Client
+
+	// subscribers are called with every event, see Subscribe
+	subscribers []func(Event)
+
+	// triggerCh holds a pending trigger request, see RequestTrigger
+	triggerCh chan struct{}
+
+	// submitReadyPrefix enables submitting the ready prefix of a chain, see SetSubmitReadyPrefix
+	submitReadyPrefix bool
+	// candidates are the units that might be picked during this run, see updateCandidates.
+	// prefixes maps units of the client to the ready prefix replacing them.
+	candidates []*gerrit.Unit
+	prefixes   map[*gerrit.Unit]*gerrit.Unit
+
+	// conflicts are the units known to conflict with HEAD, by unitKey
+	conflicts map[string]*conflict
+
+	// maxBatchSize enables speculative batching, see SetBatchSize.
+	// batch are the units stacked on HEAD waiting for CI, bottom first.
+	// bisected are the units dropped from a batch to be retested, in the order they're picked again, see bisectBatch.
+	maxBatchSize int
+	batch        []*gerrit.Unit
+	bisected     []*gerrit.Unit
+
+	// store persists the state below, and the wipUnit, batch and bisected units, see SetStateStore.
+	// restored is set once the state was restored on the first run.
+	store    store.Store
+	restored bool
+	// attempts counts how often units were rebased, by changesKey
+	attempts map[string]int
+	// history records what happened to the most recently picked units, see GetHistory
+	history []*HistoryEntry
+	// rebasedCommits are the commits of changes rebased during the current run, by change ID
+	rebasedCommits map[string]string
+
+	// ciTimeout limits how long to wait for CI, see SetCITimeout.
+	// waitingSince is when the wipUnit or batch started waiting, and rechecked is set once CI was asked to run again.
+	ciTimeout       time.Duration
+	ciTimeoutAction TimeoutAction
+	recheckMessage  string
+	waitingSince    time.Time
+	rechecked       bool
+	// requeued are the change IDs of units that timed out, and go to the back of the queue
+	requeued map[string]bool
+
+	// keepOptIn keeps the opt-in votes of units failing CI, see SetKeepOptIn
+	keepOptIn bool
+
+	// emergencyPreemption allows units with emergency priority to preempt the wipUnit
+	emergencyPreemption bool
+	// preemptions are the most recent preemptions, see GetPreemptions
+	preemptions []*Preemption
 }
 
 // NewRunner creates a new Runner struct
 func NewRunner(logger *log.Logger, gerrit *gerrit.Client) *Runner {
-	return &Runner{
-		logger: logger,
-		gerrit: gerrit,
+	r := &Runner{
+		logger:    logger,
+		gerrit:    gerrit,
+		triggerCh: make(chan struct{}, 1),
+		conflicts: make(map[string]*conflict),
+		attempts:  make(map[string]int),
+		requeued:  make(map[string]bool),
+	}
+	r.Subscribe(r.recordEvent)
+	r.Subscribe(r.forgetRequeued)
+	r.Subscribe(r.forgetBisected)
+	return r
+}
+
+// RequestTrigger asks Run to trigger as soon as possible.
+// It doesn't block, and multiple requests before the next run are coalesced.
+func (r *Runner) RequestTrigger() {
+	select {
+	case r.triggerCh <- struct{}{}:
+	default:
+	}
+}
+
+// Run triggers the runner every interval, and whenever requested through RequestTrigger,
+// until the context is cancelled.
+// Triggers are serialized, so there's always at most one run in progress.
+func (r *Runner) Run(ctx context.Context, interval time.Duration, fetchOnly bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-r.triggerCh:
+		}
+		err := r.Trigger(ctx, fetchOnly)
+		if err != nil {
+			r.logger.Error(err.Error())
+		}
 	}
 }
 
 // isAutoSubmittable determines if something could be autosubmitted, potentially requiring a rebase
 // for this, it needs to:
 //   - have the "Autosubmit" label set to +1
-//   - have gerrit's 'submittable' field set to true
+//   - be submittable (all submit requirements satisfied, or gerrit's 'submittable' field set to true)
+//   - not be work in progress
+//
+// it doesn't check if the unit is rebased on HEAD.
+// For topics, this applies to all changesets in the topic, including the ones in other projects.
+func (r *Runner) isAutoSubmittable(u *gerrit.Unit) bool {
+	return u.AllChangesets(isReady)
+}
+
+// logBlockedUnits explains why units somebody asked to autosubmit can't be submitted
+func (r *Runner) logBlockedUnits() {
+	blockedUnits := r.gerrit.FilterUnits(func(u *gerrit.Unit) bool {
+		return !r.isAutoSubmittable(u) && !u.AllChangesets(func(c *gerrit.Changeset) bool {
+			return !c.IsAutosubmit()
+		})
+	})
+	report := r.gerrit.GetAssemblyReport()
+	for _, unit := range blockedUnits {
+		for _, changeset := range unit.Changesets() {
+			if d := r.diagnoseChangeset(changeset, report); len(d.Reasons) != 0 {
+				r.logger.WithFields(log.Fields{
+					"unit":      unit,
+					"changeset": changeset,
+					"reasons":   reasonMessages(d.Reasons),
+				}).Info("changeset blocks unit from being submitted")
+			}
+		}
+	}
+
+	unrebaseableUnits := r.gerrit.FilterUnits(func(u *gerrit.Unit) bool {
+		return r.isAutoSubmittable(u) && !r.gerrit.UnitCanBeRebased(u)
+	})
+	for _, unit := range unrebaseableUnits {
+		r.logger.WithField("unit", unit).Info("unit contains merge commits, which need to be based on HEAD by their owner")
+	}
+
+	for _, unit := range r.candidates {
+		if c := r.getConflict(unit); c != nil {
+			r.logger.WithFields(log.Fields{
+				"unit":      unit,
+				"changeset": c.changeset,
+			}).Info("unit conflicts with HEAD, waiting for it to be updated")
+		}
+	}
+
+	invalidUnits := r.gerrit.FilterUnits(func(u *gerrit.Unit) bool {
+		return r.isAutoSubmittable(u) && !report.UnitIsValid(u)
+	})
+	for _, unit := range invalidUnits {
+		r.logger.WithField("unit", unit).Warn("unit failed the integrity check, not picking it")
+	}
+}
+
+// queuedUnits returns the units that can be picked, in the order they're picked.
+// Such a unit:
+//   - has the auto-submit label
+//   - has +2 review
+//   - has +1 CI
+//   - doesn't drag other changes along when submitted
+//   - passed the integrity check
+//   - doesn't wait for a parent change other chains are based on as well
+//   - is rebased on HEAD, or can be rebased (doesn't contain merge commits we're not allowed to rebase,
+//     and isn't known to conflict with HEAD)
 //
-// it doesn't check if the chain is rebased on HEAD
-func (r *Runner) isAutoSubmittable(s *gerrit.Chain) bool {
-	for _, c := range s.ChangeSets {
-		if !c.Submittable || !c.IsAutosubmit() {
-			return false
+// Units dropped from a batch to be retested come first, they don't need +1 CI, see bisectBatch.
+// Units with a higher priority come first. Among units of the same priority,
+// units that timed out waiting for CI come last, see TimeoutRequeue,
+// and the ones not requiring a rebase come first, otherwise the order of the strategy is kept.
+// Units are taken from the candidates, so they can be ready prefixes of longer units.
+func (r *Runner) queuedUnits(report *gerrit.AssemblyReport) []*gerrit.Unit {
+	isQueued := func(u *gerrit.Unit) bool {
+		return r.isAutoSubmittable(u) && len(u.ForeignSubmittedTogether()) == 0 && report.UnitIsValid(u) &&
+			!report.UnitIsWaiting(u) && r.getConflict(u) == nil && !r.inBatch(u) && !r.isBisected(u)
+	}
+	queued := make([]*gerrit.Unit, 0)
+	for _, u := range r.bisected {
+		if r.getConflict(u) == nil && u.AllChangesets(isOptedIn) {
+			queued = append(queued, u)
+		}
+	}
+	for _, u := range r.candidates {
+		if isQueued(u) && r.gerrit.UnitIsRebasedOnHEAD(u) {
+			queued = append(queued, u)
+		}
+	}
+	for _, u := range r.candidates {
+		if isQueued(u) && !r.gerrit.UnitIsRebasedOnHEAD(u) && r.gerrit.UnitCanBeRebased(u) {
+			queued = append(queued, u)
 		}
 	}
-	return true
+	sort.SliceStable(queued, func(i, j int) bool {
+		pi, pj := r.gerrit.UnitPriority(queued[i]), r.gerrit.UnitPriority(queued[j])
+		if pi != pj {
+			return pi > pj
+		}
+		return !r.isRequeued(queued[i]) && r.isRequeued(queued[j])
+	})
+	return queued
 }
 
 // IsCurrentlyRunning returns true if the runner is currently running
@@ -50,22 +233,61 @@ func (r *Runner) IsCurrentlyRunning() bool {
 	return r.currentlyRunning
 }
 
-// GetWIPChain returns the current wipChain, if any, nil otherwiese
+// GetWIPUnit returns the current wipUnit, if any, nil otherwiese
 // Acquires a lock, so check with IsCurrentlyRunning first
-func (r *Runner) GetWIPChain() *gerrit.Chain {
+func (r *Runner) GetWIPUnit() *gerrit.Unit {
 	r.mut.Lock()
 	defer func() {
 		r.mut.Unlock()
 	}()
-	return r.wipChain
+	return r.wipUnit
+}
+
+// submitUnit submits all changesets of a unit.
+// Topics are submitted by submitting a single changeset, gerrit submits the whole topic with it.
+func (r *Runner) submitUnit(ctx context.Context, u *gerrit.Unit) error {
+	if u.IsTopic() {
+		chain := u.Chains[0]
+		_, err := r.gerrit.SubmitChangeset(ctx, chain.ChangeSets[len(chain.ChangeSets)-1])
+		return err
+	}
+	for _, changeset := range u.Chains[0].ChangeSets {
+		_, err := r.gerrit.SubmitChangeset(ctx, changeset)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebaseChain rebases the changesets of a chain on top of each other, starting at base.
+// It returns the commit ID of the rebased leaf, or the changeset that failed to be rebased.
+func (r *Runner) rebaseChain(ctx context.Context, chain *gerrit.Chain, base string) (string, *gerrit.Changeset, error) {
+	for _, changeset := range chain.ChangeSets {
+		// gerrit refuses to rebase changesets that are already up to date,
+		// like the beginning of a chain with outdated dependencies further up.
+		// Merge commits are up to date if their first parent is.
+		if len(changeset.ParentCommitIDs) != 0 && changeset.ParentCommitIDs[0] == base {
+			base = changeset.CommitID
+			continue
+		}
+		rebased, err := r.gerrit.RebaseChangeset(ctx, changeset, base)
+		if err != nil {
+			return "", changeset, err
+		}
+		r.rebasedCommits[changeset.ChangeID] = rebased.CommitID
+		base = rebased.CommitID
+	}
+	return base, nil, nil
 }
 
 // Trigger gets triggered periodically
-func (r *Runner) Trigger(fetchOnly bool) error {
-	// TODO: If CI fails, remove the auto-submit labels => rules.pl
+// Cancelling the context aborts the run, including in-flight requests to gerrit.
+func (r *Runner) Trigger(ctx context.Context, fetchOnly bool) error {
 	// Only one trigger can run at the same time
 	r.mut.Lock()
 	if r.currentlyRunning {
+		r.mut.Unlock()
 		return fmt.Errorf("already running, skipping")
 	}
 	r.currentlyRunning = true
@@ -77,143 +299,69 @@ func (r *Runner) Trigger(fetchOnly bool) error {
 	}()
 
 	// Prepare the work by creating a local cache of gerrit state
-	err := r.gerrit.Refresh()
+	err := r.gerrit.Refresh(ctx)
 	if err != nil {
 		return err
 	}
+	r.updateCandidates()
+	r.pruneConflicts()
+	if !r.restored {
+		r.restoreState()
+		r.restored = true
+	}
 
 	// early return if we only want to fetch
 	if fetchOnly {
 		return nil
 	}
 
-	if r.wipChain != nil {
-		// refresh wipChain with how it looks like in gerrit now
-		wipChain := r.gerrit.FindFirstChain(func(s *gerrit.Chain) bool {
-			// the new wipChain needs to have the same number of changesets
-			if len(r.wipChain.ChangeSets) != len(s.ChangeSets) {
-				return false
-			}
-			// … and the same ChangeIDs.
-			for idx, c := range s.ChangeSets {
-				if r.wipChain.ChangeSets[idx].ChangeID != c.ChangeID {
-					return false
-				}
-			}
-			return true
-		})
-		if wipChain == nil {
-			r.logger.WithField("wipChain", r.wipChain).Warn("wipChain has disappeared")
-			r.wipChain = nil
+	r.pruneAttempts()
+	r.pruneRequeued()
+	r.rebasedCommits = make(map[string]string)
+	defer r.saveState()
+
+	if r.wipUnit != nil {
+		// refresh wipUnit with how it looks like in gerrit now.
+		// It needs to consist of the same changes.
+		wipUnit := r.findUnit(r.wipUnit)
+		if wipUnit == nil {
+			r.logger.WithField("wipUnit", r.wipUnit).Warn("wipUnit has disappeared")
+			r.discardWIPUnit(DiscardDisappeared)
 		} else {
-			r.wipChain = wipChain
+			r.wipUnit = wipUnit
 		}
 	}
+	if len(r.batch) != 0 {
+		r.refreshBatch()
+	}
+	r.refreshBisected()
 
+	run := &run{
+		skippedUnits:     make(map[*gerrit.Unit]bool),
+		submittedChanges: make(map[string]bool),
+		report:           r.gerrit.GetAssemblyReport(),
+	}
+	r.setState(r.restingState())
+	r.logger.WithField("state", r.state).Info("Running")
 	for {
-		// initialize logger
-		r.logger.Info("Running")
-		if r.wipChain != nil {
-			// if we have a wipChain
-			l := r.logger.WithField("wipChain", r.wipChain)
-			l.Info("Checking wipChain")
-
-			// discard wipChain not rebased on HEAD
-			// we rebase them at the end of the loop, so this means master advanced without going through the submit queue
-			if !r.gerrit.ChainIsRebasedOnHEAD(r.wipChain) {
-				l.Warnf("HEAD has moved to %v while still waiting for wipChain, discarding it", r.gerrit.GetHEAD())
-				r.wipChain = nil
-				continue
-			}
-
-			// we now need to check CI feedback:
-			// wipChain might have failed CI in the meantime
-			for _, c := range r.wipChain.ChangeSets {
-				if c == nil {
-					l.Error("BUG: changeset is nil")
-					continue
-				}
-				if c.Verified < 0 {
-					l.WithField("failingChangeset", c).Warnf("wipChain failed CI in the meantime, discarding.")
-					r.wipChain = nil
-					continue
-				}
-			}
-
-			// it might still be waiting for CI
-			for _, c := range r.wipChain.ChangeSets {
-				if c == nil {
-					l.Error("BUG: changeset is nil")
-					continue
-				}
-				if c.Verified == 0 {
-					l.WithField("pendingChangeset", c).Warnf("still waiting for CI feedback in wipChain, going back to sleep.")
-					// break the loop, take a look at it at the next trigger.
-					return nil
-				}
-			}
-
-			// it might be autosubmittable
-			if r.isAutoSubmittable(r.wipChain) {
-				l.Infof("submitting wipChain")
-				// if the WIP changeset is ready (auto submittable and rebased on HEAD), submit
-				for _, changeset := range r.wipChain.ChangeSets {
-					_, err := r.gerrit.SubmitChangeset(changeset)
-					if err != nil {
-						l.WithField("changeset", changeset).Error("error submitting changeset")
-						r.wipChain = nil
-						return err
-					}
-				}
-				r.wipChain = nil
-			} else {
-				l.Error("BUG: wipChain is not autosubmittable")
-				r.wipChain = nil
-			}
+		if err := ctx.Err(); err != nil {
+			r.logger.Warn("aborting run")
+			return err
 		}
-
-		r.logger.Info("Looking for chains ready to submit")
-		// Find chain, that:
-		//  * has the auto-submit label
-		//  * has +2 review
-		//  * has +1 CI
-		//  * is rebased on master
-		chain := r.gerrit.FindFirstChain(func(s *gerrit.Chain) bool {
-			return r.isAutoSubmittable(s) && s.ChangeSets[0].ParentCommitIDs[0] == r.gerrit.GetHEAD()
-		})
-		if chain != nil {
-			r.logger.WithField("chain", chain).Info("Found chain to submit without necessary rebase")
-			r.wipChain = chain
-			continue
+		next, done, err := r.step(ctx, r.state, run)
+		if next != r.state {
+			r.logger.WithFields(log.Fields{
+				"from": r.state,
+				"to":   next,
+			}).Debug("state transition")
 		}
-
-		// Find chain, that:
-		//  * has the auto-submit label
-		//  * has +2 review
-		//  * has +1 CI
-		//  * is NOT rebased on master
-		chain = r.gerrit.FindFirstChain(r.isAutoSubmittable)
-		if chain == nil {
-			r.logger.Info("no more submittable chain found, going back to sleep.")
-			break
+		r.setState(next)
+		if err != nil {
+			return err
 		}
-
-		l := r.logger.WithField("chain", chain)
-		l.Info("found chain, which needs a rebase")
-		// TODO: move into Client.RebaseChangeset function
-		head := r.gerrit.GetHEAD()
-		for _, changeset := range chain.ChangeSets {
-			changeset, err := r.gerrit.RebaseChangeset(changeset, head)
-			if err != nil {
-				l.Error(err.Error())
-				return err
-			}
-			head = changeset.CommitID
+		if done {
+			break
 		}
-		// we don't need to care about updating the rebased changesets or getting the updated HEAD,
-		// as we'll refetch it on the beginning of the next trigger anyways
-		r.wipChain = chain
-		break
 	}
 
 	r.logger.Info("Run complete")
@@ -0,0 +1,291 @@
+package submitqueue
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+	"github.com/flokli/gerrit-queue/store"
+)
+
+// stateVersion is increased whenever the persisted state changes incompatibly.
+// State of another version is ignored.
+const stateVersion = 1
+
+// maxHistory is the number of history entries kept
+const maxHistory = 100
+
+const (
+	// OutcomeSubmitted means the unit passed CI, and was submitted
+	OutcomeSubmitted = "submitted"
+	// OutcomeFailedCI means the unit failed CI after being picked
+	OutcomeFailedCI = "failed-ci"
+	// OutcomeDiscarded means the unit was dropped while waiting for CI, because HEAD moved or it was updated
+	OutcomeDiscarded = "discarded"
+)
+
+// HistoryEntry records what happened to a unit the runner picked
+type HistoryEntry struct {
+	Time time.Time `json:"time"`
+	// Changes are the numbers of the unit's changes
+	Changes []int  `json:"changes"`
+	Outcome string `json:"outcome"`
+}
+
+// persistedChange is a change of a persisted unit, with the commit it's expected to be at
+type persistedChange struct {
+	ChangeID string `json:"changeId"`
+	Number   int    `json:"number"`
+	CommitID string `json:"commitId"`
+}
+
+// persistedUnit is a unit, as its chains of changes
+type persistedUnit struct {
+	Chains [][]persistedChange `json:"chains"`
+}
+
+// persistedState is the state of the runner surviving restarts
+type persistedState struct {
+	Version  int              `json:"version"`
+	WIPUnit  *persistedUnit   `json:"wipUnit,omitempty"`
+	Batch    []*persistedUnit `json:"batch,omitempty"`
+	Attempts map[string]int   `json:"attempts,omitempty"`
+	History  []*HistoryEntry  `json:"history,omitempty"`
+
+	// WaitingSince is when the wipUnit or batch started waiting for CI, see SetCITimeout
+	WaitingSince time.Time `json:"waitingSince"`
+	Rechecked    bool      `json:"rechecked,omitempty"`
+	// Requeued are the change IDs of units moved to the back of the queue
+	Requeued []string `json:"requeued,omitempty"`
+	// Bisected are the units split off a batch to be retested
+	Bisected []*persistedUnit `json:"bisected,omitempty"`
+}
+
+// SetStateStore persists the state of the runner in the given store, and restores it on the first run.
+// Multiple runners can share a store, as the state is saved under the runner's project and branch.
+func (r *Runner) SetStateStore(s store.Store) {
+	r.store = s
+}
+
+// GetHistory returns what happened to the most recently picked units, oldest first.
+// Acquires a lock, so check with IsCurrentlyRunning first
+func (r *Runner) GetHistory() []*HistoryEntry {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return append([]*HistoryEntry{}, r.history...)
+}
+
+// recordOutcome adds an entry for the unit to the history
+func (r *Runner) recordOutcome(unit *gerrit.Unit, outcome string) {
+	entry := &HistoryEntry{
+		Time:    time.Now(),
+		Changes: make([]int, 0),
+		Outcome: outcome,
+	}
+	for _, changeset := range unit.Changesets() {
+		entry.Changes = append(entry.Changes, changeset.Number)
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.history = append(r.history, entry)
+	if len(r.history) > maxHistory {
+		r.history = r.history[len(r.history)-maxHistory:]
+	}
+}
+
+// changesKey identifies a unit by its changes, no matter which patchsets they're at
+func changesKey(unit *gerrit.Unit) string {
+	changesets := unit.Changesets()
+	changeIDs := make([]string, len(changesets))
+	for i, changeset := range changesets {
+		changeIDs[i] = changeset.ChangeID
+	}
+	sort.Strings(changeIDs)
+	return strings.Join(changeIDs, ",")
+}
+
+// countAttempt records that the unit was rebased by the runner once more
+func (r *Runner) countAttempt(unit *gerrit.Unit) {
+	r.attempts[changesKey(unit)]++
+}
+
+// getAttempts returns how often the unit was rebased by the runner
+func (r *Runner) getAttempts(unit *gerrit.Unit) int {
+	return r.attempts[changesKey(unit)]
+}
+
+// pruneAttempts forgets about the attempts of units whose changes are all gone
+func (r *Runner) pruneAttempts() {
+	changesets := r.changesetsByChangeID()
+	for key := range r.attempts {
+		gone := true
+		for _, changeID := range strings.Split(key, ",") {
+			if _, ok := changesets[changeID]; ok {
+				gone = false
+				break
+			}
+		}
+		if gone {
+			delete(r.attempts, key)
+		}
+	}
+}
+
+// changesetsByChangeID returns all changesets of the client by their change ID
+func (r *Runner) changesetsByChangeID() map[string]*gerrit.Changeset {
+	changesets := make(map[string]*gerrit.Changeset)
+	for _, unit := range r.gerrit.FilterUnits(func(u *gerrit.Unit) bool { return true }) {
+		for _, changeset := range unit.Changesets() {
+			changesets[changeset.ChangeID] = changeset
+		}
+	}
+	return changesets
+}
+
+// stateKey is the key the state of the runner is saved under
+func (r *Runner) stateKey() string {
+	return r.gerrit.GetProjectName() + ":" + r.gerrit.GetBranchName()
+}
+
+// persistUnit converts a unit for persisting it.
+// Changesets rebased during this run are expected to be at their rebased commit,
+// as units aren't reassembled after a rebase.
+func (r *Runner) persistUnit(unit *gerrit.Unit) *persistedUnit {
+	p := &persistedUnit{}
+	for _, chain := range unit.Chains {
+		changes := make([]persistedChange, 0, len(chain.ChangeSets))
+		for _, changeset := range chain.ChangeSets {
+			commitID := changeset.CommitID
+			if rebased, ok := r.rebasedCommits[changeset.ChangeID]; ok {
+				commitID = rebased
+			}
+			changes = append(changes, persistedChange{
+				ChangeID: changeset.ChangeID,
+				Number:   changeset.Number,
+				CommitID: commitID,
+			})
+		}
+		p.Chains = append(p.Chains, changes)
+	}
+	return p
+}
+
+// restoreUnit returns the persisted unit with the current changesets,
+// or an error if one of them is gone, or isn't at the expected commit anymore.
+func restoreUnit(p *persistedUnit, changesets map[string]*gerrit.Changeset) (*gerrit.Unit, error) {
+	unit := &gerrit.Unit{}
+	for _, changes := range p.Chains {
+		chain := &gerrit.Chain{}
+		for _, change := range changes {
+			changeset, ok := changesets[change.ChangeID]
+			if !ok {
+				return nil, errors.New("change is gone: " + change.ChangeID)
+			}
+			if changeset.CommitID != change.CommitID {
+				return nil, errors.New("change was updated: " + change.ChangeID)
+			}
+			chain.ChangeSets = append(chain.ChangeSets, changeset)
+		}
+		unit.Chains = append(unit.Chains, chain)
+	}
+	return unit, nil
+}
+
+// saveState persists the state of the runner, if a store is configured
+func (r *Runner) saveState() {
+	if r.store == nil {
+		return
+	}
+	state := &persistedState{
+		Version:      stateVersion,
+		Attempts:     r.attempts,
+		History:      r.GetHistory(),
+		WaitingSince: r.waitingSince,
+		Rechecked:    r.rechecked,
+	}
+	for changeID := range r.requeued {
+		state.Requeued = append(state.Requeued, changeID)
+	}
+	sort.Strings(state.Requeued)
+	if r.wipUnit != nil {
+		state.WIPUnit = r.persistUnit(r.wipUnit)
+	}
+	for _, unit := range r.batch {
+		state.Batch = append(state.Batch, r.persistUnit(unit))
+	}
+	for _, unit := range r.bisected {
+		state.Bisected = append(state.Bisected, r.persistUnit(unit))
+	}
+	if err := r.store.Save(r.stateKey(), state); err != nil {
+		r.logger.WithError(err).Warn("unable to save state")
+	}
+}
+
+// restoreState restores the state saved by a previous process, if a store is configured.
+// The wipUnit, batch and bisected units are only restored if their changes are still at the commits they were left at,
+// otherwise they're discarded and picked again like any other unit.
+// Whether they're still based on HEAD is checked by the run, like for any wipUnit and batch.
+func (r *Runner) restoreState() {
+	if r.store == nil {
+		return
+	}
+	var state persistedState
+	err := r.store.Load(r.stateKey(), &state)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			r.logger.WithError(err).Warn("unable to load state, starting from scratch")
+		}
+		return
+	}
+	if state.Version != stateVersion {
+		r.logger.WithField("version", state.Version).Warn("ignoring state of another version")
+		return
+	}
+
+	if state.Attempts != nil {
+		r.attempts = state.Attempts
+	}
+	for _, changeID := range state.Requeued {
+		r.requeued[changeID] = true
+	}
+	r.mut.Lock()
+	r.history = state.History
+	r.waitingSince = state.WaitingSince
+	r.rechecked = state.Rechecked
+	r.mut.Unlock()
+
+	changesets := r.changesetsByChangeID()
+	for _, p := range state.Bisected {
+		unit, err := restoreUnit(p, changesets)
+		if err != nil {
+			r.logger.WithError(err).Info("not restoring bisected unit")
+			continue
+		}
+		r.bisected = append(r.bisected, unit)
+	}
+	if state.WIPUnit != nil {
+		unit, err := restoreUnit(state.WIPUnit, changesets)
+		if err != nil {
+			r.logger.WithError(err).Warn("not restoring wipUnit")
+		} else {
+			r.logger.WithField("wipUnit", unit).Info("restored wipUnit")
+			r.wipUnit = unit
+		}
+	}
+	batch := make([]*gerrit.Unit, 0, len(state.Batch))
+	for _, p := range state.Batch {
+		unit, err := restoreUnit(p, changesets)
+		if err != nil {
+			r.logger.WithError(err).Warn("not restoring batch")
+			return
+		}
+		batch = append(batch, unit)
+	}
+	if len(batch) != 0 {
+		r.logger.WithField("batch", batch).Info("restored batch")
+		r.setBatch(batch)
+	}
+}
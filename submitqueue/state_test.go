@@ -0,0 +1,101 @@
+package submitqueue
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	goGerrit "github.com/andygrunwald/go-gerrit"
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/flokli/gerrit-queue/store"
+)
+
+// uploadPatchset replaces the current revision of the change with the given number
+func (f *fakeGerrit) uploadPatchset(number int, commitID, parentCommitID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, change := range f.changes {
+		if change.Number != number {
+			continue
+		}
+		revision := change.Revisions[change.CurrentRevision]
+		change.CurrentRevision = commitID
+		change.Revisions = map[string]goGerrit.RevisionInfo{commitID: {
+			Number: revision.Number + 1,
+			Commit: goGerrit.CommitInfo{Commit: commitID, Parents: []goGerrit.CommitInfo{{Commit: parentCommitID}}},
+		}}
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	f, c := newFakeGerrit(t)
+	f.addChange(1, "c1", "old", readyVotes())
+	f.addChange(2, "c2", "old", readyVotes())
+	s, err := store.NewFileStore(filepath.Join(t.TempDir(), "state.json"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	r := NewRunner(&log.Logger{Handler: discard.New()}, c)
+	r.SetStateStore(s)
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, []int{1}, f.rebased)
+
+	// a restarted runner keeps waiting for the rebased unit, instead of rebasing another one
+	r = NewRunner(&log.Logger{Handler: discard.New()}, c)
+	r.SetStateStore(s)
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, []int{1}, f.rebased)
+	if wipUnit := r.GetWIPUnit(); assert.NotNil(t, wipUnit) {
+		assert.Equal(t, 1, wipUnit.Changesets()[0].Number)
+	}
+	diagnoses := r.Diagnose()
+	if assert.Len(t, diagnoses, 2) {
+		assert.Equal(t, 1, diagnoses[0].Attempts)
+	}
+
+	f.setVotes(1, readyVotes())
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, []int{1}, f.submitted)
+	if history := r.GetHistory(); assert.Len(t, history, 1) {
+		assert.Equal(t, []int{1}, history[0].Changes)
+		assert.Equal(t, OutcomeSubmitted, history[0].Outcome)
+	}
+
+	// the history survives restarts as well
+	r = NewRunner(&log.Logger{Handler: discard.New()}, c)
+	r.SetStateStore(s)
+	assert.NoError(t, r.Trigger(context.Background(), true))
+	assert.Len(t, r.GetHistory(), 1)
+}
+
+func TestRestoreStateValidation(t *testing.T) {
+	f, c := newFakeGerrit(t)
+	f.addChange(1, "c1", "old", readyVotes())
+	s, err := store.NewKVStore(filepath.Join(t.TempDir(), "state"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+
+	r := NewRunner(&log.Logger{Handler: discard.New()}, c)
+	r.SetStateStore(s)
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, []int{1}, f.rebased)
+
+	// the owner uploaded a new patchset while the runner was down, so it's not the unit it rebased anymore
+	f.uploadPatchset(1, "c1-new", "old")
+	f.setVotes(1, readyVotes())
+	r = NewRunner(&log.Logger{Handler: discard.New()}, c)
+	r.SetStateStore(s)
+	assert.NoError(t, r.Trigger(context.Background(), false))
+	assert.Equal(t, []int{1, 1}, f.rebased)
+
+	diagnoses := r.Diagnose()
+	if assert.Len(t, diagnoses, 1) {
+		assert.Equal(t, 2, diagnoses[0].Attempts)
+	}
+}
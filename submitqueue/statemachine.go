@@ -0,0 +1,328 @@
+package submitqueue
+
+import (
+	"context"
+	"errors"
+
+	"github.com/apex/log"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+)
+
+// State is the state of the runner
+type State int
+
+const (
+	// StateIdle means nothing is in progress, the next queued unit is picked
+	StateIdle State = iota
+	// StateRebasing means the picked wipUnit is rebased on HEAD
+	StateRebasing
+	// StateWaitingForCI means the wipUnit waits for CI feedback
+	StateWaitingForCI
+	// StateSubmitting means the wipUnit passed CI, and is submitted
+	StateSubmitting
+	// StateBatching means a batch waits for CI, and its passing units are submitted
+	StateBatching
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateRebasing:
+		return "rebasing"
+	case StateWaitingForCI:
+		return "waiting-for-ci"
+	case StateSubmitting:
+		return "submitting"
+	case StateBatching:
+		return "batching"
+	default:
+		return "unknown"
+	}
+}
+
+// run holds what's shared between the steps of a single run
+type run struct {
+	// units that were submitted or couldn't be rebased during this run, and shouldn't be picked again.
+	// The local cache isn't refreshed until the next run, so it still contains submitted units.
+	skippedUnits map[*gerrit.Unit]bool
+	// changes of the batch submitted during this run, see processBatch
+	submittedChanges map[string]bool
+	// units with chains failing the integrity check are never picked
+	report *gerrit.AssemblyReport
+}
+
+// GetState returns the state the runner is in, or was left in by the last run.
+// Acquires a lock, so check with IsCurrentlyRunning first
+func (r *Runner) GetState() State {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	return r.state
+}
+
+// setState transitions to the given state
+func (r *Runner) setState(state State) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.state = state
+}
+
+// restingState is the state a run starts in, derived from what survived the last run
+func (r *Runner) restingState() State {
+	switch {
+	case len(r.batch) != 0:
+		return StateBatching
+	case r.wipUnit != nil:
+		return StateWaitingForCI
+	default:
+		return StateIdle
+	}
+}
+
+// step runs the given state, and returns the next state.
+// If done is true, the run ends, and continues in the next state on the next trigger.
+func (r *Runner) step(ctx context.Context, state State, run *run) (next State, done bool, err error) {
+	switch state {
+	case StateIdle:
+		return r.stepIdle(ctx, run)
+	case StateRebasing:
+		return r.stepRebasing(ctx, run)
+	case StateWaitingForCI:
+		return r.stepWaitingForCI(ctx, run)
+	case StateSubmitting:
+		return r.stepSubmitting(ctx, run)
+	case StateBatching:
+		return r.stepBatching(ctx, run)
+	default:
+		panic("unknown state " + state.String())
+	}
+}
+
+// discardWIPUnit drops the wipUnit, and emits UnitDiscarded
+func (r *Runner) discardWIPUnit(reason DiscardReason) {
+	unit := r.wipUnit
+	r.mut.Lock()
+	r.wipUnit = nil
+	r.mut.Unlock()
+	r.emit(&UnitDiscarded{unitEvent{unit}, reason})
+}
+
+// stepIdle finds a new wipUnit, or stacks a batch.
+// A unit already rebased on HEAD goes straight to waiting for CI, others are rebased first.
+func (r *Runner) stepIdle(ctx context.Context, run *run) (State, bool, error) {
+	r.logger.Info("Looking for units ready to submit")
+	// Find the queued units we didn't fail to rebase or submit during this run
+	queued := make([]*gerrit.Unit, 0)
+	for _, u := range r.queuedUnits(run.report) {
+		if !run.skippedUnits[u] && u.AllChangesets(func(c *gerrit.Changeset) bool { return !run.submittedChanges[c.ChangeID] }) {
+			queued = append(queued, u)
+		}
+	}
+	if len(queued) == 0 {
+		r.logBlockedUnits()
+		r.logger.Info("no more submittable unit found, going back to sleep.")
+		return StateIdle, true, nil
+	}
+	unit := queued[0]
+
+	// stack it with the batchable units queued after it, in queue order
+	if size := r.batchSize(); size > 1 && r.isBatchable(unit) {
+		units := []*gerrit.Unit{unit}
+		for _, u := range queued[1:] {
+			if len(units) == size || !r.isBatchable(u) {
+				break
+			}
+			units = append(units, u)
+		}
+		if len(units) > 1 {
+			r.logger.WithField("units", units).Info("found units to stack in a batch")
+			if err := r.buildBatch(ctx, units, run.skippedUnits); err != nil {
+				return StateBatching, true, err
+			}
+			if len(r.batch) == 0 {
+				return StateIdle, false, nil
+			}
+			// CI needs to run on the stacked units
+			r.startWaiting()
+			return StateBatching, true, nil
+		}
+	}
+
+	l := r.logger.WithFields(log.Fields{
+		"unit":     unit,
+		"priority": r.gerrit.UnitPriority(unit),
+	})
+	r.mut.Lock()
+	r.wipUnit = unit
+	r.mut.Unlock()
+	r.emit(&UnitPicked{unitEvent{unit}})
+	if r.gerrit.UnitIsRebasedOnHEAD(unit) {
+		l.Info("Found unit to submit without necessary rebase")
+		r.startWaiting()
+		return StateWaitingForCI, false, nil
+	}
+	l.Info("found unit, which needs a rebase")
+	return StateRebasing, false, nil
+}
+
+// stepRebasing rebases each chain of the wipUnit on HEAD.
+// Afterwards, CI needs to run, so the run ends.
+func (r *Runner) stepRebasing(ctx context.Context, run *run) (State, bool, error) {
+	unit := r.wipUnit
+	l := r.logger.WithField("unit", unit)
+	// a conflict would leave the unit half-rebased, so ask gerrit first
+	if !r.checkMergeable(ctx, unit) {
+		run.skippedUnits[unit] = true
+		r.discardWIPUnit(DiscardConflict)
+		return StateIdle, false, nil
+	}
+	r.countAttempt(unit)
+	head := r.gerrit.GetHEAD()
+	// each chain of the unit is rebased on HEAD on its own
+	for _, chain := range unit.Chains {
+		if r.gerrit.ChainIsRebasedOnHEAD(chain) {
+			continue
+		}
+		_, changeset, err := r.rebaseChain(ctx, chain, head)
+		if err != nil {
+			l := l.WithField("changeset", changeset).WithError(err)
+			reason := DiscardRebaseFailed
+			switch {
+			case errors.Is(err, gerrit.ErrConflict):
+				l.Warn("unit can't be rebased on HEAD without conflicts, skipping it")
+				r.recordConflict(ctx, unit, changeset)
+				reason = DiscardConflict
+			case errors.Is(err, gerrit.ErrForbidden):
+				l.Error("not allowed to rebase unit, skipping it")
+			case errors.Is(err, gerrit.ErrNotFound):
+				l.Warn("changeset disappeared while rebasing, skipping unit")
+				reason = DiscardDisappeared
+			default:
+				l.Error("error rebasing unit")
+				r.discardWIPUnit(reason)
+				return StateIdle, true, err
+			}
+			run.skippedUnits[unit] = true
+			r.discardWIPUnit(reason)
+			return StateIdle, false, nil
+		}
+	}
+	r.emit(&UnitRebased{unitEvent{unit}, head})
+	r.startWaiting()
+	// we don't need to care about updating the rebased changesets or getting the updated HEAD,
+	// as we'll refetch it on the beginning of the next trigger anyways
+	return StateWaitingForCI, true, nil
+}
+
+// stepWaitingForCI checks the CI feedback of the wipUnit.
+// It's discarded if it failed CI, or HEAD moved in the meantime.
+// If CI doesn't report back in time, the timeout action is applied, see SetCITimeout.
+func (r *Runner) stepWaitingForCI(ctx context.Context, run *run) (State, bool, error) {
+	l := r.logger.WithField("wipUnit", r.wipUnit)
+	l.Info("Checking wipUnit")
+
+	// discard wipUnit not rebased on HEAD
+	// we rebase them when picking them, so this means master advanced without going through the submit queue
+	if !r.gerrit.UnitIsRebasedOnHEAD(r.wipUnit) {
+		l.Warnf("HEAD has moved to %v while still waiting for wipUnit, discarding it", r.gerrit.GetHEAD())
+		r.discardWIPUnit(DiscardHEADMoved)
+		return StateIdle, false, nil
+	}
+
+	// wipUnit might have failed CI in the meantime
+	var failing *gerrit.Changeset
+	r.wipUnit.AllChangesets(func(c *gerrit.Changeset) bool {
+		if c.IsCIFailed() {
+			failing = c
+			return false
+		}
+		return true
+	})
+	if failing != nil {
+		l.WithField("failingChangeset", failing).Warnf("wipUnit failed CI in the meantime, discarding.")
+		r.reportCIFailure(ctx, r.wipUnit, failing, nil)
+		r.emit(&CIFailed{unitEvent{r.wipUnit}, failing})
+		r.discardWIPUnit(DiscardCIFailed)
+		return StateIdle, false, nil
+	}
+
+	// it might still be waiting for CI
+	if !r.wipUnit.AllChangesets(func(c *gerrit.Changeset) bool {
+		if !c.IsVerified() {
+			l.WithField("pendingChangeset", c).Warnf("still waiting for CI feedback in wipUnit, going back to sleep.")
+			return false
+		}
+		return true
+	}) {
+		// an emergency doesn't wait for it
+		if unit := r.findPreemptingUnit(run.report, run.skippedUnits); unit != nil {
+			preempted := r.wipUnit
+			r.preempt(unit)
+			r.emit(&UnitDiscarded{unitEvent{preempted}, DiscardPreempted})
+			return StateIdle, false, nil
+		}
+		if r.ciTimedOut() && !r.handleCITimeout(ctx, []*gerrit.Unit{r.wipUnit}) {
+			run.skippedUnits[r.wipUnit] = true
+			r.discardWIPUnit(DiscardCITimeout)
+			return StateIdle, false, nil
+		}
+		// take a look at it at the next trigger.
+		return StateWaitingForCI, true, nil
+	}
+
+	r.emit(&CIPassed{unitEvent{r.wipUnit}})
+	if !r.isAutoSubmittable(r.wipUnit) {
+		l.Error("BUG: wipUnit is not autosubmittable")
+		r.discardWIPUnit(DiscardNotSubmittable)
+		return StateIdle, false, nil
+	}
+	return StateSubmitting, false, nil
+}
+
+// stepSubmitting submits the wipUnit, which is rebased on HEAD, and passed CI
+func (r *Runner) stepSubmitting(ctx context.Context, run *run) (State, bool, error) {
+	unit := r.wipUnit
+	l := r.logger.WithField("wipUnit", unit)
+	l.Infof("submitting wipUnit")
+	err := r.submitUnit(ctx, unit)
+	if err != nil {
+		l := l.WithError(err)
+		switch {
+		case errors.Is(err, gerrit.ErrTransient):
+			// keep the wipUnit, it's still valid, and retry on the next trigger
+			l.Warn("transient error submitting changeset, retrying later")
+			return StateWaitingForCI, true, err
+		case errors.Is(err, gerrit.ErrConflict), errors.Is(err, gerrit.ErrNotFound):
+			// gerrit doesn't want to merge it (anymore), or it's gone.
+			// Discard it and look for other units.
+			l.Warn("changeset can't be submitted, discarding wipUnit")
+			run.skippedUnits[unit] = true
+			r.discardWIPUnit(DiscardSubmitFailed)
+			return StateIdle, false, nil
+		default:
+			l.Error("error submitting changeset")
+			r.discardWIPUnit(DiscardSubmitFailed)
+			return StateIdle, true, err
+		}
+	}
+	run.skippedUnits[unit] = true
+	r.mut.Lock()
+	r.wipUnit = nil
+	r.mut.Unlock()
+	r.emit(&UnitSubmitted{unitEvent{unit}})
+	return StateIdle, false, nil
+}
+
+// stepBatching submits the passing units of the batch, and splits it on failures, see processBatch
+func (r *Runner) stepBatching(ctx context.Context, run *run) (State, bool, error) {
+	waiting, err := r.processBatch(ctx, run.submittedChanges)
+	if err != nil {
+		return r.restingState(), true, err
+	}
+	if waiting {
+		// take a look at it at the next trigger.
+		return StateBatching, true, nil
+	}
+	return StateIdle, false, nil
+}
@@ -0,0 +1,414 @@
+package submitqueue
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/discard"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateMachine(t *testing.T) {
+	// rebase triggers a run rebasing change 1 on HEAD
+	rebase := func(t *testing.T, f *fakeGerrit, r *Runner) {
+		assert.NoError(t, r.Trigger(context.Background(), false))
+	}
+
+	for _, tc := range []struct {
+		name string
+		// setup adds changes to the fake gerrit
+		setup func(f *fakeGerrit)
+		// before configures the runner, and prepares the run under test
+		before func(t *testing.T, f *fakeGerrit, r *Runner)
+		// after checks the outcome beyond the events and state
+		after      func(t *testing.T, f *fakeGerrit, r *Runner)
+		wantErr    bool
+		wantEvents []string
+		wantState  State
+	}{{
+		name: "nothing queued",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "head", map[string]int{"Verified": 1, "Code-Review": 2})
+		},
+		wantState: StateIdle,
+	}, {
+		name:       "unit needs a rebase",
+		setup:      func(f *fakeGerrit) { f.addChange(1, "c1", "old", readyVotes()) },
+		wantEvents: []string{"UnitPicked(1)", "UnitRebased(1)"},
+		wantState:  StateWaitingForCI,
+	}, {
+		name:       "unit rebased on HEAD is submitted",
+		setup:      func(f *fakeGerrit) { f.addChange(1, "c1", "head", readyVotes()) },
+		wantEvents: []string{"UnitPicked(1)", "CIPassed(1)", "UnitSubmitted(1)"},
+		wantState:  StateIdle,
+	}, {
+		name:       "still waiting for CI",
+		setup:      func(f *fakeGerrit) { f.addChange(1, "c1", "old", readyVotes()) },
+		before:     rebase,
+		wantEvents: []string{},
+		wantState:  StateWaitingForCI,
+	}, {
+		name:  "CI passed",
+		setup: func(f *fakeGerrit) { f.addChange(1, "c1", "old", readyVotes()) },
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			rebase(t, f, r)
+			f.setVotes(1, readyVotes())
+		},
+		wantEvents: []string{"CIPassed(1)", "UnitSubmitted(1)"},
+		wantState:  StateIdle,
+	}, {
+		name:  "CI failed",
+		setup: func(f *fakeGerrit) { f.addChange(1, "c1", "old", readyVotes()) },
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			rebase(t, f, r)
+			f.setVotes(1, failedVotes())
+		},
+		after: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			assert.Equal(t, []string{"Autosubmit"}, f.deletedVotes[1])
+			if assert.Len(t, f.messages[1], 1) {
+				assert.Contains(t, f.messages[1][0], "failed CI on top of master (head)")
+				assert.Contains(t, f.messages[1][0], "Autosubmit was reset")
+			}
+		},
+		wantEvents: []string{"CIFailed(1)", "UnitDiscarded(1 ci-failed)"},
+		wantState:  StateIdle,
+	}, {
+		name: "CI failed, not allowed to remove votes",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "old", readyVotes())
+			f.failDeleteVote[1] = http.StatusForbidden
+		},
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			rebase(t, f, r)
+			f.setVotes(1, failedVotes())
+		},
+		after: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			// the owner is told anyways
+			assert.Len(t, f.messages[1], 1)
+		},
+		wantEvents: []string{"CIFailed(1)", "UnitDiscarded(1 ci-failed)"},
+		wantState:  StateIdle,
+	}, {
+		name:  "CI failed, keeping the opt-in",
+		setup: func(f *fakeGerrit) { f.addChange(1, "c1", "old", readyVotes()) },
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			r.SetKeepOptIn(true)
+			rebase(t, f, r)
+			f.setVotes(1, failedVotes())
+		},
+		after: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			assert.Empty(t, f.deletedVotes[1])
+			if assert.Len(t, f.messages[1], 1) {
+				assert.Contains(t, f.messages[1][0], "is tried again")
+			}
+		},
+		wantEvents: []string{"CIFailed(1)", "UnitDiscarded(1 ci-failed)"},
+		wantState:  StateIdle,
+	}, {
+		name:  "HEAD moved",
+		setup: func(f *fakeGerrit) { f.addChange(1, "c1", "old", readyVotes()) },
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			rebase(t, f, r)
+			f.head = "head2"
+		},
+		wantEvents: []string{"UnitDiscarded(1 head-moved)"},
+		wantState:  StateIdle,
+	}, {
+		name:  "wipUnit disappeared",
+		setup: func(f *fakeGerrit) { f.addChange(1, "c1", "old", readyVotes()) },
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			rebase(t, f, r)
+			f.findChange("I1").Status = "ABANDONED"
+		},
+		wantEvents: []string{"UnitDiscarded(1 disappeared)"},
+		wantState:  StateIdle,
+	}, {
+		name: "conflict reported by gerrit",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "old", readyVotes())
+			f.conflicting[1] = true
+		},
+		wantEvents: []string{"UnitPicked(1)", "UnitDiscarded(1 conflict)"},
+		wantState:  StateIdle,
+	}, {
+		name: "conflict while rebasing",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "old", readyVotes())
+			f.failRebase[1] = http.StatusConflict
+		},
+		wantEvents: []string{"UnitPicked(1)", "UnitDiscarded(1 conflict)"},
+		wantState:  StateIdle,
+	}, {
+		name: "rebase forbidden",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "old", readyVotes())
+			f.failRebase[1] = http.StatusForbidden
+		},
+		wantEvents: []string{"UnitPicked(1)", "UnitDiscarded(1 rebase-failed)"},
+		wantState:  StateIdle,
+	}, {
+		name: "submit refused",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "head", readyVotes())
+			f.failSubmit[1] = http.StatusConflict
+		},
+		wantEvents: []string{"UnitPicked(1)", "CIPassed(1)", "UnitDiscarded(1 submit-failed)"},
+		wantState:  StateIdle,
+	}, {
+		name: "transient submit error",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "head", readyVotes())
+			f.failSubmit[1] = http.StatusServiceUnavailable
+		},
+		wantErr:    true,
+		wantEvents: []string{"UnitPicked(1)", "CIPassed(1)"},
+		wantState:  StateWaitingForCI,
+	}, {
+		name:  "preempted by an emergency",
+		setup: func(f *fakeGerrit) { f.addChange(1, "c1", "old", readyVotes()) },
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			r.SetEmergencyPreemption(true)
+			rebase(t, f, r)
+			f.addChange(2, "c2", "head", readyVotes()).Hashtags = []string{"queue-emergency"}
+		},
+		wantEvents: []string{"UnitDiscarded(1 preempted)", "UnitPicked(2)", "CIPassed(2)", "UnitSubmitted(2)"},
+		wantState:  StateIdle,
+	}, {
+		name:  "CI timed out, recheck",
+		setup: func(f *fakeGerrit) { f.addChange(1, "c1", "old", readyVotes()) },
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			r.SetCITimeout(time.Minute, TimeoutRecheck, "recheck please")
+			rebase(t, f, r)
+			r.waitingSince = time.Now().Add(-time.Hour)
+		},
+		after: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			assert.Equal(t, []string{"recheck please"}, f.messages[1])
+			assert.WithinDuration(t, time.Now().Add(time.Minute), r.GetCIDeadline(), time.Second)
+		},
+		wantEvents: []string{"CITimedOut(1 recheck)"},
+		wantState:  StateWaitingForCI,
+	}, {
+		name:  "CI timed out again after a recheck",
+		setup: func(f *fakeGerrit) { f.addChange(1, "c1", "old", readyVotes()) },
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			r.SetCITimeout(time.Minute, TimeoutRecheck, "recheck")
+			rebase(t, f, r)
+			r.waitingSince = time.Now().Add(-time.Hour)
+			r.rechecked = true
+		},
+		wantEvents: []string{"CITimedOut(1 discard)", "UnitDiscarded(1 ci-timeout)"},
+		wantState:  StateIdle,
+	}, {
+		name:  "CI timed out, requeue",
+		setup: func(f *fakeGerrit) { f.addChange(1, "c1", "old", readyVotes()) },
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			r.SetCITimeout(time.Minute, TimeoutRequeue, "")
+			rebase(t, f, r)
+			r.waitingSince = time.Now().Add(-time.Hour)
+		},
+		after: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			assert.True(t, r.requeued["I1"])
+			assert.True(t, r.GetCIDeadline().IsZero())
+		},
+		wantEvents: []string{"CITimedOut(1 requeue)", "UnitDiscarded(1 ci-timeout)"},
+		wantState:  StateIdle,
+	}, {
+		name:  "requeued unit picked again",
+		setup: func(f *fakeGerrit) { f.addChange(1, "c1", "old", readyVotes()) },
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			r.requeued["I1"] = true
+		},
+		after: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			assert.Empty(t, r.requeued)
+		},
+		wantEvents: []string{"UnitPicked(1)", "UnitRebased(1)"},
+		wantState:  StateWaitingForCI,
+	}, {
+		name:  "CI not timed out yet",
+		setup: func(f *fakeGerrit) { f.addChange(1, "c1", "old", readyVotes()) },
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			r.SetCITimeout(time.Hour, TimeoutDiscard, "")
+			rebase(t, f, r)
+		},
+		wantEvents: []string{},
+		wantState:  StateWaitingForCI,
+	}, {
+		name: "batch stacked",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "old", readyVotes())
+			f.addChange(2, "c2", "old", readyVotes())
+		},
+		before:     func(t *testing.T, f *fakeGerrit, r *Runner) { r.SetBatchSize(2) },
+		wantEvents: []string{"UnitPicked(1)", "UnitRebased(1)", "UnitPicked(2)", "UnitRebased(2)"},
+		wantState:  StateBatching,
+	}, {
+		name: "batch passed",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "old", readyVotes())
+			f.addChange(2, "c2", "old", readyVotes())
+		},
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			r.SetBatchSize(2)
+			rebase(t, f, r)
+			f.setVotes(1, readyVotes())
+			f.setVotes(2, readyVotes())
+		},
+		wantEvents: []string{"CIPassed(1)", "UnitSubmitted(1)", "CIPassed(2)", "UnitSubmitted(2)"},
+		wantState:  StateIdle,
+	}, {
+		name: "batch bottom failed",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "old", readyVotes())
+			f.addChange(2, "c2", "old", readyVotes())
+		},
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			r.SetBatchSize(2)
+			rebase(t, f, r)
+			f.setVotes(1, failedVotes())
+		},
+		after: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			assert.Equal(t, []string{"Autosubmit"}, f.deletedVotes[1])
+			assert.Empty(t, f.deletedVotes[2])
+			assert.Equal(t, "head", f.parentOf(2))
+		},
+		// the unit above it is retested on its own, as the failure rate went up
+		wantEvents: []string{"CIFailed(1)", "UnitDiscarded(1 ci-failed)", "UnitDiscarded(2 bisected)", "UnitPicked(2)", "UnitRebased(2)"},
+		wantState:  StateWaitingForCI,
+	}, {
+		name: "batch failed above pending unit",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "old", readyVotes())
+			f.addChange(2, "c2", "old", readyVotes())
+		},
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			r.SetBatchSize(2)
+			rebase(t, f, r)
+			f.setVotes(2, failedVotes())
+		},
+		after: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			assert.Empty(t, f.deletedVotes)
+			assert.Empty(t, f.messages)
+			assert.Equal(t, []int{1, 2}, f.rebased)
+			assert.Len(t, r.GetBisected(), 1)
+		},
+		wantEvents: []string{"UnitDiscarded(2 bisected)"},
+		wantState:  StateBatching,
+	}, {
+		name: "batch failed above passing unit",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "old", readyVotes())
+			f.addChange(2, "c2", "old", readyVotes())
+		},
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			r.SetBatchSize(2)
+			rebase(t, f, r)
+			// it passed, but isn't submitted, as its owner doesn't want it to be anymore
+			f.setVotes(1, map[string]int{"Verified": 1, "Code-Review": 2})
+			f.setVotes(2, failedVotes())
+		},
+		after: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			assert.Equal(t, []string{"Autosubmit"}, f.deletedVotes[2])
+			if assert.Len(t, f.messages[2], 1) {
+				assert.Contains(t, f.messages[2][0], "failed CI on top of change 1 (c1-r2)")
+			}
+			assert.Len(t, r.GetBatch(), 1)
+		},
+		wantEvents: []string{"CIFailed(2)", "UnitDiscarded(2 ci-failed)"},
+		wantState:  StateBatching,
+	}, {
+		name: "batch bisected unit failed on HEAD",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "old", readyVotes())
+			f.addChange(2, "c2", "old", readyVotes())
+		},
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			r.SetBatchSize(2)
+			rebase(t, f, r)
+			f.setVotes(2, failedVotes())
+			rebase(t, f, r)
+			f.setVotes(1, readyVotes())
+		},
+		after: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			// it was tested on top of what's HEAD now, so it's not rebased again
+			assert.Equal(t, []int{1, 2}, f.rebased)
+			assert.Equal(t, []string{"Autosubmit"}, f.deletedVotes[2])
+			if assert.Len(t, f.messages[2], 1) {
+				assert.Contains(t, f.messages[2][0], "failed CI on top of master (c1-r2)")
+			}
+			assert.Empty(t, r.GetBisected())
+		},
+		wantEvents: []string{"CIPassed(1)", "UnitSubmitted(1)", "UnitPicked(2)", "CIFailed(2)", "UnitDiscarded(2 ci-failed)"},
+		wantState:  StateIdle,
+	}, {
+		name: "batch CI timed out",
+		setup: func(f *fakeGerrit) {
+			f.addChange(1, "c1", "old", readyVotes())
+			f.addChange(2, "c2", "old", readyVotes())
+		},
+		before: func(t *testing.T, f *fakeGerrit, r *Runner) {
+			r.SetBatchSize(2)
+			r.SetCITimeout(time.Minute, TimeoutDiscard, "")
+			rebase(t, f, r)
+			r.waitingSince = time.Now().Add(-time.Hour)
+		},
+		wantEvents: []string{"CITimedOut(1 discard)", "CITimedOut(2 discard)", "UnitDiscarded(1 ci-timeout)", "UnitDiscarded(2 ci-timeout)"},
+		wantState:  StateIdle,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, c := newFakeGerrit(t)
+			tc.setup(f)
+			r := NewRunner(&log.Logger{Handler: discard.New()}, c)
+			if tc.before != nil {
+				tc.before(t, f, r)
+			}
+
+			events := []string{}
+			r.Subscribe(func(e Event) {
+				events = append(events, e.String())
+			})
+			err := r.Trigger(context.Background(), false)
+			if tc.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			if tc.wantEvents == nil {
+				tc.wantEvents = []string{}
+			}
+			assert.Equal(t, tc.wantEvents, events)
+			assert.Equal(t, tc.wantState, r.GetState())
+			if tc.after != nil {
+				tc.after(t, f, r)
+			}
+		})
+	}
+}
+
+func TestStateString(t *testing.T) {
+	for state := StateIdle; state <= StateBatching; state++ {
+		assert.NotEqual(t, "unknown", state.String())
+	}
+	assert.Equal(t, "unknown", State(-1).String())
+}
+
+func TestRequeuedUnitsGoLast(t *testing.T) {
+	f, c := newFakeGerrit(t)
+	f.addChange(1, "c1", "head", readyVotes())
+	f.addChange(2, "c2", "head", readyVotes())
+	f.addChange(3, "c3", "head", readyVotes()).Hashtags = []string{"queue-priority"}
+
+	r := NewRunner(&log.Logger{Handler: discard.New()}, c)
+	assert.NoError(t, r.Trigger(context.Background(), true))
+	r.requeued["I1"] = true
+	r.requeued["I3"] = true
+
+	// priority still comes first
+	numbers := []int{}
+	for _, unit := range r.queuedUnits(c.GetAssemblyReport()) {
+		numbers = append(numbers, unit.Changesets()[0].Number)
+	}
+	assert.Equal(t, []int{3, 2, 1}, numbers)
+}
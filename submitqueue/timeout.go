@@ -0,0 +1,157 @@
+package submitqueue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/apex/log"
+
+	"github.com/flokli/gerrit-queue/gerrit"
+)
+
+// TimeoutAction is what the runner does when CI doesn't report back in time
+type TimeoutAction string
+
+const (
+	// TimeoutRecheck asks CI to run again, by posting the recheck message on the pending changesets.
+	// If it times out again, the unit is discarded.
+	TimeoutRecheck TimeoutAction = "recheck"
+	// TimeoutDiscard discards the unit, it's picked again once it passed CI
+	TimeoutDiscard TimeoutAction = "discard"
+	// TimeoutRequeue discards the unit, and moves it to the back of the queue once it passed CI,
+	// until it's picked again
+	TimeoutRequeue TimeoutAction = "requeue"
+)
+
+// DefaultRecheckMessage is the message posted to ask CI to run again
+const DefaultRecheckMessage = "recheck"
+
+// ParseTimeoutAction returns the timeout action with the given name
+func ParseTimeoutAction(name string) (TimeoutAction, error) {
+	switch action := TimeoutAction(name); action {
+	case TimeoutRecheck, TimeoutDiscard, TimeoutRequeue:
+		return action, nil
+	default:
+		return "", fmt.Errorf("unknown CI timeout action %q, must be one of %s, %s, %s",
+			name, TimeoutRecheck, TimeoutDiscard, TimeoutRequeue)
+	}
+}
+
+// SetCITimeout limits how long the wipUnit or batch waits for CI, and what happens afterwards.
+// A timeout of 0 waits forever.
+func (r *Runner) SetCITimeout(timeout time.Duration, action TimeoutAction, recheckMessage string) {
+	r.ciTimeout = timeout
+	r.ciTimeoutAction = action
+	r.recheckMessage = recheckMessage
+}
+
+// GetCIDeadline returns when the wipUnit or batch times out waiting for CI,
+// or the zero time if nothing waits for CI, or there's no timeout.
+// Acquires a lock, so check with IsCurrentlyRunning first
+func (r *Runner) GetCIDeadline() time.Time {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.ciTimeout == 0 || r.waitingSince.IsZero() || (r.wipUnit == nil && len(r.batch) == 0) {
+		return time.Time{}
+	}
+	return r.waitingSince.Add(r.ciTimeout)
+}
+
+// startWaiting records that the wipUnit or batch starts waiting for CI
+func (r *Runner) startWaiting() {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.waitingSince = time.Now()
+	r.rechecked = false
+}
+
+// ciTimedOut returns true if the wipUnit or batch waited for CI for too long.
+// Units restored without a start time start waiting now.
+func (r *Runner) ciTimedOut() bool {
+	if r.waitingSince.IsZero() {
+		r.startWaiting()
+	}
+	return r.ciTimeout != 0 && time.Since(r.waitingSince) > r.ciTimeout
+}
+
+// isRequeued returns true if the unit timed out with TimeoutRequeue, and goes to the back of the queue
+func (r *Runner) isRequeued(unit *gerrit.Unit) bool {
+	return !unit.AllChangesets(func(c *gerrit.Changeset) bool { return !r.requeued[c.ChangeID] })
+}
+
+// pruneRequeued forgets about requeued changes that are gone
+func (r *Runner) pruneRequeued() {
+	changesets := r.changesetsByChangeID()
+	for changeID := range r.requeued {
+		if _, ok := changesets[changeID]; !ok {
+			delete(r.requeued, changeID)
+		}
+	}
+}
+
+// forgetRequeued puts units back in their place in the queue once they're picked again,
+// or submitted or discarded for another reason than timing out.
+// It's subscribed to the runner's events.
+func (r *Runner) forgetRequeued(event Event) {
+	switch e := event.(type) {
+	case *UnitDiscarded:
+		if e.Reason == DiscardCITimeout {
+			return
+		}
+	case *UnitPicked, *UnitSubmitted:
+	default:
+		return
+	}
+	for _, changeset := range event.GetUnit().Changesets() {
+		delete(r.requeued, changeset.ChangeID)
+	}
+}
+
+// handleCITimeout applies the timeout action to the units waiting for CI.
+// It returns true if they keep waiting after a recheck.
+func (r *Runner) handleCITimeout(ctx context.Context, units []*gerrit.Unit) bool {
+	action := r.ciTimeoutAction
+	if action == TimeoutRecheck && r.rechecked {
+		action = TimeoutDiscard
+	}
+	for _, unit := range units {
+		r.emit(&CITimedOut{unitEvent{unit}, action})
+	}
+	l := r.logger.WithFields(log.Fields{
+		"units":   units,
+		"timeout": r.ciTimeout,
+		"action":  action,
+	})
+
+	if action == TimeoutRecheck {
+		l.Warn("timed out waiting for CI, asking for a recheck")
+		for _, unit := range units {
+			for _, changeset := range unit.Changesets() {
+				if changeset.IsVerified() {
+					continue
+				}
+				if err := r.gerrit.PostMessage(ctx, changeset, r.recheckMessage); err != nil {
+					l.WithField("changeset", changeset).WithError(err).Warn("unable to ask for a recheck")
+				}
+			}
+		}
+		r.startWaiting()
+		r.mut.Lock()
+		r.rechecked = true
+		r.mut.Unlock()
+		return true
+	}
+
+	if action == TimeoutRequeue {
+		l.Warn("timed out waiting for CI, moving to the back of the queue")
+		for _, unit := range units {
+			for _, changeset := range unit.Changesets() {
+				r.requeued[changeset.ChangeID] = true
+			}
+		}
+	} else {
+		l.Warn("timed out waiting for CI, discarding")
+	}
+	return false
+}